@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"os"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Permission string
+
+const (
+	PermissionRead  Permission = "read"
+	PermissionWrite Permission = "write"
+	PermissionAdmin Permission = "admin"
+)
+
+var permissionRank = map[Permission]int{
+	PermissionRead:  1,
+	PermissionWrite: 2,
+	PermissionAdmin: 3,
+}
+
+// Check if p includes q, admin includes write which includes read
+func (p Permission) Allows(q Permission) bool {
+	return permissionRank[p] >= permissionRank[q] && permissionRank[q] > 0
+}
+
+func (p Permission) Valid() bool {
+	return permissionRank[p] > 0
+}
+
+// ApiKey is a pair of access key and secret used to authenticate requests,
+// the secret is kept as is since S3 signatures are computed from it
+type ApiKey struct {
+	mgm.DefaultModel `bson:",inline"`
+	Name             string `json:"name"`
+	AccessKey        string `bson:"access_key" json:"access_key"`
+	SecretKey        string `bson:"secret_key" json:"-"`
+	Admin            bool   `json:"admin"`
+}
+
+func (k *ApiKey) CreateIndex() error {
+	col := mgm.Coll(k)
+	_, err := col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.M{"access_key": 1},
+		Options: options.MergeIndexOptions(
+			options.Index().SetUnique(true),
+			options.Index().SetName("access_key"),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+var (
+	ErrApiKeyNotFound = errors.New("api key does not exist")
+	ErrAccessDenied   = errors.New("access denied")
+	ErrUnauthorized   = errors.New("authentication is required")
+)
+
+const (
+	accessKeyChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	accessKeyLen   = 20
+	secretKeyLen   = 30 // bytes, 40 base64 chars
+)
+
+func (k *ApiKey) Create() error {
+	return CreateApiKey(k)
+}
+
+// Generate a new access key and secret then store them
+func CreateApiKey(k *ApiKey) error {
+	ak := make([]byte, accessKeyLen)
+	for i := range ak {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(accessKeyChars))))
+		if err != nil {
+			return err
+		}
+		ak[i] = accessKeyChars[n.Int64()]
+	}
+	sk := make([]byte, secretKeyLen)
+	if _, err := rand.Read(sk); err != nil {
+		return err
+	}
+	k.AccessKey = string(ak)
+	k.SecretKey = base64.RawURLEncoding.EncodeToString(sk)
+
+	return Metadata().CreateApiKey(k)
+}
+
+// Root key configured through ROOT_ACCESS_KEY and ROOT_SECRET_KEY, it's never
+// stored and has admin access to everything
+func rootApiKey() *ApiKey {
+	ak, sk := os.Getenv("ROOT_ACCESS_KEY"), os.Getenv("ROOT_SECRET_KEY")
+	if ak == "" || sk == "" {
+		return nil
+	}
+	return &ApiKey{Name: "root", AccessKey: ak, SecretKey: sk, Admin: true}
+}
+
+func FetchApiKey(accessKey string) (*ApiKey, error) {
+	if root := rootApiKey(); root != nil && root.AccessKey == accessKey {
+		return root, nil
+	}
+	k, err := Metadata().FetchApiKey(accessKey)
+	if err == ErrRecordNotFound {
+		return nil, ErrApiKeyNotFound
+	}
+	return k, err
+}
+
+func FetchApiKeys() ([]ApiKey, error) {
+	return Metadata().FetchApiKeys()
+}
+
+func DeleteApiKey(accessKey string) error {
+	if _, err := Metadata().FetchApiKey(accessKey); err != nil {
+		if err == ErrRecordNotFound {
+			return ErrApiKeyNotFound
+		}
+		return err
+	}
+	return Metadata().DeleteApiKey(accessKey)
+}
+
+// secret lookup used to verify S3 signatures
+func apiKeySecret(accessKey string) (string, error) {
+	k, err := FetchApiKey(accessKey)
+	if err != nil {
+		if err == ErrApiKeyNotFound {
+			return "", ErrUnknownAccessKey
+		}
+		return "", err
+	}
+	return k.SecretKey, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type apiKeyPayload struct {
+	Name  string `json:"name" validate:"required,min=3,max=256"`
+	Admin bool   `json:"admin"`
+}
+
+func HandleApiKeyCreation(w http.ResponseWriter, r *http.Request) {
+	if err := AuthorizeAdmin(r); err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	var payload apiKeyPayload
+	if err := ParseAndValidate(r, &payload); err != nil {
+		SendValidationError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	defer r.Body.Close()
+
+	k := &ApiKey{
+		Name:  payload.Name,
+		Admin: payload.Admin,
+	}
+	if err := k.Create(); err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// secret is only shown once
+	SendJson(w, http.StatusCreated, Payload{
+		"message":    "api key created",
+		"name":       k.Name,
+		"access_key": k.AccessKey,
+		"secret_key": k.SecretKey,
+		"admin":      k.Admin,
+	})
+}
+
+func HandleApiKeysFetch(w http.ResponseWriter, r *http.Request) {
+	if err := AuthorizeAdmin(r); err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	keys, err := FetchApiKeys()
+	if err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{"keys": keys})
+}
+
+func HandleApiKeyDeletion(w http.ResponseWriter, r *http.Request) {
+	if err := AuthorizeAdmin(r); err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := DeleteApiKey(mux.Vars(r)["access_key"]); err != nil {
+		if err == ErrApiKeyNotFound {
+			SendHttpJsonError(w, http.StatusNotFound, err)
+			return
+		}
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{"message": "api key deleted"})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+type principalCtxKey struct{}
+
+// Authenticate requests with api key sent using basic auth
+// ex: curl -u <access_key>:<secret_key>
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ak, sk, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cloud-storage"`)
+			SendHttpJsonError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+
+		k, err := FetchApiKey(ak)
+		if err != nil && err != ErrApiKeyNotFound {
+			SendHttpJsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if k == nil || subtle.ConstantTimeCompare([]byte(k.SecretKey), []byte(sk)) != 1 {
+			SendHttpJsonError(w, http.StatusUnauthorized, errors.New("invalid access key or secret"))
+			return
+		}
+
+		next.ServeHTTP(w, WithPrincipal(r, k))
+	})
+}
+
+func WithPrincipal(r *http.Request, k *ApiKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalCtxKey{}, k))
+}
+
+// Api key that authenticated the request
+func Principal(r *http.Request) *ApiKey {
+	k, _ := r.Context().Value(principalCtxKey{}).(*ApiKey)
+	return k
+}
+
+// Fetch bucket and check that request principal has perm on it
+func AuthorizeBucket(r *http.Request, name string, perm Permission) (*Bucket, error) {
+	b, err := FetchBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	if !b.Allows(Principal(r), perm) {
+		return nil, ErrAccessDenied
+	}
+	return b, nil
+}
+
+// Fetch object and check that request principal has perm on its bucket
+func AuthorizeObject(r *http.Request, uuid string, perm Permission) (*Object, error) {
+	o, err := FetchObject(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := AuthorizeBucket(r, o.BucketName, perm); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Only admin keys can pass
+func AuthorizeAdmin(r *http.Request) error {
+	if k := Principal(r); k == nil || !k.Admin {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// Send the error with a status matching its type
+func SendAccessError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+		return SendHttpJsonError(w, http.StatusForbidden, err)
+	case errors.Is(err, ErrBucketNotFound), errors.Is(err, ErrRecordNotFound),
+		errors.Is(err, ErrVersionNotFound):
+		return SendHttpJsonError(w, http.StatusNotFound, err)
+	}
+	return SendHttpJsonError(w, http.StatusInternalServerError, err)
+}
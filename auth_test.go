@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPermissionAllows(t *testing.T) {
+	tests := []struct {
+		p, q Permission
+		want bool
+	}{
+		{PermissionAdmin, PermissionWrite, true},
+		{PermissionWrite, PermissionRead, true},
+		{PermissionRead, PermissionRead, true},
+		{PermissionRead, PermissionWrite, false},
+		{PermissionWrite, PermissionAdmin, false},
+		{PermissionAdmin, "owner", false},
+		{"", PermissionRead, false},
+	}
+	for _, tt := range tests {
+		if got := tt.p.Allows(tt.q); got != tt.want {
+			t.Errorf("%q allows %q: got %v", tt.p, tt.q, got)
+		}
+	}
+}
+
+func TestBucketGrants(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	k := &ApiKey{Name: "reader"}
+	if err := CreateApiKey(k); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Allows(nil, PermissionRead) || b.Allows(k, PermissionRead) {
+		t.Error("access allowed without grant")
+	}
+	if !b.Allows(&ApiKey{AccessKey: "other", Admin: true}, PermissionAdmin) {
+		t.Error("admin key denied")
+	}
+	if err := b.Grant("missing", PermissionRead); err != ErrApiKeyNotFound {
+		t.Errorf("got %v granting a missing key", err)
+	}
+	if err := b.Grant(k.AccessKey, "owner"); err == nil {
+		t.Error("invalid permission granted")
+	}
+
+	if err := b.Grant(k.AccessKey, PermissionRead); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = FetchBucket("photos")
+	if !b.Allows(k, PermissionRead) || b.Allows(k, PermissionWrite) {
+		t.Errorf("got grants %v, want read only", b.Grants)
+	}
+	// granting again replaces the permission
+	if err := b.Grant(k.AccessKey, PermissionWrite); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Grants) != 1 || !b.Allows(k, PermissionWrite) {
+		t.Errorf("got grants %v", b.Grants)
+	}
+	if err := b.Revoke(k.AccessKey); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = FetchBucket("photos")
+	if b.Allows(k, PermissionRead) {
+		t.Error("access kept after revoking")
+	}
+}
+
+func TestConcurrentBucketGrants(t *testing.T) {
+	setupStores(t)
+	newTestBucket(t, "photos")
+	var keys []*ApiKey
+	for i := 0; i < 8; i++ {
+		k := &ApiKey{Name: "reader"}
+		if err := CreateApiKey(k); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+
+	// every request works on its own copy of the bucket like the handlers do
+	var wg sync.WaitGroup
+	for _, k := range keys {
+		wg.Add(1)
+		go func(k *ApiKey) {
+			defer wg.Done()
+			b, _ := FetchBucket("photos")
+			if err := b.Grant(k.AccessKey, PermissionRead); err != nil {
+				t.Error(err)
+			}
+		}(k)
+	}
+	wg.Wait()
+	b, _ := FetchBucket("photos")
+	if len(b.Grants) != len(keys) {
+		t.Errorf("got %d grants, want %d", len(b.Grants), len(keys))
+	}
+
+	// settings updates of a stale copy keep the stored grants
+	stale := &Bucket{}
+	*stale = *b
+	stale.Grants = nil
+	if err := stale.Revoke(keys[0].AccessKey); err != nil {
+		t.Fatal(err)
+	}
+	b.Quota.MaxObjects = 10
+	if err := Metadata().UpdateBucket(b); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = FetchBucket("photos")
+	if len(b.Grants) != len(keys)-1 || b.Allows(keys[0], PermissionRead) {
+		t.Errorf("got grants %v after revoking and updating", b.Grants)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	setupStores(t)
+	t.Setenv("ROOT_ACCESS_KEY", "root")
+	t.Setenv("ROOT_SECRET_KEY", "rootsecret")
+	k := &ApiKey{Name: "app"}
+	if err := CreateApiKey(k); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *ApiKey
+	h := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = Principal(r)
+	}))
+	tests := []struct {
+		name      string
+		ak, sk    string
+		status    int
+		principal string
+	}{
+		{"no auth", "", "", http.StatusUnauthorized, ""},
+		{"root", "root", "rootsecret", http.StatusOK, "root"},
+		{"stored key", k.AccessKey, k.SecretKey, http.StatusOK, k.AccessKey},
+		{"wrong secret", k.AccessKey, "rootsecret", http.StatusUnauthorized, ""},
+		{"unknown key", "unknown", "rootsecret", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		got = nil
+		r := httptest.NewRequest(http.MethodGet, "/buckets", nil)
+		if tt.ak != "" {
+			r.SetBasicAuth(tt.ak, tt.sk)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d %s", tt.name, w.Code, w.Body)
+		}
+		if tt.principal != "" && (got == nil || got.AccessKey != tt.principal) {
+			t.Errorf("%s: got principal %v", tt.name, got)
+		}
+	}
+}
+
+func TestHandleBucketDeletionAccess(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	k := &ApiKey{Name: "writer"}
+	if err := CreateApiKey(k); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Grant(k.AccessKey, PermissionWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	del := func(k *ApiKey, name string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/bucket/"+name, nil)
+		r = WithPrincipal(r, k)
+		r = mux.SetURLVars(r, map[string]string{"name": name})
+		w := httptest.NewRecorder()
+		HandleBucketDeletion(w, r)
+		return w.Code
+	}
+	if code := del(k, "photos"); code != http.StatusForbidden {
+		t.Errorf("got %d deleting with write access, want 403", code)
+	}
+	if code := del(k, "missing"); code != http.StatusNotFound {
+		t.Errorf("got %d deleting a missing bucket, want 404", code)
+	}
+	if err := b.Grant(k.AccessKey, PermissionAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if code := del(k, "photos"); code != http.StatusOK {
+		t.Errorf("got %d deleting with admin access", code)
+	}
+}
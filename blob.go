@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Objects with the same content share a single blob file named by the
+// content hash, the blob counts the objects referencing it and is deleted
+// with the last one. Blobs are shared within a bucket, or across buckets with
+// DEDUP_SCOPE=global, DEDUP_SCOPE=off stores a file per object. Encrypted
+// objects always get their own file.
+
+const blobsDir = ".blobs"
+
+const (
+	DedupScopeBucket = "bucket"
+	DedupScopeGlobal = "global"
+	DedupScopeOff    = "off"
+)
+
+type Blob struct {
+	mgm.DefaultModel `bson:",inline"`
+	// storage path, also the blob key
+	Path   string `json:"path"`
+	SHA256 string `bson:"sha256" json:"sha256"`
+	Size   int64  `json:"size"`
+	// objects referencing the blob
+	Refs int `json:"refs"`
+}
+
+func (b *Blob) CreateIndex() error {
+	col := mgm.Coll(b)
+	_, err := col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.M{"path": 1},
+		Options: options.MergeIndexOptions(
+			options.Index().SetUnique(true),
+			options.Index().SetName("path"),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func isBlobPath(p string) bool {
+	return path.Dir(path.Dir(path.Dir(p))) == blobsDir
+}
+
+// Path of the blob holding content saved in bucket b, empty when the object
+// gets a file of its own. Bucket blobs are grouped by bucket id so renaming
+// the bucket doesn't move them.
+func blobPath(b *Bucket, o *Object) string {
+	if o.Encrypted || o.SHA256 == "" {
+		return ""
+	}
+	scope := b.ID.Hex()
+	switch os.Getenv("DEDUP_SCOPE") {
+	case DedupScopeOff:
+		return ""
+	case DedupScopeGlobal:
+		scope = "shared"
+	}
+	name := o.SHA256
+	if o.Encoding != "" {
+		// the same content stored as is and compressed
+		name += "." + o.Encoding
+	}
+	return path.Join(blobsDir, scope, o.SHA256[:2], name)
+}
+
+// blob path -> *sync.Mutex, blob references are counted one object at a time
+// so a blob can't be deleted while an object is being saved with it
+var blobLocks sync.Map
+
+func lockBlob(p string) func() {
+	v, _ := blobLocks.LoadOrStore(p, &sync.Mutex{})
+	m := v.(*sync.Mutex)
+	m.Lock()
+	return m.Unlock
+}
+
+// Store saved file p as blob bp and add a reference to it, the file is
+// dropped when the blob already exists. The blob must be locked.
+func storeBlob(p, bp string, sha string, size int64) error {
+	ok, err := Storage().Exists(bp)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = Storage().DeleteFile(p)
+	} else {
+		err = Storage().MoveFile(p, bp)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = Metadata().AddBlobRefs(&Blob{Path: bp, SHA256: sha, Size: size}, 1)
+	return err
+}
+
+// Remove a reference to blob bp, the blob is deleted with its last reference.
+// The blob must be locked.
+func unrefBlob(bp string) error {
+	refs, err := Metadata().AddBlobRefs(&Blob{Path: bp}, -1)
+	if err == ErrRecordNotFound {
+		// counted again by recovery
+		return nil
+	}
+	if err != nil || refs > 0 {
+		return err
+	}
+	if err := ignoreNotFound(Storage().DeleteFile(bp)); err != nil {
+		return err
+	}
+	return Metadata().DeleteBlob(bp)
+}
+
+// Fetch blob p and count the objects referencing it, the blob must be locked
+// so saves and deletes in progress aren't counted half way
+func countBlobRefs(p string) (*Blob, int, error) {
+	b, err := Metadata().FetchBlob(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := Metadata().CountBlobObjects(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, n, nil
+}
+
+// Set blob references to the objects referencing it, unreferenced blobs are
+// deleted. Returns the references the blob had and the objects counted.
+func recountBlob(p string) (int, int, error) {
+	unlock := lockBlob(p)
+	defer unlock()
+
+	b, n, err := countBlobRefs(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n == 0 {
+		if err := ignoreNotFound(Storage().DeleteFile(p)); err != nil {
+			return 0, 0, err
+		}
+		return b.Refs, n, Metadata().DeleteBlob(p)
+	}
+	if n != b.Refs {
+		if _, err := Metadata().AddBlobRefs(b, n-b.Refs); err != nil {
+			return 0, 0, err
+		}
+	}
+	return b.Refs, n, nil
+}
+
+// Count references of every blob again, interrupted saves and deletes can
+// leave them off by one
+func RecountBlobs() error {
+	blobs, err := Metadata().FetchBlobs()
+	if err != nil {
+		return err
+	}
+	for i := range blobs {
+		refs, n, err := recountBlob(blobs[i].Path)
+		if err == ErrRecordNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if refs != n {
+			log.Printf("blob %s had %d references instead of %d\n", blobs[i].Path, refs, n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDedupBlobs(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	first := saveTestObject(t, b, "a.png", "same")
+	second := saveTestObject(t, b, "b.png", "same")
+	other := saveTestObject(t, b, "c.png", "other")
+
+	if first.Blob == "" || first.Blob != second.Blob || other.Blob == first.Blob {
+		t.Fatalf("got blobs %q, %q and %q", first.Blob, second.Blob, other.Blob)
+	}
+	if !isBlobPath(first.Blob) {
+		t.Errorf("%s isn't a blob path", first.Blob)
+	}
+	if blob, err := Metadata().FetchBlob(first.Blob); err != nil || blob.Refs != 2 {
+		t.Fatalf("got %+v, %v, want 2 references", blob, err)
+	}
+	if u, _ := FetchBucketUsage(b); u.Bytes != 13 || u.StoredBytes != 13 {
+		t.Errorf("got usage %+v, shared content counts for each object", u)
+	}
+
+	if err := DeleteObject(first.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if blob, err := Metadata().FetchBlob(first.Blob); err != nil || blob.Refs != 1 {
+		t.Errorf("got %+v, %v, want 1 reference", blob, err)
+	}
+	if ok, _ := Storage().Exists(first.Blob); !ok {
+		t.Fatal("blob deleted with references left")
+	}
+
+	if err := DeleteObject(second.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Metadata().FetchBlob(first.Blob); err != ErrRecordNotFound {
+		t.Errorf("blob fetched after the last reference: %v", err)
+	}
+	if ok, _ := Storage().Exists(first.Blob); ok {
+		t.Error("blob file kept after the last reference")
+	}
+}
+
+func TestDedupScope(t *testing.T) {
+	setupStores(t)
+	photos := newTestBucket(t, "photos")
+	videos := newTestBucket(t, "videos")
+	if a, b := saveTestObject(t, photos, "a.png", "same"), saveTestObject(t, videos, "a.png", "same"); a.Blob == b.Blob {
+		t.Errorf("buckets share blob %s", a.Blob)
+	}
+
+	t.Setenv("DEDUP_SCOPE", DedupScopeGlobal)
+	if a, b := saveTestObject(t, photos, "b.png", "shared"), saveTestObject(t, videos, "b.png", "shared"); a.Blob != b.Blob {
+		t.Errorf("got blobs %s and %s across buckets", a.Blob, b.Blob)
+	}
+
+	t.Setenv("DEDUP_SCOPE", DedupScopeOff)
+	if o := saveTestObject(t, photos, "c.png", "same"); o.Blob != "" {
+		t.Errorf("got blob %s without dedup", o.Blob)
+	}
+
+	// content encrypted with a customer key isn't shared
+	t.Setenv("DEDUP_SCOPE", "")
+	o := &Object{Type: "image/png"}
+	if _, err := SaveObject(o, &SaveConfig{
+		BucketID:    photos.Name,
+		Reader:      strings.NewReader("same"),
+		Key:         "d.png",
+		CustomerKey: []byte(strings.Repeat("k", encKeySize)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Blob != "" {
+		t.Errorf("got blob %s for encrypted content", o.Blob)
+	}
+}
+
+func TestRecountBlobs(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "same")
+	saveTestObject(t, b, "b.png", "same")
+
+	// interrupted delete left a reference too many
+	if _, err := Metadata().AddBlobRefs(&Blob{Path: o.Blob}, 1); err != nil {
+		t.Fatal(err)
+	}
+	// and a blob nothing references
+	orphan := &Blob{Path: blobsDir + "/" + b.ID.Hex() + "/ab/abcd", SHA256: "abcd", Size: 1}
+	if _, err := Storage().CreateFile(orphan.Path, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Metadata().AddBlobRefs(orphan, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecountBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := Metadata().FetchBlob(o.Blob); blob == nil || blob.Refs != 2 {
+		t.Errorf("got %+v, want 2 references", blob)
+	}
+	if _, err := Metadata().FetchBlob(orphan.Path); err != ErrRecordNotFound {
+		t.Errorf("unreferenced blob fetched: %v", err)
+	}
+	if ok, _ := Storage().Exists(orphan.Path); ok {
+		t.Error("unreferenced blob file kept")
+	}
+}
@@ -0,0 +1,972 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	boltBuckets  = []byte("buckets")
+	boltObjects  = []byte("objects")
+	boltSessions = []byte("sessions")
+	boltApiKeys  = []byte("api_keys")
+	boltUploads  = []byte("uploads")
+
+	boltMultipartUploads = []byte("multipart_uploads")
+	boltUploadParts      = []byte("upload_parts")
+	boltJournal          = []byte("journal")
+	boltBucketUsage      = []byte("bucket_usage")
+	boltJobs             = []byte("jobs")
+	boltBlobs            = []byte("blobs")
+)
+
+// BoltStore keeps metadata in an embedded bbolt file, records are bson encoded
+// and lookups other than the primary key scan the whole table, which is fine
+// for small deployments and test runs
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, t := range [][]byte{boltBuckets, boltObjects, boltSessions, boltApiKeys, boltUploads,
+			boltMultipartUploads, boltUploadParts, boltJournal, boltBucketUsage, boltJobs, boltBlobs} {
+			if _, err := tx.CreateBucketIfNotExists(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// set model id and timestamps the same way mgm does on create
+func prepareModel(m *mgm.DefaultModel) {
+	if m.ID.IsZero() {
+		m.ID = primitive.NewObjectID()
+	}
+	m.Creating()
+	m.Saving()
+}
+
+func (s *BoltStore) put(table []byte, key string, v any) error {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(table).Put([]byte(key), b)
+	})
+}
+
+func (s *BoltStore) get(table []byte, key string, v any) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(table).Get([]byte(key))
+		if b == nil {
+			return ErrRecordNotFound
+		}
+		return bson.Unmarshal(b, v)
+	})
+}
+
+func (s *BoltStore) delete(table []byte, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(table).Delete([]byte(key))
+	})
+}
+
+// iterate over all records of table, decoding is left to fn
+func (s *BoltStore) each(table []byte, fn func(v []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(table).ForEach(func(_, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+func (s *BoltStore) CreateBucket(b *Bucket) error {
+	prepareModel(&b.DefaultModel)
+	return s.put(boltBuckets, b.Name, b)
+}
+
+func (s *BoltStore) FetchBucket(name string) (*Bucket, error) {
+	var b Bucket
+	if err := s.get(boltBuckets, name, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *BoltStore) FetchBuckets() ([]Bucket, error) {
+	buckets := []Bucket{}
+	err := s.each(boltBuckets, func(v []byte) error {
+		var b Bucket
+		if err := bson.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		buckets = append(buckets, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+func (s *BoltStore) UpdateBucket(b *Bucket) error {
+	b.Saving()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltBuckets)
+		if v := t.Get([]byte(b.Name)); v != nil {
+			var prev Bucket
+			if err := bson.Unmarshal(v, &prev); err != nil {
+				return err
+			}
+			b.Deleting = b.Deleting || prev.Deleting
+			b.Grants = prev.Grants
+		}
+		return boltPut(t, b.Name, b)
+	})
+}
+
+func (s *BoltStore) PutBucketGrant(name string, g BucketGrant) ([]BucketGrant, error) {
+	return s.updateBucketGrants(name, func(grants []BucketGrant) []BucketGrant {
+		return append(withoutGrant(grants, g.AccessKey), g)
+	})
+}
+
+func (s *BoltStore) DeleteBucketGrant(name string, accessKey string) ([]BucketGrant, error) {
+	return s.updateBucketGrants(name, func(grants []BucketGrant) []BucketGrant {
+		return withoutGrant(grants, accessKey)
+	})
+}
+
+func (s *BoltStore) updateBucketGrants(name string, fn func([]BucketGrant) []BucketGrant) ([]BucketGrant, error) {
+	var grants []BucketGrant
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltBuckets)
+		v := t.Get([]byte(name))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		var b Bucket
+		if err := bson.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		b.Grants = fn(b.Grants)
+		grants = b.Grants
+		b.Saving()
+		return boltPut(t, name, &b)
+	})
+	return grants, err
+}
+
+func (s *BoltStore) SetBucketDeleting(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltBuckets)
+		v := t.Get([]byte(name))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		var b Bucket
+		if err := bson.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		b.Deleting = true
+		b.Saving()
+		return boltPut(t, name, &b)
+	})
+}
+
+func (s *BoltStore) SetBucketDataKey(name string, masterKeyID string, dataKey string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltBuckets)
+		v := t.Get([]byte(name))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		var b Bucket
+		if err := bson.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		b.Encryption.MasterKeyID = masterKeyID
+		b.Encryption.DataKey = dataKey
+		b.Saving()
+		return boltPut(t, name, &b)
+	})
+}
+
+func (s *BoltStore) DeleteBucket(b *Bucket) error {
+	return s.delete(boltBuckets, b.Name)
+}
+
+// bucket names are the table keys so the cursor walks them in order
+func (s *BoltStore) ListBuckets(prefix string, after string, limit int) ([]Bucket, error) {
+	buckets := []Bucket{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBuckets).Cursor()
+		k, v := c.Seek([]byte(prefix))
+		if after > prefix {
+			k, v = c.Seek([]byte(after))
+		}
+		for ; k != nil && len(buckets) < limit; k, v = c.Next() {
+			if !bytes.HasPrefix(k, []byte(prefix)) {
+				break
+			}
+			if string(k) == after {
+				continue
+			}
+			var b Bucket
+			if err := bson.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			buckets = append(buckets, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+func (s *BoltStore) RenameBucket(name string, newName string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltBuckets)
+		v := t.Get([]byte(name))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		if t.Get([]byte(newName)) != nil {
+			return ErrBucketExists
+		}
+		var b Bucket
+		if err := bson.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		b.Name = newName
+		b.Saving()
+		if err := boltPut(t, newName, &b); err != nil {
+			return err
+		}
+		if err := t.Delete([]byte(name)); err != nil {
+			return err
+		}
+
+		err := boltRewrite(tx.Bucket(boltObjects), func(v []byte) (any, error) {
+			var o Object
+			if err := bson.Unmarshal(v, &o); err != nil || o.BucketName != name {
+				return nil, err
+			}
+			o.BucketName = newName
+			o.Directory = renamedDir(o.Directory, name, newName)
+			return &o, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = boltRewrite(tx.Bucket(boltUploads), func(v []byte) (any, error) {
+			var u Upload
+			if err := bson.Unmarshal(v, &u); err != nil || u.BucketName != name {
+				return nil, err
+			}
+			u.BucketName = newName
+			return &u, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = boltRewrite(tx.Bucket(boltMultipartUploads), func(v []byte) (any, error) {
+			var u MultipartUpload
+			if err := bson.Unmarshal(v, &u); err != nil || u.BucketName != name {
+				return nil, err
+			}
+			u.BucketName = newName
+			return &u, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		t = tx.Bucket(boltBucketUsage)
+		if v := t.Get([]byte(name)); v != nil {
+			var u BucketUsage
+			if err := bson.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			u.Bucket = newName
+			if err := boltPut(t, newName, &u); err != nil {
+				return err
+			}
+			return t.Delete([]byte(name))
+		}
+		return nil
+	})
+}
+
+func boltPut(t *bolt.Bucket, key string, v any) error {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.Put([]byte(key), b)
+}
+
+// replace the records fn returns a new value for, records can't be written
+// while the table is iterated so they are collected first
+func boltRewrite(t *bolt.Bucket, fn func(v []byte) (any, error)) error {
+	updates := map[string]any{}
+	err := t.ForEach(func(k, v []byte) error {
+		n, err := fn(v)
+		if err != nil {
+			return err
+		}
+		if n != nil {
+			updates[string(k)] = n
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updates {
+		if err := boltPut(t, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) FetchBucketUsage(bucket string) (*BucketUsage, error) {
+	var u BucketUsage
+	if err := s.get(boltBucketUsage, bucket, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *BoltStore) PutBucketUsage(u *BucketUsage) error {
+	prepareModel(&u.DefaultModel)
+	return s.put(boltBucketUsage, u.Bucket, u)
+}
+
+func (s *BoltStore) AddBucketUsage(bucket string, bytes int64, stored int64, objects int, q *BucketQuota) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltBucketUsage)
+		v := t.Get([]byte(bucket))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		var u BucketUsage
+		if err := bson.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		u.Bytes += bytes
+		u.StoredBytes += stored
+		u.Objects += objects
+		if q != nil && ((q.MaxBytes > 0 && u.Bytes > q.MaxBytes) || (q.MaxObjects > 0 && u.Objects > q.MaxObjects)) {
+			return ErrRecordNotFound
+		}
+		u.Saving()
+
+		b, err := bson.Marshal(&u)
+		if err != nil {
+			return err
+		}
+		return t.Put([]byte(bucket), b)
+	})
+}
+
+func (s *BoltStore) DeleteBucketUsage(bucket string) error {
+	return s.delete(boltBucketUsage, bucket)
+}
+
+func (s *BoltStore) CreateObject(o *Object) error {
+	prepareModel(&o.DefaultModel)
+	return s.put(boltObjects, o.UUID, o)
+}
+
+func (s *BoltStore) FetchObject(uuid string) (*Object, error) {
+	var o Object
+	if err := s.get(boltObjects, uuid, &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (s *BoltStore) FetchObjectByKey(bucket string, key string) (*Object, error) {
+	var latest *Object
+	err := s.each(boltObjects, func(v []byte) error {
+		var o Object
+		if err := bson.Unmarshal(v, &o); err != nil {
+			return err
+		}
+		if o.BucketName == bucket && o.Key == key &&
+			(latest == nil || o.CreatedAt.After(latest.CreatedAt)) {
+			latest = &o
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, ErrRecordNotFound
+	}
+	return latest, nil
+}
+
+func (s *BoltStore) FetchObjectVersions(bucket string, key string) ([]Object, error) {
+	objects := []Object{}
+	err := s.each(boltObjects, func(v []byte) error {
+		var o Object
+		if err := bson.Unmarshal(v, &o); err != nil {
+			return err
+		}
+		if o.BucketName == bucket && o.Key == key {
+			objects = append(objects, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].CreatedAt.After(objects[j].CreatedAt)
+	})
+	return objects, nil
+}
+
+func (s *BoltStore) UpdateObject(o *Object) error {
+	o.Saving()
+	return s.put(boltObjects, o.UUID, o)
+}
+
+func (s *BoltStore) EachObject(fn func(o *Object) error) error {
+	return s.each(boltObjects, func(v []byte) error {
+		var o Object
+		if err := bson.Unmarshal(v, &o); err != nil {
+			return err
+		}
+		return fn(&o)
+	})
+}
+
+func (s *BoltStore) DeleteObject(uuid string) error {
+	return s.delete(boltObjects, uuid)
+}
+
+func (s *BoltStore) FetchBucketObjects(bucket string) ([]Object, error) {
+	var objects []Object
+	err := s.each(boltObjects, func(v []byte) error {
+		var o Object
+		if err := bson.Unmarshal(v, &o); err != nil {
+			return err
+		}
+		if o.BucketName == bucket {
+			objects = append(objects, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *BoltStore) FetchBucketObjectsBatch(bucket string, limit int) ([]Object, error) {
+	objects := []Object{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltObjects).Cursor()
+		for k, v := c.First(); k != nil && len(objects) < limit; k, v = c.Next() {
+			var o Object
+			if err := bson.Unmarshal(v, &o); err != nil {
+				return err
+			}
+			if o.BucketName == bucket {
+				objects = append(objects, o)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *BoltStore) ListObjects(q *ObjectsQuery) ([]Object, error) {
+	latest := map[string]Object{}
+	err := s.each(boltObjects, func(v []byte) error {
+		var o Object
+		if err := bson.Unmarshal(v, &o); err != nil {
+			return err
+		}
+		if o.BucketName != q.Bucket || !strings.HasPrefix(o.Key, q.Prefix) {
+			return nil
+		}
+		if l, ok := latest[o.Key]; !ok || o.CreatedAt.After(l.CreatedAt) {
+			latest[o.Key] = o
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []Object{}
+	for _, o := range latest {
+		if o.DeleteMarker || (q.After != nil && !q.After.Before(&o, q.Sort, q.Desc)) {
+			continue
+		}
+		objects = append(objects, o)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return cursorOf(&objects[i]).Before(&objects[j], q.Sort, q.Desc)
+	})
+	if len(objects) > q.Limit {
+		objects = objects[:q.Limit]
+	}
+	return objects, nil
+}
+
+func (s *BoltStore) CreateSession(ss *ObjectSharingSession) error {
+	prepareModel(&ss.DefaultModel)
+	return s.put(boltSessions, ss.ID.Hex(), ss)
+}
+
+func (s *BoltStore) FetchSession(id string) (*ObjectSharingSession, error) {
+	var ss ObjectSharingSession
+	if err := s.get(boltSessions, id, &ss); err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+func (s *BoltStore) fetchSessions(ouuid string) ([]ObjectSharingSession, error) {
+	sessions := []ObjectSharingSession{}
+	err := s.each(boltSessions, func(v []byte) error {
+		var ss ObjectSharingSession
+		if err := bson.Unmarshal(v, &ss); err != nil {
+			return err
+		}
+		if ss.OUUID == ouuid {
+			sessions = append(sessions, ss)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *BoltStore) FetchLatestSession(ouuid string) (*ObjectSharingSession, error) {
+	sessions, err := s.fetchSessions(ouuid)
+	if err != nil {
+		return nil, err
+	}
+	var latest *ObjectSharingSession
+	for i := range sessions {
+		if latest == nil || sessions[i].ExpiryDate.After(latest.ExpiryDate) {
+			latest = &sessions[i]
+		}
+	}
+	if latest == nil {
+		return nil, ErrRecordNotFound
+	}
+	return latest, nil
+}
+
+func (s *BoltStore) FetchObjectSessions(ouuid string) ([]ObjectSharingSession, error) {
+	sessions, err := s.fetchSessions(ouuid)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+func (s *BoltStore) RevokeSession(id string, at time.Time) (*ObjectSharingSession, error) {
+	var ss ObjectSharingSession
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltSessions)
+		v := t.Get([]byte(id))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		if err := bson.Unmarshal(v, &ss); err != nil {
+			return err
+		}
+		if ss.IsRevoked() {
+			return nil
+		}
+		ss.RevokedAt = &at
+		ss.Saving()
+		return boltPut(t, id, &ss)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+func (s *BoltStore) IncrementSessionDownloads(id string) (*ObjectSharingSession, error) {
+	var ss ObjectSharingSession
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltSessions)
+		v := t.Get([]byte(id))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		if err := bson.Unmarshal(v, &ss); err != nil {
+			return err
+		}
+		if ss.IsExhausted() {
+			return ErrRecordNotFound
+		}
+		ss.Downloads++
+
+		b, err := bson.Marshal(&ss)
+		if err != nil {
+			return err
+		}
+		return t.Put([]byte(id), b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+func (s *BoltStore) CreateUpload(u *Upload) error {
+	prepareModel(&u.DefaultModel)
+	return s.put(boltUploads, u.ID.Hex(), u)
+}
+
+func (s *BoltStore) FetchUpload(id string) (*Upload, error) {
+	var u Upload
+	if err := s.get(boltUploads, id, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *BoltStore) UpdateUpload(u *Upload) error {
+	u.Saving()
+	return s.put(boltUploads, u.ID.Hex(), u)
+}
+
+func (s *BoltStore) DeleteUpload(u *Upload) error {
+	return s.delete(boltUploads, u.ID.Hex())
+}
+
+func (s *BoltStore) FetchUploadsExpiredBefore(t time.Time) ([]Upload, error) {
+	uploads := []Upload{}
+	err := s.each(boltUploads, func(v []byte) error {
+		var u Upload
+		if err := bson.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		if u.ExpiresAt.Before(t) {
+			uploads = append(uploads, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (s *BoltStore) CreateMultipartUpload(u *MultipartUpload) error {
+	prepareModel(&u.DefaultModel)
+	return s.put(boltMultipartUploads, u.ID.Hex(), u)
+}
+
+func (s *BoltStore) FetchMultipartUpload(id string) (*MultipartUpload, error) {
+	var u MultipartUpload
+	if err := s.get(boltMultipartUploads, id, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *BoltStore) FetchMultipartUploadsBefore(t time.Time) ([]MultipartUpload, error) {
+	uploads := []MultipartUpload{}
+	err := s.each(boltMultipartUploads, func(v []byte) error {
+		var u MultipartUpload
+		if err := bson.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		if u.CreatedAt.Before(t) {
+			uploads = append(uploads, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (s *BoltStore) FetchIdleMultipartUploads(t time.Time) ([]MultipartUpload, error) {
+	uploads := []MultipartUpload{}
+	err := s.each(boltMultipartUploads, func(v []byte) error {
+		var u MultipartUpload
+		if err := bson.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		if u.UpdatedAt.Before(t) {
+			uploads = append(uploads, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (s *BoltStore) TouchMultipartUpload(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltMultipartUploads)
+		v := t.Get([]byte(id))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		var u MultipartUpload
+		if err := bson.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		u.Saving()
+		return boltPut(t, id, &u)
+	})
+}
+
+func (s *BoltStore) DeleteMultipartUpload(u *MultipartUpload) error {
+	return s.delete(boltMultipartUploads, u.ID.Hex())
+}
+
+// parts are keyed by <upload id>/<number> so they are grouped per upload
+func uploadPartKey(uploadID string, n int) string {
+	return fmt.Sprintf("%s/%05d", uploadID, n)
+}
+
+func (s *BoltStore) PutUploadPart(p *UploadPart) error {
+	prepareModel(&p.DefaultModel)
+	return s.put(boltUploadParts, uploadPartKey(p.UploadID, p.Number), p)
+}
+
+func (s *BoltStore) FetchUploadParts(uploadID string) ([]UploadPart, error) {
+	parts := []UploadPart{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltUploadParts).Cursor()
+		prefix := []byte(uploadID + "/")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var p UploadPart
+			if err := bson.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			parts = append(parts, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+func (s *BoltStore) DeleteUploadParts(uploadID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltUploadParts).Cursor()
+		prefix := []byte(uploadID + "/")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) CreateApiKey(k *ApiKey) error {
+	prepareModel(&k.DefaultModel)
+	return s.put(boltApiKeys, k.AccessKey, k)
+}
+
+func (s *BoltStore) FetchApiKey(accessKey string) (*ApiKey, error) {
+	var k ApiKey
+	if err := s.get(boltApiKeys, accessKey, &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s *BoltStore) FetchApiKeys() ([]ApiKey, error) {
+	keys := []ApiKey{}
+	err := s.each(boltApiKeys, func(v []byte) error {
+		var k ApiKey
+		if err := bson.Unmarshal(v, &k); err != nil {
+			return err
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *BoltStore) DeleteApiKey(accessKey string) error {
+	return s.delete(boltApiKeys, accessKey)
+}
+
+func (s *BoltStore) CreateJournalEntry(e *JournalEntry) error {
+	prepareModel(&e.DefaultModel)
+	return s.put(boltJournal, e.ID.Hex(), e)
+}
+
+// entries are keyed by object id so they come in creation order
+func (s *BoltStore) FetchJournalEntries() ([]JournalEntry, error) {
+	entries := []JournalEntry{}
+	err := s.each(boltJournal, func(v []byte) error {
+		var e JournalEntry
+		if err := bson.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *BoltStore) DeleteJournalEntry(e *JournalEntry) error {
+	return s.delete(boltJournal, e.ID.Hex())
+}
+
+func (s *BoltStore) AddBlobRefs(b *Blob, n int) (int, error) {
+	refs := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(boltBlobs)
+		var cur Blob
+		if v := t.Get([]byte(b.Path)); v != nil {
+			if err := bson.Unmarshal(v, &cur); err != nil {
+				return err
+			}
+			cur.Saving()
+		} else if n > 0 {
+			cur = Blob{Path: b.Path, SHA256: b.SHA256, Size: b.Size}
+			prepareModel(&cur.DefaultModel)
+		} else {
+			return ErrRecordNotFound
+		}
+		cur.Refs += n
+		refs = cur.Refs
+		return boltPut(t, b.Path, &cur)
+	})
+	return refs, err
+}
+
+func (s *BoltStore) FetchBlob(path string) (*Blob, error) {
+	var b Blob
+	if err := s.get(boltBlobs, path, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *BoltStore) FetchBlobs() ([]Blob, error) {
+	blobs := []Blob{}
+	err := s.each(boltBlobs, func(v []byte) error {
+		var b Blob
+		if err := bson.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		blobs = append(blobs, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+func (s *BoltStore) DeleteBlob(path string) error {
+	return s.delete(boltBlobs, path)
+}
+
+func (s *BoltStore) CountBlobObjects(path string) (int, error) {
+	n := 0
+	err := s.EachObject(func(o *Object) error {
+		if o.Blob == path {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *BoltStore) CreateJob(j *Job) error {
+	prepareModel(&j.DefaultModel)
+	return s.put(boltJobs, j.ID.Hex(), j)
+}
+
+func (s *BoltStore) FetchJob(id string) (*Job, error) {
+	var j Job
+	if err := s.get(boltJobs, id, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// jobs are keyed by object id so they come in creation order
+func (s *BoltStore) FetchUnfinishedJobs() ([]Job, error) {
+	jobs := []Job{}
+	err := s.each(boltJobs, func(v []byte) error {
+		var j Job
+		if err := bson.Unmarshal(v, &j); err != nil {
+			return err
+		}
+		if !j.IsFinished() {
+			jobs = append(jobs, j)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *BoltStore) UpdateJob(j *Job) error {
+	j.Saving()
+	return s.put(boltJobs, j.ID.Hex(), j)
+}
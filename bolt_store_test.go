@@ -0,0 +1,173 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestBoltStore(t *testing.T) (*BoltStore, string) {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "storage.db")
+	s, err := NewBoltStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, p
+}
+
+func TestBoltStoreBuckets(t *testing.T) {
+	s, p := newTestBoltStore(t)
+	for _, name := range []string{"photos-b", "videos", "photos-a"} {
+		if err := s.CreateBucket(&Bucket{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.FetchBucket("missing"); err != ErrRecordNotFound {
+		t.Errorf("got %v, want not found", err)
+	}
+
+	names := func(bs []Bucket) []string {
+		ns := []string{}
+		for _, b := range bs {
+			ns = append(ns, b.Name)
+		}
+		return ns
+	}
+	tests := []struct {
+		prefix, after string
+		limit         int
+		want          []string
+	}{
+		{"", "", 10, []string{"photos-a", "photos-b", "videos"}},
+		{"photos", "", 10, []string{"photos-a", "photos-b"}},
+		{"", "photos-a", 1, []string{"photos-b"}},
+		{"photos", "photos-b", 10, []string{}},
+	}
+	for _, tt := range tests {
+		bs, err := s.ListBuckets(tt.prefix, tt.after, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(bs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("prefix %q after %q: got %v, want %v", tt.prefix, tt.after, got, tt.want)
+		}
+	}
+
+	// records are kept across restarts
+	s.Close()
+	s, err := NewBoltStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if b, err := s.FetchBucket("videos"); err != nil || b.Name != "videos" {
+		t.Errorf("got %v, %v after reopening", b, err)
+	}
+}
+
+func TestBoltStoreObjects(t *testing.T) {
+	s, _ := newTestBoltStore(t)
+	for _, uuid := range []string{"v1", "v2"} {
+		if err := s.CreateObject(&Object{UUID: uuid, BucketName: "b", Key: "a.png", Directory: "b/dir"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := s.CreateObject(&Object{UUID: "other", BucketName: "c", Key: "a.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if o, err := s.FetchObjectByKey("b", "a.png"); err != nil || o.UUID != "v2" {
+		t.Errorf("got %v, %v, want the latest version", o, err)
+	}
+	vs, err := s.FetchObjectVersions("b", "a.png")
+	if err != nil || len(vs) != 2 || vs[0].UUID != "v2" {
+		t.Errorf("got %v, %v, want versions latest first", vs, err)
+	}
+	if obs, err := s.FetchBucketObjectsBatch("b", 1); err != nil || len(obs) != 1 {
+		t.Errorf("got %d objects, %v, want 1", len(obs), err)
+	}
+
+	if err := s.CreateBucket(&Bucket{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RenameBucket("b", "d"); err != nil {
+		t.Fatal(err)
+	}
+	o, err := s.FetchObject("v1")
+	if err != nil || o.BucketName != "d" || o.Directory != "d/dir" {
+		t.Errorf("got %+v, %v, want object moved to the renamed bucket", o, err)
+	}
+
+	if err := s.DeleteObject("v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FetchObject("v1"); err != ErrRecordNotFound {
+		t.Errorf("deleted object fetched: %v", err)
+	}
+}
+
+func TestBoltStoreBucketUsage(t *testing.T) {
+	s, _ := newTestBoltStore(t)
+	if err := s.AddBucketUsage("b", 1, 1, 1, nil); err != ErrRecordNotFound {
+		t.Errorf("got %v without usage, want not found", err)
+	}
+	if err := s.PutBucketUsage(&BucketUsage{Bucket: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &BucketQuota{MaxBytes: 10, MaxObjects: 2}
+	if err := s.AddBucketUsage("b", 6, 3, 1, q); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBucketUsage("b", 6, 3, 1, q); err != ErrRecordNotFound {
+		t.Errorf("got %v going over quota, want not found", err)
+	}
+	if err := s.AddBucketUsage("b", -6, -3, -1, q); err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.FetchBucketUsage("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Bytes != 0 || u.StoredBytes != 0 || u.Objects != 0 {
+		t.Errorf("got usage %+v, want none", u)
+	}
+}
+
+func TestBoltStoreSessionDownloads(t *testing.T) {
+	s, _ := newTestBoltStore(t)
+	sess := &ObjectSharingSession{OUUID: "a", MaxDownloads: 2}
+	if err := s.CreateSession(sess); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		got, err := s.IncrementSessionDownloads(sess.ID.Hex())
+		if err != nil || got.Downloads != i {
+			t.Fatalf("got %v, %v", got, err)
+		}
+	}
+	if _, err := s.IncrementSessionDownloads(sess.ID.Hex()); err != ErrRecordNotFound {
+		t.Errorf("got %v past max downloads, want not found", err)
+	}
+}
+
+func TestBoltStoreBlobRefs(t *testing.T) {
+	s, _ := newTestBoltStore(t)
+	b := &Blob{Path: ".blobs/a", SHA256: "a", Size: 1}
+	if _, err := s.AddBlobRefs(b, -1); err != ErrRecordNotFound {
+		t.Errorf("got %v removing a reference of a missing blob", err)
+	}
+	if n, err := s.AddBlobRefs(b, 2); err != nil || n != 2 {
+		t.Errorf("got %d, %v, want 2 references", n, err)
+	}
+	if n, err := s.AddBlobRefs(b, -1); err != nil || n != 1 {
+		t.Errorf("got %d, %v, want 1 reference", n, err)
+	}
+	if got, err := s.FetchBlob(b.Path); err != nil || got.Refs != 1 || got.SHA256 != "a" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+}
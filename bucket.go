@@ -1,17 +1,17 @@
 package main
 
 import (
-	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
 	"math/big"
+	"path"
 	"regexp"
 	"strings"
 
 	"github.com/kamva/mgm/v3"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
@@ -20,38 +20,133 @@ const (
 
 type Bucket struct {
 	mgm.DefaultModel `bson:",inline"`
-	Name             string `json:"name"`
+	Name             string        `json:"name"`
+	Grants           []BucketGrant `json:"grants"`
+
+	// keep every version of objects saved under the same key
+	Versioning bool `json:"versioning"`
+
+	Lifecycle []LifecycleRule `json:"lifecycle"`
+
+	Quota BucketQuota `json:"quota"`
+
+	// objects saved while enabled are encrypted at rest
+	Encryption BucketEncryption `json:"encryption"`
+
+	// set while a recursive delete job empties the bucket
+	Deleting bool `bson:"deleting" json:"deleting"`
+
+	// filled when the bucket is fetched on its own
+	Usage *BucketUsage `bson:"-" json:"usage,omitempty"`
+}
+
+// BucketGrant gives an api key access to the bucket
+type BucketGrant struct {
+	AccessKey  string     `bson:"access_key" json:"access_key"`
+	Permission Permission `json:"permission"`
 }
 
+var (
+	ErrBucketExists   = errors.New("bucket already exists")
+	ErrBucketNotFound = errors.New("bucket does not exist")
+	ErrBucketNotEmpty = errors.New("bucket is not empty")
+	// names become directory names so they can't hold paths
+	ErrInvalidBucketName = errors.New("bucket name can't contain slashes or start with a dot")
+)
+
 // Create bucket
 func (b *Bucket) Create() error {
 	return CreateBucket(b)
 }
 
 func CreateBucket(b *Bucket) error {
+	b.mutateName() // mutate name to avoid collision
+	return createBucket(b)
+}
+
+// Create bucket with the exact givin name
+func createBucket(b *Bucket) error {
 	// Validate bucket existence
-	if exists, err := Exists(b.Name); err != nil {
-		if err != nil {
-			return err
-		} else if exists {
-			return errors.New("bucket already exists")
-		}
+	if exists, err := BucketExists(b.Name); err != nil {
+		return err
+	} else if exists {
+		return ErrBucketExists
+	}
+
+	j, err := beginJournal(&JournalEntry{Op: JournalBucketCreate, Bucket: b.Name})
+	if err != nil {
+		return err
 	}
-	b.mutateName() // mutate name to avoid collision
 
 	// Create bucket
-	_, err := CreateDir(b.Name)
+	if err := Storage().CreateDir(b.Name); err != nil {
+		j.Done()
+		return err
+	}
+
+	// Store bucket metadata, the empty directory is removed if that fails
+	if err := Metadata().CreateBucket(b); err != nil {
+		if ignoreNotFound(Storage().DeleteDir(b.Name, false)) == nil {
+			j.Done()
+		}
+		return err
+	}
+	j.Done()
+	return nil
+}
+
+// Check if api key k has perm on the bucket, admin keys can access everything
+func (b *Bucket) Allows(k *ApiKey, perm Permission) bool {
+	if k == nil {
+		return false
+	}
+	if k.Admin {
+		return true
+	}
+	for _, g := range b.Grants {
+		if g.AccessKey == k.AccessKey {
+			return g.Permission.Allows(perm)
+		}
+	}
+	return false
+}
+
+// Grant api key access to the bucket replacing its previous permission
+func (b *Bucket) Grant(accessKey string, perm Permission) error {
+	if !perm.Valid() {
+		return errors.New("invalid permission")
+	}
+	if _, err := FetchApiKey(accessKey); err != nil {
+		return err
+	}
+	grants, err := Metadata().PutBucketGrant(b.Name, BucketGrant{AccessKey: accessKey, Permission: perm})
 	if err != nil {
 		return err
 	}
+	b.Grants = grants
+	return nil
+}
 
-	// Store bucket metadata
-	if err := mgm.Coll(b).Create(b); err != nil {
+// Remove api key access from the bucket
+func (b *Bucket) Revoke(accessKey string) error {
+	grants, err := Metadata().DeleteBucketGrant(b.Name, accessKey)
+	if err != nil {
 		return err
 	}
+	b.Grants = grants
 	return nil
 }
 
+func withoutGrant(grants []BucketGrant, accessKey string) []BucketGrant {
+	kept := []BucketGrant{}
+	for _, g := range grants {
+		if g.AccessKey != accessKey {
+			kept = append(kept, g)
+		}
+	}
+	return kept
+}
+
 func (b *Bucket) mutateName() error {
 	n := normalizeName(b.Name)
 	r, err := rand.Int(rand.Reader, big.NewInt(9999))
@@ -64,10 +159,149 @@ func (b *Bucket) mutateName() error {
 
 func normalizeName(name string) string {
 	// replace all special characters with underscore
-	r := regexp.MustCompile(`[\s$&+,:;=?@#|'<>.^*()%!-]`)
+	r := regexp.MustCompile(`[\s$&+,:;=?@#|'<>.^*()%!/\\-]`)
 	return strings.ToLower(r.ReplaceAllString(name, "_"))
 }
 
+// BucketSettings changes bucket settings, nil fields are kept as they are
+type BucketSettings struct {
+	Versioning *bool
+	Lifecycle  *[]LifecycleRule
+	Quota      *BucketQuota
+	Encryption *bool
+}
+
+// Update bucket settings at once
+func (b *Bucket) Update(s *BucketSettings) error {
+	if s.Lifecycle != nil {
+		if err := checkLifecycle(*s.Lifecycle); err != nil {
+			return err
+		}
+		b.Lifecycle = *s.Lifecycle
+	}
+	if s.Versioning != nil {
+		b.Versioning = *s.Versioning
+	}
+	if s.Quota != nil {
+		b.Quota = *s.Quota
+	}
+	if s.Encryption != nil {
+		if err := b.setEncryption(*s.Encryption); err != nil {
+			return err
+		}
+	}
+	return Metadata().UpdateBucket(b)
+}
+
+// Rename bucket
+func (b *Bucket) Rename(name string) error {
+	return RenameBucket(b, name)
+}
+
+// RenameBucket moves the bucket directory then renames the bucket and its
+// objects, unlike creation the name is used as is so it fails when taken.
+// Links to objects keep working.
+func RenameBucket(b *Bucket, name string) error {
+	if b.Deleting {
+		return ErrBucketDeleting
+	}
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return ErrInvalidBucketName
+	}
+	if name == b.Name {
+		return nil
+	}
+	if exists, err := BucketExists(name); err != nil {
+		return err
+	} else if exists {
+		return ErrBucketExists
+	}
+
+	j, err := beginJournal(&JournalEntry{Op: JournalBucketRename, Bucket: b.Name, Target: name})
+	if err != nil {
+		return err
+	}
+
+	if err := Storage().MoveDir(b.Name, name); err != nil {
+		j.Done()
+		if err == ErrDirExists {
+			return ErrBucketExists
+		}
+		return err
+	}
+
+	// the journal entry is kept for recovery to finish the rename
+	if err := Metadata().RenameBucket(b.Name, name); err != nil {
+		return err
+	}
+	j.Done()
+	b.Name = name
+	return nil
+}
+
+// directory of an object in renamed bucket
+func renamedDir(dir string, name string, newName string) string {
+	if dir == name || strings.HasPrefix(dir, name+"/") {
+		return newName + dir[len(name):]
+	}
+	return dir
+}
+
+type BucketListOptions struct {
+	Prefix  string
+	MaxKeys int
+	// continuation token returned by the previous page
+	Token string
+}
+
+type BucketListing struct {
+	Buckets     []Bucket `json:"buckets"`
+	IsTruncated bool     `json:"is_truncated"`
+	NextToken   string   `json:"next_continuation_token,omitempty"`
+}
+
+// List buckets api key k can read a page at a time ordered by name
+func ListBuckets(k *ApiKey, opts *BucketListOptions) (*BucketListing, error) {
+	if opts.MaxKeys <= 0 || opts.MaxKeys > DefaultMaxKeys {
+		opts.MaxKeys = DefaultMaxKeys
+	}
+
+	after := ""
+	if opts.Token != "" {
+		b, err := base64.RawURLEncoding.DecodeString(opts.Token)
+		if err != nil {
+			return nil, ErrInvalidListToken
+		}
+		after = string(b)
+	}
+
+	res := &BucketListing{Buckets: []Bucket{}}
+	for {
+		// one more bucket than the page tells if there is a next one
+		limit := opts.MaxKeys + 1 - len(res.Buckets)
+		buckets, err := Metadata().ListBuckets(opts.Prefix, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range buckets {
+			after = b.Name
+			if !b.Allows(k, PermissionRead) {
+				continue
+			}
+			if len(res.Buckets) == opts.MaxKeys {
+				last := res.Buckets[len(res.Buckets)-1].Name
+				res.IsTruncated = true
+				res.NextToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+				return res, nil
+			}
+			res.Buckets = append(res.Buckets, b)
+		}
+		if len(buckets) < limit {
+			return res, nil
+		}
+	}
+}
+
 // Delete bucket
 func (b *Bucket) Delete() error {
 	return DeleteBucket(b)
@@ -76,51 +310,68 @@ func (b *Bucket) Delete() error {
 // DeleteBucket
 func DeleteBucket(b *Bucket) error {
 	// Validate bucket existence
-	if exists, err := Exists(b.Name); err != nil {
-		if err != nil {
-			return err
-		} else if !exists {
-			return errors.New("bucket does not exist")
-		}
+	if exists, err := BucketExists(b.Name); err != nil {
+		return err
+	} else if !exists {
+		return ErrBucketNotFound
+	}
+
+	// Only empty buckets can be deleted
+	obs, err := Metadata().FetchBucketObjectsBatch(b.Name, 1)
+	if err != nil {
+		return err
+	}
+	if len(obs) > 0 {
+		return ErrBucketNotEmpty
+	}
+
+	j, err := beginJournal(&JournalEntry{Op: JournalBucketDelete, Bucket: b.Name})
+	if err != nil {
+		return err
 	}
 
-	// Delete bucket
-	if err := DeleteDir(b.Name, false); err != nil {
+	// Delete bucket metadata first so nothing is saved in it meanwhile
+	if err := Metadata().DeleteBucket(b); err != nil {
+		j.Done()
 		return err
 	}
 
-	// Delete bucket metadata
-	if err := mgm.Coll(b).Delete(b); err != nil {
+	// Delete bucket, what is left are empty sub directories. Files without
+	// objects are kept for fsck to report.
+	if err := Storage().DeleteDir(b.Name, false); err == ErrDirNotEmpty {
+		log.Printf("directory of bucket %s kept, it holds files without objects\n", b.Name)
+	} else if ignoreNotFound(err) != nil {
 		return err
 	}
+	j.Done()
+
+	if err := Metadata().DeleteBucketUsage(b.Name); err != nil && err != ErrRecordNotFound {
+		log.Printf("usage of bucket %s not deleted: %v\n", b.Name, err)
+	}
+	// the bucket blobs went with its objects, what is left are directories
+	if err := Storage().DeleteDir(path.Join(blobsDir, b.ID.Hex()), true); err != nil {
+		log.Printf("blobs of bucket %s not deleted: %v\n", b.Name, err)
+	}
 	return nil
 }
 
 // Fetch bucket by name from database
 func FetchBucket(name string) (*Bucket, error) {
-	var b Bucket
-	err := mgm.Coll(&Bucket{}).First(bson.M{"name": name}, &b)
-
-	if err != nil {
-		return nil, err
+	b, err := Metadata().FetchBucket(name)
+	if err == ErrRecordNotFound {
+		return nil, ErrBucketNotFound
 	}
-
-	return &b, nil
+	return b, err
 }
 
 func BucketExists(name string) (bool, error) {
-	var b Bucket
-	err := mgm.Coll(&Bucket{}).First(
-		bson.M{"name": name},
-		&b,
-		options.FindOne().SetProjection(bson.M{"name": 1}),
-	)
-
-	if err != nil {
+	if _, err := Metadata().FetchBucket(name); err != nil {
+		if err == ErrRecordNotFound {
+			return false, nil
+		}
 		return false, err
 	}
-
-	return true, err
+	return true, nil
 }
 
 func (b *Bucket) FetchObjects() ([]Object, error) {
@@ -128,18 +379,5 @@ func (b *Bucket) FetchObjects() ([]Object, error) {
 }
 
 func FetchBucketObjects(b *Bucket) ([]Object, error) {
-	var objects []Object
-	cur, err := mgm.Coll(&Object{}).Find(
-		context.Background(),
-		bson.M{"bucketname": b.Name},
-	)
-	if err != nil {
-		return nil, err
-	}
-	if err := cur.All(context.Background(), &objects); err != nil {
-		return nil, err
-	}
-
-	return objects, nil
-
+	return Metadata().FetchBucketObjects(b.Name)
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRenameBucket(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "a")
+	newTestBucket(t, "taken")
+
+	for _, name := range []string{"a/b", `a\b`, ".blobs", ".."} {
+		if err := RenameBucket(b, name); err != ErrInvalidBucketName {
+			t.Errorf("%s: got %v, want invalid name", name, err)
+		}
+	}
+	if err := RenameBucket(b, "taken"); err != ErrBucketExists {
+		t.Errorf("got %v, want bucket exists", err)
+	}
+
+	// the name is kept as given
+	if err := RenameBucket(b, "My-Photos.2"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Name != "My-Photos.2" {
+		t.Errorf("renamed to %s", b.Name)
+	}
+	if _, err := FetchBucket("photos"); err != ErrBucketNotFound {
+		t.Errorf("old bucket fetched: %v", err)
+	}
+	moved, err := FetchObject(o.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenObject(moved, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if c, _ := io.ReadAll(f); moved.BucketName != b.Name || string(c) != "a" {
+		t.Errorf("object in %s with %q", moved.BucketName, c)
+	}
+}
+
+func TestHandleBucketRename(t *testing.T) {
+	setupStores(t)
+	newTestBucket(t, "photos")
+
+	rename := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/bucket/photos/rename", strings.NewReader(body))
+		r = WithPrincipal(r, &ApiKey{AccessKey: "root", Admin: true})
+		r = mux.SetURLVars(r, map[string]string{"name": "photos"})
+		w := httptest.NewRecorder()
+		HandleBucketRename(w, r)
+		return w
+	}
+
+	for _, body := range []string{`{"name": "images", "encryption": true}`, `{"name": "a/b/c"}`, `{}`} {
+		if w := rename(body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got %d %s", body, w.Code, w.Body)
+		}
+	}
+	if w := rename(`{"name": "images"}`); w.Code != http.StatusOK {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+	if _, err := FetchBucket("images"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "a")
+	if err := DeleteBucket(b); err != ErrBucketNotEmpty {
+		t.Errorf("got %v, want bucket not empty", err)
+	}
+
+	if err := DeleteObject(o.UUID); err != nil {
+		t.Fatal(err)
+	}
+	// left by objects deleted from sub directories
+	if err := Storage().CreateDir("photos/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteBucket(b); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := Storage().Exists("photos"); ok {
+		t.Error("bucket directory kept")
+	}
+	if _, err := FetchBucket(b.Name); err != ErrBucketNotFound {
+		t.Errorf("deleted bucket fetched: %v", err)
+	}
+}
+
+func TestDeleteBucketKeepsUnknownFiles(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	if _, err := Storage().CreateFile("photos/orphan", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteBucket(b); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := Storage().Exists("photos/orphan"); !ok {
+		t.Error("file without object deleted")
+	}
+	if _, err := FetchBucket(b.Name); err != ErrBucketNotFound {
+		t.Errorf("deleted bucket fetched: %v", err)
+	}
+}
+
+func TestListBuckets(t *testing.T) {
+	setupStores(t)
+	k := &ApiKey{Name: "reader"}
+	if err := CreateApiKey(k); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a1", "a2", "a3", "a4", "a5", "b1"} {
+		b := newTestBucket(t, name)
+		if name != "a2" {
+			if err := b.Grant(k.AccessKey, PermissionRead); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// pages skip buckets the key can't read
+	var got []string
+	opts := &BucketListOptions{Prefix: "a", MaxKeys: 2}
+	for pages := 0; ; pages++ {
+		l, err := ListBuckets(k, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range l.Buckets {
+			got = append(got, b.Name)
+		}
+		if !l.IsTruncated {
+			if pages != 1 {
+				t.Errorf("got %d pages", pages+1)
+			}
+			break
+		}
+		opts.Token = l.NextToken
+	}
+	if strings.Join(got, ",") != "a1,a3,a4,a5" {
+		t.Errorf("got buckets %v", got)
+	}
+
+	if _, err := ListBuckets(k, &BucketListOptions{Token: "not base64!"}); err != ErrInvalidListToken {
+		t.Errorf("got %v with an invalid token", err)
+	}
+	l, err := ListBuckets(&ApiKey{AccessKey: "root", Admin: true}, &BucketListOptions{})
+	if err != nil || len(l.Buckets) != 6 || l.IsTruncated {
+		t.Errorf("admin listed %d buckets, %v", len(l.Buckets), err)
+	}
+}
+
+func TestHandleBucketUpdate(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	if err := b.SetQuota(BucketQuota{MaxObjects: 5}); err != nil {
+		t.Fatal(err)
+	}
+	reader := &ApiKey{Name: "reader"}
+	if err := CreateApiKey(reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Grant(reader.AccessKey, PermissionRead); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(h http.HandlerFunc, k *ApiKey, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPatch, "/bucket/photos", strings.NewReader(body))
+		r = WithPrincipal(r, k)
+		r = mux.SetURLVars(r, map[string]string{"name": "photos"})
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	root := &ApiKey{AccessKey: "root", Admin: true}
+
+	if w := serve(HandleBucketUpdate, reader, `{"versioning": true}`); w.Code != http.StatusForbidden {
+		t.Errorf("reader update got %d", w.Code)
+	}
+	if w := serve(HandleBucketUpdate, root, `{"lifecycle": [{"id": "a", "enabled": true}]}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("rule without action got %d %s", w.Code, w.Body)
+	}
+	if w := serve(HandleBucketUpdate, root, `{"versioning": true}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	// fields left out are kept
+	b, _ = FetchBucket("photos")
+	if !b.Versioning || b.Quota.MaxObjects != 5 || len(b.Grants) != 1 {
+		t.Errorf("got bucket %+v", b)
+	}
+
+	// only admins see grants, usage is counted on fetch
+	saveTestObject(t, b, "a.png", "abc")
+	var res struct {
+		Bucket Bucket `json:"bucket"`
+	}
+	w := serve(HandleBucketFetch, reader, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Bucket.Grants) != 0 || res.Bucket.Usage == nil || res.Bucket.Usage.Bytes != 3 {
+		t.Errorf("reader got %s", w.Body)
+	}
+	w = serve(HandleBucketFetch, root, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Bucket.Grants) != 1 {
+		t.Errorf("admin got %s", w.Body)
+	}
+}
@@ -3,12 +3,19 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
 
 type bucketPayload struct {
 	Name string `json:"name" validate:"required,min=5,max=256"`
+	// encrypt objects at rest, only read on creation
+	Encryption bool `json:"encryption"`
+}
+
+type bucketRenamePayload struct {
+	Name string `json:"name" validate:"required,min=5,max=256"`
 }
 
 func HandleBucketCreation(w http.ResponseWriter, r *http.Request) {
@@ -19,8 +26,18 @@ func HandleBucketCreation(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
+	// creator is the bucket admin
 	b := &Bucket{
 		Name: payload.Name,
+		Grants: []BucketGrant{
+			{AccessKey: Principal(r).AccessKey, Permission: PermissionAdmin},
+		},
+	}
+	if payload.Encryption {
+		if err := b.setEncryption(true); err != nil {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
 	}
 
 	if err := b.Create(); err != nil {
@@ -34,6 +51,145 @@ func HandleBucketCreation(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type bucketSettingsPayload struct {
+	Versioning *bool            `json:"versioning"`
+	Lifecycle  *[]LifecycleRule `json:"lifecycle" validate:"omitempty,max=100,dive"`
+	Quota      *BucketQuota     `json:"quota"`
+	Encryption *bool            `json:"encryption"`
+}
+
+// only bucket admins see who else has access
+func bucketView(r *http.Request, b *Bucket) *Bucket {
+	if !b.Allows(Principal(r), PermissionAdmin) {
+		b.Grants = []BucketGrant{}
+	}
+	return b
+}
+
+// List buckets the api key can read
+// ex: /buckets?prefix=media&max_keys=100
+func HandleBucketsFetch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := &BucketListOptions{
+		Prefix: q.Get("prefix"),
+		Token:  q.Get("continuation_token"),
+	}
+	if v := q.Get("max_keys"); v != "" {
+		mk, err := strconv.Atoi(v)
+		if err != nil || mk < 1 {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("max_keys must be a positive number"))
+			return
+		}
+		opts.MaxKeys = mk
+	}
+
+	l, err := ListBuckets(Principal(r), opts)
+	if err != nil {
+		if err == ErrInvalidListToken {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range l.Buckets {
+		bucketView(r, &l.Buckets[i])
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"buckets":                 l.Buckets,
+		"is_truncated":            l.IsTruncated,
+		"next_continuation_token": l.NextToken,
+		"max_keys":                opts.MaxKeys,
+	})
+}
+
+// Bucket settings along with its object count and byte usage
+func HandleBucketFetch(w http.ResponseWriter, r *http.Request) {
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionRead)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if b.Usage, err = FetchBucketUsage(b); err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	SendJson(w, http.StatusOK, Payload{"bucket": bucketView(r, b)})
+}
+
+// Update bucket settings, fields left out are kept
+func HandleBucketUpdate(w http.ResponseWriter, r *http.Request) {
+	var payload bucketSettingsPayload
+	if err := ParseAndValidate(r, &payload); err != nil {
+		SendValidationError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	defer r.Body.Close()
+
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionAdmin)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	err = b.Update(&BucketSettings{
+		Versioning: payload.Versioning,
+		Lifecycle:  payload.Lifecycle,
+		Quota:      payload.Quota,
+		Encryption: payload.Encryption,
+	})
+	if err != nil {
+		if errors.Is(err, ErrLifecycleNoAction) || errors.Is(err, ErrLifecycleDuplicateID) ||
+			err == ErrEncryptionNotConfigured {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"message": "bucket updated",
+		"bucket":  b,
+	})
+}
+
+// Rename bucket to the exact given name, objects move along
+func HandleBucketRename(w http.ResponseWriter, r *http.Request) {
+	var payload bucketRenamePayload
+	if err := ParseStrictAndValidate(r, &payload); err != nil {
+		SendValidationError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	defer r.Body.Close()
+
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionAdmin)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := b.Rename(payload.Name); err != nil {
+		if err == ErrBucketExists || err == ErrBucketDeleting {
+			SendHttpJsonError(w, http.StatusConflict, err)
+			return
+		}
+		if err == ErrInvalidBucketName {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"message": "bucket renamed",
+		"bucket":  b.Name,
+	})
+}
+
 func HandleBucketDeletion(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["name"]
 	if name == "" {
@@ -41,8 +197,25 @@ func HandleBucketDeletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b := &Bucket{
-		Name: name,
+	b, err := AuthorizeBucket(r, name, PermissionAdmin)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	// buckets with objects are emptied by a background job
+	if r.URL.Query().Get("force") == "true" {
+		j, err := DeleteBucketRecursive(b, Principal(r).AccessKey)
+		if err != nil {
+			SendHttpJsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Location", JoinUrl("/jobs/"+j.ID.Hex()))
+		SendJson(w, http.StatusAccepted, Payload{
+			"message": "bucket delete started",
+			"job":     j,
+		})
+		return
 	}
 
 	if err := b.Delete(); err != nil {
@@ -55,29 +228,118 @@ func HandleBucketDeletion(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// List bucket objects a page at a time
+// ex: /bucket/{name}/objects?prefix=photos/&delimiter=/&max_keys=100&sort=size&order=desc
 func HandleObjectsFetch(w http.ResponseWriter, r *http.Request) {
-	if IsProduction() {
-		SendHttpJsonError(w, http.StatusUnauthorized, errors.New("access is not allowed"))
-		return
-	}
 	name := mux.Vars(r)["name"]
 	if name == "" {
 		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("bucket name is required"))
 		return
 	}
 
-	b := &Bucket{
-		Name: name,
+	q := r.URL.Query()
+	opts := &ListOptions{
+		Prefix:     q.Get("prefix"),
+		Delimiter:  q.Get("delimiter"),
+		Sort:       q.Get("sort"),
+		Token:      q.Get("continuation_token"),
+		StartAfter: q.Get("start_after"),
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("order must be asc or desc"))
+		return
+	}
+	if v := q.Get("max_keys"); v != "" {
+		mk, err := strconv.Atoi(v)
+		if err != nil || mk < 1 {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("max_keys must be a positive number"))
+			return
+		}
+		opts.MaxKeys = mk
 	}
 
-	obs, err := b.FetchObjects()
+	b, err := AuthorizeBucket(r, name, PermissionRead)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
 
+	l, err := ListBucketObjects(b, opts)
 	if err != nil {
-		SendHttpJsonError(w, http.StatusBadRequest, err)
+		if err == ErrInvalidListToken || err == ErrInvalidListSort || err == ErrDelimiterSort {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"objects":                 l.Objects,
+		"common_prefixes":         l.CommonPrefixes,
+		"key_count":               l.KeyCount,
+		"is_truncated":            l.IsTruncated,
+		"next_continuation_token": l.NextToken,
+		"prefix":                  opts.Prefix,
+		"delimiter":               opts.Delimiter,
+		"max_keys":                opts.MaxKeys,
+		"sort":                    opts.Sort,
+	})
+}
+
+type grantPayload struct {
+	AccessKey  string     `json:"access_key" validate:"required"`
+	Permission Permission `json:"permission" validate:"required,oneof=read write admin"`
+}
+
+func HandleBucketGrant(w http.ResponseWriter, r *http.Request) {
+	var payload grantPayload
+	if err := ParseAndValidate(r, &payload); err != nil {
+		SendValidationError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	defer r.Body.Close()
+
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionAdmin)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := b.Grant(payload.AccessKey, payload.Permission); err != nil {
+		if err == ErrApiKeyNotFound {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"message": "access granted",
+		"grants":  b.Grants,
+	})
+}
+
+func HandleBucketRevoke(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	b, err := AuthorizeBucket(r, vars["name"], PermissionAdmin)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := b.Revoke(vars["access_key"]); err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	SendJson(w, http.StatusOK, Payload{
-		"objects": obs,
+		"message": "access revoked",
+		"grants":  b.Grants,
 	})
 }
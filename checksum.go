@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("content checksum does not match what was received")
+	ErrInvalidDigest    = errors.New("content checksum header is not valid")
+)
+
+// Checksums of object content as hex strings, empty ones aren't checked
+type Checksums struct {
+	MD5    string
+	SHA256 string
+}
+
+func (c Checksums) IsEmpty() bool {
+	return c.MD5 == "" && c.SHA256 == ""
+}
+
+// Read expected checksums from request headers
+//
+//	Content-MD5: base64 md5 (RFC 1864)
+//	X-Checksum-Sha256: hex sha256
+//	X-Amz-Checksum-Sha256: base64 sha256 (S3)
+func ParseChecksums(h http.Header) (Checksums, error) {
+	var c Checksums
+	if v := h.Get("Content-MD5"); v != "" {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(b) != md5.Size {
+			return c, ErrInvalidDigest
+		}
+		c.MD5 = hex.EncodeToString(b)
+	}
+	if v := h.Get("X-Amz-Checksum-Sha256"); v != "" {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(b) != sha256.Size {
+			return c, ErrInvalidDigest
+		}
+		c.SHA256 = hex.EncodeToString(b)
+	}
+	if v := h.Get("X-Checksum-Sha256"); v != "" {
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != sha256.Size {
+			return c, ErrInvalidDigest
+		}
+		c.SHA256 = hex.EncodeToString(b)
+	}
+	return c, nil
+}
+
+// checksumReader hashes content while it's read and fails at EOF when it
+// doesn't match the expected checksums, so storage never keeps the file
+type checksumReader struct {
+	r      io.Reader
+	md5    hash.Hash
+	sha256 hash.Hash
+	want   Checksums
+	size   int64
+}
+
+func newChecksumReader(r io.Reader, want Checksums) *checksumReader {
+	return &checksumReader{
+		r:      r,
+		md5:    md5.New(),
+		sha256: sha256.New(),
+		want:   want,
+	}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.md5.Write(p[:n])
+	r.sha256.Write(p[:n])
+	r.size += int64(n)
+	if err == io.EOF {
+		sums := r.Sums()
+		if (r.want.MD5 != "" && r.want.MD5 != sums.MD5) ||
+			(r.want.SHA256 != "" && r.want.SHA256 != sums.SHA256) {
+			return n, ErrChecksumMismatch
+		}
+	}
+	return n, err
+}
+
+// Size of the content read so far
+func (r *checksumReader) Size() int64 {
+	return r.size
+}
+
+// Checksums of the content read so far
+func (r *checksumReader) Sums() Checksums {
+	return Checksums{
+		MD5:    hex.EncodeToString(r.md5.Sum(nil)),
+		SHA256: hex.EncodeToString(r.sha256.Sum(nil)),
+	}
+}
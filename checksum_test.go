@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseChecksums(t *testing.T) {
+	m := md5.Sum([]byte("content"))
+	s := sha256.Sum256([]byte("content"))
+	want := Checksums{MD5: hex.EncodeToString(m[:]), SHA256: hex.EncodeToString(s[:])}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   Checksums
+		err    error
+	}{
+		{"none", nil, Checksums{}, nil},
+		{"md5 and hex sha256", map[string]string{
+			"Content-MD5":       base64.StdEncoding.EncodeToString(m[:]),
+			"X-Checksum-Sha256": hex.EncodeToString(s[:]),
+		}, want, nil},
+		{"s3 sha256", map[string]string{"X-Amz-Checksum-Sha256": base64.StdEncoding.EncodeToString(s[:])}, Checksums{SHA256: want.SHA256}, nil},
+		{"hex md5", map[string]string{"Content-MD5": hex.EncodeToString(m[:])}, Checksums{}, ErrInvalidDigest},
+		{"short sha256", map[string]string{"X-Checksum-Sha256": "abcd"}, Checksums{}, ErrInvalidDigest},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for k, v := range tt.header {
+			h.Set(k, v)
+		}
+		got, err := ParseChecksums(h)
+		if err != tt.err || (err == nil && got != tt.want) {
+			t.Errorf("%s: got %+v, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestChecksumReader(t *testing.T) {
+	s := sha256.Sum256([]byte("content"))
+	sum := hex.EncodeToString(s[:])
+
+	r := newChecksumReader(strings.NewReader("content"), Checksums{SHA256: sum})
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 7 || r.Sums().SHA256 != sum {
+		t.Errorf("got size %d, sums %+v", r.Size(), r.Sums())
+	}
+
+	r = newChecksumReader(strings.NewReader("altered"), Checksums{SHA256: sum})
+	if _, err := io.ReadAll(r); err != ErrChecksumMismatch {
+		t.Errorf("got %v, want mismatch", err)
+	}
+}
+
+func TestSaveObjectChecksums(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	m := md5.Sum([]byte("content"))
+
+	o := &Object{Type: "image/png"}
+	_, err := SaveObject(o, &SaveConfig{
+		BucketID:  b.Name,
+		Reader:    strings.NewReader("altered"),
+		Key:       "a.png",
+		Checksums: Checksums{MD5: hex.EncodeToString(m[:])},
+	})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got %v, want mismatch", err)
+	}
+	if _, err := FetchObjectByKey(b.Name, "a.png"); err == nil {
+		t.Error("object saved with a mismatched checksum")
+	}
+	Storage().WalkFiles(func(p string, size int64) error {
+		t.Errorf("file %s kept", p)
+		return nil
+	})
+
+	o = saveTestObject(t, b, "a.png", "content")
+	s := sha256.Sum256([]byte("content"))
+	if o.MD5 != hex.EncodeToString(m[:]) || o.SHA256 != hex.EncodeToString(s[:]) {
+		t.Errorf("got md5 %s, sha256 %s", o.MD5, o.SHA256)
+	}
+	if o.ETag() != `"`+o.SHA256+`"` {
+		t.Errorf("got etag %s", o.ETag())
+	}
+}
+
+func TestHandleServingNotModified(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	s := newTestSession(t, o, &ObjectShare{})
+
+	get := func(h http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/share/photos/"+o.UUID+"?session="+s.ID.Hex(), nil)
+		for k := range h {
+			r.Header.Set(k, h.Get(k))
+		}
+		r = mux.SetURLVars(r, map[string]string{"bucket": "photos", "uuid": o.UUID})
+		w := httptest.NewRecorder()
+		HandleServingRequestedObject(w, r)
+		return w
+	}
+
+	w := get(http.Header{})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != o.ETag() || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("got %d with headers %v", w.Code, w.Header())
+	}
+	lm := w.Header().Get("Last-Modified")
+	past := o.CreatedAt.Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"matching etag", http.Header{"If-None-Match": {o.ETag()}}, http.StatusNotModified},
+		{"weak etag", http.Header{"If-None-Match": {`"other", W/` + o.ETag()}}, http.StatusNotModified},
+		{"other etag", http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+		{"not modified since", http.Header{"If-Modified-Since": {lm}}, http.StatusNotModified},
+		{"modified since", http.Header{"If-Modified-Since": {past}}, http.StatusOK},
+		{"etag first", http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lm}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := get(tt.header); w.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Content types that compress well are stored gzip compressed. Clients
+// accepting gzip get the stored bytes as they are, others get them
+// decompressed on the fly.
+
+const EncodingGzip = "gzip"
+
+var CompressibleTypes = []string{
+	"application/json",
+	"text/*",
+	"image/svg+xml",
+	"application/dash+xml",
+	"application/vnd.apple.mpegurl",
+	"application/x-mpegurl",
+}
+
+func IsCompressible(t string) bool {
+	for _, p := range CompressibleTypes {
+		if matchContentType(p, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the Accept-Encoding header accepts encoding
+func AcceptsEncoding(header string, encoding string) bool {
+	for _, v := range strings.Split(header, ",") {
+		parts := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+		// q=0 refuses the encoding
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipReader reads r gzip compressed, r is compressed in the background as
+// it's read
+type gzipReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func newGzipReader(r io.Reader) *gzipReader {
+	pr, pw := io.Pipe()
+	g := &gzipReader{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(g.done)
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return g
+}
+
+// Stop compressing, r isn't read anymore once it returns
+func (g *gzipReader) Close() error {
+	g.PipeReader.Close()
+	<-g.done
+	return nil
+}
+
+// gzipFile decompresses a compressed file as it's read. Seeking forward skips
+// decompressed bytes, seeking backwards starts decompressing from the start.
+type gzipFile struct {
+	f  StoredFile
+	zr *gzip.Reader
+	// decompressed size
+	size int64
+	pos  int64
+	// decompressed bytes read from zr
+	off int64
+}
+
+func newGzipFile(f StoredFile, size int64) *gzipFile {
+	return &gzipFile{f: f, size: size}
+}
+
+func (g *gzipFile) reset() error {
+	if _, err := g.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var err error
+	if g.zr == nil {
+		g.zr, err = gzip.NewReader(g.f)
+	} else {
+		err = g.zr.Reset(g.f)
+	}
+	g.off = 0
+	return err
+}
+
+func (g *gzipFile) Read(p []byte) (int, error) {
+	if g.pos >= g.size {
+		return 0, io.EOF
+	}
+	if g.zr == nil || g.pos < g.off {
+		if err := g.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if g.pos > g.off {
+		n, err := io.CopyN(ioutil.Discard, g.zr, g.pos-g.off)
+		g.off += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := g.zr.Read(p)
+	g.off += int64(n)
+	g.pos += int64(n)
+	return n, err
+}
+
+func (g *gzipFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += g.pos
+	case io.SeekEnd:
+		offset += g.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	g.pos = offset
+	return offset, nil
+}
+
+func (g *gzipFile) Close() error {
+	return g.f.Close()
+}
+
+func (g *gzipFile) Name() string {
+	return g.f.Name()
+}
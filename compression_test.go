@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"br, deflate", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := AcceptsEncoding(tt.header, EncodingGzip); got != tt.want {
+			t.Errorf("%q: got %v", tt.header, got)
+		}
+	}
+	if !IsCompressible("text/plain; charset=utf-8") || IsCompressible("image/png") {
+		t.Error("wrong compressible types")
+	}
+}
+
+func saveTextObject(t *testing.T, b *Bucket, key, content string) *Object {
+	t.Helper()
+	o, err := saveTypedObject(b, key, "application/json", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestSaveCompressedObject(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "docs")
+	content := strings.Repeat(`{"key": "value"}`, 1000)
+	o := saveTextObject(t, b, "a.json", content)
+	if o.Encoding != EncodingGzip || o.Size != len(content) || o.StoredSize >= int64(len(content)) {
+		t.Fatalf("got encoding %q, size %d, stored %d", o.Encoding, o.Size, o.StoredSize)
+	}
+	if u, _ := FetchBucketUsage(b); u.Bytes != int64(len(content)) || u.StoredBytes != o.StoredSize {
+		t.Errorf("got usage %+v", u)
+	}
+	if p := saveTestObject(t, b, "a.png", "png"); p.Encoding != "" {
+		t.Errorf("png stored with encoding %s", p.Encoding)
+	}
+
+	f, err := OpenObject(o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if c, _ := io.ReadAll(f); string(c) != content {
+		t.Errorf("read %d bytes", len(c))
+	}
+
+	// seeking back and forth decompresses from the right offset
+	for _, off := range []int64{16000 - 5, 16, 0, 8000} {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, 5)
+		if _, err := io.ReadFull(f, p); err != nil || string(p) != content[off:off+5] {
+			t.Errorf("at %d got %q, %v", off, p, err)
+		}
+	}
+	if n, _ := f.Seek(0, io.SeekEnd); n != int64(len(content)) {
+		t.Errorf("got size %d", n)
+	}
+}
+
+func TestHandleServingCompressedObject(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "docs")
+	content := strings.Repeat(`{"key": "value"}`, 1000)
+	o := saveTextObject(t, b, "a.json", content)
+	s := newTestSession(t, o, &ObjectShare{})
+
+	get := func(h http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/share/docs/"+o.UUID+"?session="+s.ID.Hex(), nil)
+		for k := range h {
+			r.Header.Set(k, h.Get(k))
+		}
+		r = mux.SetURLVars(r, map[string]string{"bucket": "docs", "uuid": o.UUID})
+		w := httptest.NewRecorder()
+		HandleServingRequestedObject(w, r)
+		return w
+	}
+
+	w := get(http.Header{"Accept-Encoding": {"gzip"}})
+	if w.Header().Get("Content-Encoding") != EncodingGzip || w.Header().Get("ETag") != o.EncodedETag(EncodingGzip) {
+		t.Errorf("got headers %v", w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := io.ReadAll(zr); string(c) != content {
+		t.Errorf("decompressed %d bytes", len(c))
+	}
+
+	w = get(http.Header{})
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("ETag") != o.ETag() || w.Body.String() != content {
+		t.Errorf("got headers %v and %d bytes without gzip", w.Header(), w.Body.Len())
+	}
+	if v := w.Header().Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("got Vary %q", v)
+	}
+
+	w = get(http.Header{"Range": {"bytes=16-31"}})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), []byte(content[16:32])) {
+		t.Errorf("got %d %q for a range", w.Code, w.Body)
+	}
+}
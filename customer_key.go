@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// Objects can be encrypted with a key sent by the client instead of the
+// bucket data key. The key is never stored, only its fingerprint to check
+// the key sent when the object is read.
+
+// base64 encoded 32 bytes AES-256 key
+const CustomerKeyHeader = "X-Encryption-Key"
+
+// S3 clients send the customer key in SSE-C headers instead
+const (
+	S3CustomerAlgorithmHeader = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	S3CustomerKeyHeader       = "X-Amz-Server-Side-Encryption-Customer-Key"
+	S3CustomerKeyMD5Header    = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+)
+
+var (
+	ErrCustomerKeyInvalid  = errors.New("encryption key must be 32 base64 encoded bytes")
+	ErrCustomerKeyRequired = errors.New("object is encrypted with a customer key, send it in " + CustomerKeyHeader)
+	ErrCustomerKeyMismatch = errors.New("encryption key does not match the object key")
+)
+
+// Parse customer key from request headers, nil when none is sent
+func ParseCustomerKey(h http.Header) ([]byte, error) {
+	v := h.Get(CustomerKeyHeader)
+	if v == "" {
+		return nil, nil
+	}
+	k, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(k) != encKeySize {
+		return nil, ErrCustomerKeyInvalid
+	}
+	return k, nil
+}
+
+// Parse customer key from S3 SSE-C headers, nil when none is sent
+func ParseS3CustomerKey(h http.Header) ([]byte, error) {
+	v := h.Get(S3CustomerKeyHeader)
+	if v == "" && h.Get(S3CustomerAlgorithmHeader) == "" {
+		return nil, nil
+	}
+	if h.Get(S3CustomerAlgorithmHeader) != "AES256" {
+		return nil, ErrCustomerKeyInvalid
+	}
+	k, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(k) != encKeySize {
+		return nil, ErrCustomerKeyInvalid
+	}
+	if m := h.Get(S3CustomerKeyMD5Header); m != "" && m != customerKeyMD5(k) {
+		return nil, ErrCustomerKeyInvalid
+	}
+	return k, nil
+}
+
+// base64 md5 of the key, S3 sends it along the key
+func customerKeyMD5(k []byte) string {
+	sum := md5.Sum(k)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func customerKeyFingerprint(k []byte) string {
+	s := sha256.Sum256(k)
+	return hex.EncodeToString(s[:])
+}
+
+// Check key against the customer key object was saved with
+func (o *Object) CheckCustomerKey(k []byte) error {
+	if k == nil {
+		return ErrCustomerKeyRequired
+	}
+	if subtle.ConstantTimeCompare([]byte(customerKeyFingerprint(k)), []byte(o.CustomerKeySHA256)) != 1 {
+		return ErrCustomerKeyMismatch
+	}
+	return nil
+}
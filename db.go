@@ -1,35 +1,158 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"time"
+)
+
+const (
+	MongoMetadataDriver = "mongo"
+	BoltMetadataDriver  = "bolt"
 
-	"github.com/kamva/mgm/v3"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	DefaultBoltPath = "./storage.db"
 )
 
-func OpenDBConnection() error {
-	db := os.Getenv("DB_NAME")
-	uri := os.Getenv("MONGO_URL")
-	err := mgm.SetDefaultConfig(
-		nil,
-		db,
-		options.Client().ApplyURI(uri),
-	)
-	if err != nil {
-		return err
-	}
+var (
+	ErrRecordNotFound = errors.New("record not found")
 
-	processIndexes()
+	metadata MetadataStore
+)
 
-	return nil
+// MetadataStore persists buckets, objects, sharing sessions, uploads, api keys,
+// content blobs, the operations journal and background jobs
+type MetadataStore interface {
+	CreateBucket(b *Bucket) error
+	FetchBucket(name string) (*Bucket, error)
+	FetchBuckets() ([]Bucket, error)
+	// buckets named with prefix after the given name, ordered by name
+	ListBuckets(prefix string, after string, limit int) ([]Bucket, error)
+	// update bucket settings, the deleting flag is kept once set and grants
+	// are only changed by PutBucketGrant and DeleteBucketGrant
+	UpdateBucket(b *Bucket) error
+	// replace the grant of g.AccessKey on the bucket, grants of other keys
+	// are left as is. Returns the bucket grants.
+	PutBucketGrant(name string, g BucketGrant) ([]BucketGrant, error)
+	// remove the grant of accessKey on the bucket, returns the bucket grants
+	DeleteBucketGrant(name string, accessKey string) ([]BucketGrant, error)
+	// flag the bucket as being deleted, it's set on its own so concurrent
+	// settings updates can't clear it
+	SetBucketDeleting(name string) error
+	// replace the wrapped data key of the bucket and the id of the master
+	// key wrapping it, the rest of the bucket is left as is
+	SetBucketDataKey(name string, masterKeyID string, dataKey string) error
+	// rename bucket along with every record referencing it, the objects
+	// directories included, running it again after a failure finishes it
+	RenameBucket(name string, newName string) error
+	DeleteBucket(b *Bucket) error
+
+	FetchBucketUsage(bucket string) (*BucketUsage, error)
+	// create or replace the usage of u.Bucket
+	PutBucketUsage(u *BucketUsage) error
+	// add to bucket usage, with a quota the usage is only updated while it
+	// stays within it, ErrRecordNotFound is returned otherwise
+	AddBucketUsage(bucket string, bytes int64, stored int64, objects int, q *BucketQuota) error
+	DeleteBucketUsage(bucket string) error
+
+	CreateObject(o *Object) error
+	FetchObject(uuid string) (*Object, error)
+	FetchObjectByKey(bucket string, key string) (*Object, error)
+	// objects saved under key, latest first
+	FetchObjectVersions(bucket string, key string) ([]Object, error)
+	UpdateObject(o *Object) error
+	DeleteObject(uuid string) error
+	FetchBucketObjects(bucket string) ([]Object, error)
+	// up to limit objects of bucket in no particular order
+	FetchBucketObjectsBatch(bucket string, limit int) ([]Object, error)
+	// call fn with every object of every bucket, fn must not write to the
+	// store while iterating
+	EachObject(fn func(o *Object) error) error
+	ListObjects(q *ObjectsQuery) ([]Object, error)
+
+	CreateSession(s *ObjectSharingSession) error
+	FetchSession(id string) (*ObjectSharingSession, error)
+	FetchLatestSession(ouuid string) (*ObjectSharingSession, error)
+	FetchObjectSessions(ouuid string) ([]ObjectSharingSession, error)
+	// set the session revoked_at unless it's already revoked, other fields
+	// are left as is. Returns the updated session.
+	RevokeSession(id string, at time.Time) (*ObjectSharingSession, error)
+	// increment session downloads only while under its max downloads,
+	// ErrRecordNotFound is returned otherwise
+	IncrementSessionDownloads(id string) (*ObjectSharingSession, error)
+
+	CreateUpload(u *Upload) error
+	FetchUpload(id string) (*Upload, error)
+	UpdateUpload(u *Upload) error
+	DeleteUpload(u *Upload) error
+	// uploads expiring before t
+	FetchUploadsExpiredBefore(t time.Time) ([]Upload, error)
+
+	CreateMultipartUpload(u *MultipartUpload) error
+	FetchMultipartUpload(id string) (*MultipartUpload, error)
+	FetchMultipartUploadsBefore(t time.Time) ([]MultipartUpload, error)
+	// uploads without parts stored since t
+	FetchIdleMultipartUploads(t time.Time) ([]MultipartUpload, error)
+	// record activity on the upload, it's updated on its own so concurrent
+	// parts don't overwrite each other
+	TouchMultipartUpload(id string) error
+	DeleteMultipartUpload(u *MultipartUpload) error
+	// create or replace part with the same upload id and number
+	PutUploadPart(p *UploadPart) error
+	FetchUploadParts(uploadID string) ([]UploadPart, error)
+	DeleteUploadParts(uploadID string) error
+
+	CreateApiKey(k *ApiKey) error
+	FetchApiKey(accessKey string) (*ApiKey, error)
+	FetchApiKeys() ([]ApiKey, error)
+	DeleteApiKey(accessKey string) error
+
+	CreateJournalEntry(e *JournalEntry) error
+	FetchJournalEntries() ([]JournalEntry, error)
+	DeleteJournalEntry(e *JournalEntry) error
+
+	// add n references to blob b.Path, the blob is created when missing and
+	// n is positive, ErrRecordNotFound is returned otherwise. Returns the
+	// references the blob has now.
+	AddBlobRefs(b *Blob, n int) (int, error)
+	FetchBlob(path string) (*Blob, error)
+	FetchBlobs() ([]Blob, error)
+	DeleteBlob(path string) error
+	// objects referencing the blob
+	CountBlobObjects(path string) (int, error)
+
+	CreateJob(j *Job) error
+	FetchJob(id string) (*Job, error)
+	// pending and running jobs in creation order
+	FetchUnfinishedJobs() ([]Job, error)
+	UpdateJob(j *Job) error
 }
 
-func processIndexes() error {
-	if err := (&Object{}).CreateIndex(); err != nil {
-		return err
+// Open metadata store selected by METADATA_DRIVER (mongo by default)
+func OpenDBConnection() error {
+	var (
+		s   MetadataStore
+		err error
+	)
+	switch d := os.Getenv("METADATA_DRIVER"); d {
+	case "", MongoMetadataDriver:
+		s, err = NewMongoStore(os.Getenv("MONGO_URL"), os.Getenv("DB_NAME"))
+	case BoltMetadataDriver:
+		p := os.Getenv("BOLT_PATH")
+		if p == "" {
+			p = DefaultBoltPath
+		}
+		s, err = NewBoltStore(p)
+	default:
+		err = fmt.Errorf("unknown metadata driver %q", d)
 	}
-	if err := (&ObjectSharingSession{}).CreateIndex(); err != nil {
+	if err != nil {
 		return err
 	}
+	metadata = s
 	return nil
 }
+
+func Metadata() MetadataStore {
+	return metadata
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Object content can be encrypted at rest with AES-256-GCM. Every bucket has
+// a random data key wrapped by a master key and every object its own key
+// derived from the data key and a random salt. Content is sealed in chunks so
+// ranges are decrypted without reading the whole file.
+//
+//	file:  magic | salt | chunk 0 | chunk 1 | ...
+//	chunk: 64 KB of content sealed with its index as nonce, the last chunk is
+//	       flagged in its nonce so truncated files fail to decrypt
+
+const (
+	encMagic      = "CSE1"
+	encSaltSize   = 16
+	encHeaderSize = len(encMagic) + encSaltSize
+	encChunkSize  = 64 * 1024
+	encTagSize    = 16
+	encKeySize    = 32
+)
+
+var (
+	ErrEncryptionNotConfigured = errors.New("encryption master key is not configured")
+	ErrMasterKeyNotFound       = errors.New("master key of the bucket data key is not configured")
+	ErrDecryptionFailed        = errors.New("object content can't be decrypted")
+)
+
+// BucketEncryption holds the bucket data key wrapped by a master key, the key
+// is kept when encryption is turned off so objects saved before can be read
+type BucketEncryption struct {
+	Enabled     bool   `json:"enabled"`
+	DataKey     string `bson:"data_key" json:"-"`
+	MasterKeyID string `bson:"master_key_id" json:"master_key_id,omitempty"`
+}
+
+// master keys loaded from the configuration in env
+var masterKeyCache struct {
+	sync.Mutex
+	env  string
+	keys map[string][]byte
+}
+
+// Master keys are configured as MASTER_KEYS=<kid>:<base64 key>,... or in the
+// MASTER_KEY_FILE, one <kid>:<base64 key> per line. Data keys are wrapped with
+// MASTER_KEY_ID, older keys are kept until rotate-keys re-wrapped their data
+// keys. Keys are loaded once, changes to the file need a restart.
+func masterKeys() (map[string][]byte, error) {
+	env := os.Getenv("MASTER_KEYS") + "\n" + os.Getenv("MASTER_KEY_FILE")
+	masterKeyCache.Lock()
+	defer masterKeyCache.Unlock()
+	if masterKeyCache.keys != nil && masterKeyCache.env == env {
+		return masterKeyCache.keys, nil
+	}
+	keys, err := loadMasterKeys()
+	if err != nil {
+		return nil, err
+	}
+	masterKeyCache.env, masterKeyCache.keys = env, keys
+	return keys, nil
+}
+
+func loadMasterKeys() (map[string][]byte, error) {
+	entries := strings.Split(os.Getenv("MASTER_KEYS"), ",")
+	if p := os.Getenv("MASTER_KEY_FILE"); p != "" {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, strings.Split(string(b), "\n")...)
+	}
+
+	keys := map[string][]byte{}
+	for _, e := range entries {
+		kv := strings.SplitN(strings.TrimSpace(e), ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		k, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil || len(k) != encKeySize {
+			return nil, fmt.Errorf("master key %s must be %d base64 encoded bytes", kv[0], encKeySize)
+		}
+		keys[kv[0]] = k
+	}
+	return keys, nil
+}
+
+func activeMasterKey() (string, []byte, error) {
+	keys, err := masterKeys()
+	if err != nil {
+		return "", nil, err
+	}
+	kid := os.Getenv("MASTER_KEY_ID")
+	k, ok := keys[kid]
+	if !ok {
+		return "", nil, ErrEncryptionNotConfigured
+	}
+	return kid, k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// Turn bucket encryption on or off, objects already saved stay as they are.
+// The data key is created the first time encryption is turned on.
+func (b *Bucket) setEncryption(enabled bool) error {
+	if enabled && b.Encryption.DataKey == "" {
+		k := make([]byte, encKeySize)
+		if _, err := rand.Read(k); err != nil {
+			return err
+		}
+		if err := b.wrapDataKey(k); err != nil {
+			return err
+		}
+	}
+	b.Encryption.Enabled = enabled
+	return nil
+}
+
+// wrap data key with the active master key
+func (b *Bucket) wrapDataKey(k []byte) error {
+	kid, mk, err := activeMasterKey()
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(mk)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	b.Encryption.DataKey = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, k, nil))
+	b.Encryption.MasterKeyID = kid
+	return nil
+}
+
+// unwrap bucket data key with the master key it was wrapped with
+func (b *Bucket) dataKey() ([]byte, error) {
+	keys, err := masterKeys()
+	if err != nil {
+		return nil, err
+	}
+	mk, ok := keys[b.Encryption.MasterKeyID]
+	if !ok {
+		return nil, ErrMasterKeyNotFound
+	}
+	aead, err := newGCM(mk)
+	if err != nil {
+		return nil, err
+	}
+	w, err := base64.StdEncoding.DecodeString(b.Encryption.DataKey)
+	if err != nil || len(w) < aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	k, err := aead.Open(nil, w[:aead.NonceSize()], w[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return k, nil
+}
+
+// Open object content as stored, encrypted content is decrypted as it's read
+// but compressed content is left compressed. Objects saved with a customer
+// key need the same key, it's ignored otherwise.
+func openStoredObject(o *Object, customerKey []byte) (StoredFile, error) {
+	var key []byte
+	if o.Encrypted {
+		var err error
+		if key, err = objectDataKey(o, customerKey); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := Storage().GetFile(o.Path())
+	if err != nil || key == nil {
+		return f, err
+	}
+	d, err := newDecryptingFile(f, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func objectDataKey(o *Object, customerKey []byte) ([]byte, error) {
+	if o.CustomerKeySHA256 != "" {
+		if err := o.CheckCustomerKey(customerKey); err != nil {
+			return nil, err
+		}
+		return customerKey, nil
+	}
+	b, err := FetchBucket(o.BucketName)
+	if err != nil {
+		return nil, err
+	}
+	return b.dataKey()
+}
+
+// key of a single object
+func objectKey(dataKey []byte, salt []byte) (cipher.AEAD, error) {
+	k := make([]byte, encKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dataKey, salt, []byte("object")), k); err != nil {
+		return nil, err
+	}
+	return newGCM(k)
+}
+
+func chunkNonce(i int64, final bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n, uint64(i))
+	if final {
+		n[8] = 1
+	}
+	return n
+}
+
+// Size of encrypted file holding size bytes of content
+func encryptedSize(size int64) int64 {
+	chunks := (size + encChunkSize - 1) / encChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encHeaderSize) + size + chunks*encTagSize
+}
+
+// Size of content held by an encrypted file of size bytes
+func decryptedSize(size int64) (int64, bool) {
+	body := size - int64(encHeaderSize)
+	if body < encTagSize {
+		return 0, false
+	}
+	full, rem := body/(encChunkSize+encTagSize), body%(encChunkSize+encTagSize)
+	if rem == 0 {
+		return full * encChunkSize, true
+	}
+	if rem < encTagSize {
+		return 0, false
+	}
+	return full*encChunkSize + rem - encTagSize, true
+}
+
+// encryptingReader reads r encrypted, a chunk is read ahead to know which
+// one is the last
+type encryptingReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	chunk []byte
+	out   []byte
+	// encrypted bytes not read yet
+	buf  []byte
+	idx  int64
+	done bool
+}
+
+func newEncryptingReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := objectKey(dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReader{
+		r:     bufio.NewReaderSize(r, encChunkSize),
+		aead:  aead,
+		chunk: make([]byte, encChunkSize),
+		buf:   append([]byte(encMagic), salt...),
+	}, nil
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+func (e *encryptingReader) seal() error {
+	n, err := io.ReadFull(e.r, e.chunk)
+	final := false
+	switch err {
+	case nil:
+		if _, err := e.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(e.idx, final), e.chunk[:n], nil)
+	e.buf = e.out
+	e.idx++
+	e.done = final
+	return nil
+}
+
+// decryptingFile decrypts an encrypted file a chunk at a time as it's read,
+// seeking only decrypts the chunk reading continues from
+type decryptingFile struct {
+	f    StoredFile
+	aead cipher.AEAD
+	size int64
+	pos  int64
+	// decrypted content of chunk idx
+	idx    int64
+	buf    []byte
+	sealed []byte
+}
+
+func newDecryptingFile(f StoredFile, dataKey []byte) (*decryptingFile, error) {
+	hdr := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(f, hdr); err != nil || string(hdr[:len(encMagic)]) != encMagic {
+		return nil, ErrDecryptionFailed
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	size, ok := decryptedSize(end)
+	if !ok {
+		return nil, ErrDecryptionFailed
+	}
+	aead, err := objectKey(dataKey, hdr[len(encMagic):])
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptingFile{
+		f:      f,
+		aead:   aead,
+		size:   size,
+		idx:    -1,
+		sealed: make([]byte, encChunkSize+encTagSize),
+	}
+	// empty content is never read, its chunk is still checked
+	if size == 0 {
+		if err := d.load(0); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *decryptingFile) load(idx int64) error {
+	n := d.size - idx*encChunkSize
+	if n > encChunkSize {
+		n = encChunkSize
+	}
+	if _, err := d.f.Seek(int64(encHeaderSize)+idx*(encChunkSize+encTagSize), io.SeekStart); err != nil {
+		return err
+	}
+	sealed := d.sealed[:n+encTagSize]
+	if _, err := io.ReadFull(d.f, sealed); err != nil {
+		return ErrDecryptionFailed
+	}
+
+	last := int64(0)
+	if d.size > 0 {
+		last = (d.size - 1) / encChunkSize
+	}
+	buf, err := d.aead.Open(d.buf[:0], chunkNonce(idx, idx == last), sealed, nil)
+	if err != nil {
+		d.idx = -1
+		return ErrDecryptionFailed
+	}
+	d.buf = buf
+	d.idx = idx
+	return nil
+}
+
+func (d *decryptingFile) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	idx := d.pos / encChunkSize
+	if idx != d.idx {
+		if err := d.load(idx); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf[d.pos-idx*encChunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptingFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decryptingFile) Close() error {
+	return d.f.Close()
+}
+
+func (d *decryptingFile) Name() string {
+	return d.f.Name()
+}
+
+// Re-wrap data keys wrapped by older master keys with the active one, the
+// older keys can be removed from the configuration afterwards. The server
+// must be stopped while it runs, it only picks up the new active key once
+// restarted and the bolt database can't be opened twice.
+// ex: ./server rotate-keys
+func RunRotateKeysCommand(args []string) int {
+	fs := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	dry := fs.Bool("dry-run", false, "only list buckets whose data key would be re-wrapped")
+	fs.Parse(args)
+
+	kid, _, err := activeMasterKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate-keys failed: %v\n", err)
+		return 2
+	}
+	buckets, err := Metadata().FetchBuckets()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate-keys failed: %v\n", err)
+		return 2
+	}
+
+	rotated, failed := []string{}, map[string]string{}
+	for i := range buckets {
+		b := &buckets[i]
+		if b.Encryption.DataKey == "" || b.Encryption.MasterKeyID == kid {
+			continue
+		}
+		if !*dry {
+			if err := rewrapDataKey(b); err != nil {
+				failed[b.Name] = err.Error()
+				continue
+			}
+		}
+		rotated = append(rotated, b.Name)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{
+		"master_key_id": kid,
+		"rotated":       rotated,
+		"failed":        failed,
+	})
+
+	if len(failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func rewrapDataKey(b *Bucket) error {
+	k, err := b.dataKey()
+	if err != nil {
+		return err
+	}
+	if err := b.wrapDataKey(k); err != nil {
+		return err
+	}
+	return Metadata().SetBucketDataKey(b.Name, b.Encryption.MasterKeyID, b.Encryption.DataKey)
+}
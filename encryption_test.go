@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testMasterKey(t *testing.T) string {
+	t.Helper()
+	k := make([]byte, encKeySize)
+	if _, err := rand.Read(k); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(k)
+}
+
+func encryptTestContent(t *testing.T, content []byte, key []byte) []byte {
+	t.Helper()
+	r, err := newEncryptingReader(bytes.NewReader(content), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncryptedContent(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), encKeySize)
+	for _, size := range []int{0, 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 5} {
+		content := make([]byte, size)
+		rand.Read(content)
+		enc := encryptTestContent(t, content, key)
+		if int64(len(enc)) != encryptedSize(int64(size)) {
+			t.Errorf("%d bytes: encrypted to %d, want %d", size, len(enc), encryptedSize(int64(size)))
+		}
+		if n, ok := decryptedSize(int64(len(enc))); !ok || n != int64(size) {
+			t.Errorf("%d bytes: decrypted size %d, %v", size, n, ok)
+		}
+
+		d, err := newDecryptingFile(&memoryFile{Reader: bytes.NewReader(enc)}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(d); err != nil || !bytes.Equal(b, content) {
+			t.Errorf("%d bytes: read %d bytes, %v", size, len(b), err)
+		}
+
+		// ranges across chunks
+		for _, off := range []int{0, size / 2, size - 1} {
+			if off < 0 {
+				continue
+			}
+			if _, err := d.Seek(int64(off), io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 10)
+			n, _ := io.ReadFull(d, b)
+			end := off + 10
+			if end > size {
+				end = size
+			}
+			if want := content[off:end]; !bytes.Equal(b[:n], want) {
+				t.Errorf("%d bytes: read %x at %d, want %x", size, b[:n], off, want)
+			}
+		}
+	}
+}
+
+func TestEncryptedContentTampered(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), encKeySize)
+	content := bytes.Repeat([]byte("a"), 2*encChunkSize+10)
+	enc := encryptTestContent(t, content, key)
+
+	tests := map[string][]byte{
+		// dropping the last chunk leaves a valid chunk that isn't final
+		"truncated": enc[:encHeaderSize+2*(encChunkSize+encTagSize)],
+		"flipped":   append(append([]byte{}, enc[:100]...), append([]byte{enc[100] ^ 1}, enc[101:]...)...),
+	}
+	for name, b := range tests {
+		d, err := newDecryptingFile(&memoryFile{Reader: bytes.NewReader(b)}, key)
+		if err == nil {
+			_, err = io.ReadAll(d)
+		}
+		if err != ErrDecryptionFailed {
+			t.Errorf("%s: got %v, want decryption failure", name, err)
+		}
+	}
+
+	d, err := newDecryptingFile(&memoryFile{Reader: bytes.NewReader(enc)}, bytes.Repeat([]byte("x"), encKeySize))
+	if err == nil {
+		_, err = io.ReadAll(d)
+	}
+	if err != ErrDecryptionFailed {
+		t.Errorf("wrong key: got %v, want decryption failure", err)
+	}
+}
+
+func TestMasterKeysLoadedOnce(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(p, []byte("k1:"+testMasterKey(t)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MASTER_KEYS", "")
+	t.Setenv("MASTER_KEY_FILE", p)
+	keys, err := masterKeys()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("got %d keys, %v", len(keys), err)
+	}
+
+	if err := os.WriteFile(p, []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := masterKeys(); err != nil || keys["k1"] == nil {
+		t.Errorf("keys reloaded: %v, %v", keys, err)
+	}
+
+	t.Setenv("MASTER_KEYS", "k2:"+strings.Repeat("A", 43)+"=")
+	if keys, err := masterKeys(); err != nil || keys["k2"] == nil {
+		t.Errorf("changed configuration not loaded: %v, %v", keys, err)
+	}
+}
+
+func TestRewrapDataKey(t *testing.T) {
+	setupStores(t)
+	t.Setenv("MASTER_KEYS", "k1:"+testMasterKey(t)+",k2:"+testMasterKey(t))
+	t.Setenv("MASTER_KEY_FILE", "")
+	t.Setenv("MASTER_KEY_ID", "k1")
+
+	b := &Bucket{Name: "encrypted"}
+	if err := b.setEncryption(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := createBucket(b); err != nil {
+		t.Fatal(err)
+	}
+	o := saveTestObject(t, b, "a.png", "secret")
+	if !o.Encrypted {
+		t.Fatal("object saved unencrypted")
+	}
+
+	// settings changed after the bucket was read are kept
+	fresh, err := FetchBucket(b.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh.Quota.MaxObjects = 10
+	if err := Metadata().UpdateBucket(fresh); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("MASTER_KEY_ID", "k2")
+	if err := rewrapDataKey(b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := FetchBucket(b.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Encryption.MasterKeyID != "k2" || got.Quota.MaxObjects != 10 {
+		t.Errorf("got master key %s and quota %+v", got.Encryption.MasterKeyID, got.Quota)
+	}
+
+	// the old key is no longer needed
+	t.Setenv("MASTER_KEYS", "k2:"+strings.Split(os.Getenv("MASTER_KEYS"), ",k2:")[1])
+	f, err := OpenObject(o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if c, err := io.ReadAll(f); err != nil || string(c) != "secret" {
+		t.Errorf("read %q, %v", c, err)
+	}
+}
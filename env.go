@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 )
@@ -17,3 +18,10 @@ func IsDevelopment() bool {
 func IsProduction() bool {
 	return os.Getenv("ENV") == "production"
 }
+
+// Requests per second each client can send to the S3 api, unlimited when
+// S3_RATE_LIMIT isn't set
+func S3RateLimit() float64 {
+	rps, _ := strconv.ParseFloat(os.Getenv("S3_RATE_LIMIT"), 64)
+	return rps
+}
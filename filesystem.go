@@ -1,94 +1,280 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func CreateFile(p string, data []byte) (*os.File, error) {
-	str, sErr := GetStorage()
-	if sErr != nil {
-		return nil, sErr
+// files being written are staged under this prefix next to their final path
+const stagingPrefix = ".upload-"
+
+// LocalStorage stores objects on the local disk under root directory
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{root: root}, nil
+}
+
+// Path of p on disk, paths leading out of root or to root itself are rejected
+func (s *LocalStorage) path(p string) (string, error) {
+	path := filepath.Join(s.root, p)
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrInvalidPath
+	}
+	return path, nil
+}
+
+// Write r to a temp file next to p then rename it into place, so readers
+// never see a partially written file
+func (s *LocalStorage) CreateFile(p string, r io.Reader) (int64, error) {
+	path, err := s.path(p)
+	if err != nil {
+		return 0, err
 	}
-	path := filepath.Join(str, p)
 	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
-		return nil, err
+		return 0, err
 	}
-	if err := ioutil.WriteFile(path, data, 0644); err != nil {
-		return nil, err
+	tmp, err := ioutil.TempFile(filepath.Dir(path), stagingPrefix+"*")
+	if err != nil {
+		return 0, err
 	}
-	f, err := os.Open(path)
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	n, err := io.Copy(tmp, r)
 	if err != nil {
-		return nil, err
+		tmp.Close()
+		return 0, err
 	}
-	return f, nil
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
-func GetFile(p string) (*os.File, error) {
-	str, sErr := GetStorage()
-	if sErr != nil {
-		return nil, sErr
+func (s *LocalStorage) AppendFile(p string, r io.Reader) (int64, error) {
+	path, err := s.path(p)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+func (s *LocalStorage) GetFile(p string) (StoredFile, error) {
+	path, err := s.path(p)
+	if err != nil {
+		return nil, err
 	}
-	path := filepath.Join(str, p)
 	f, err := os.Open(path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrFileNotFound
+		}
 		return nil, err
 	}
 	return f, nil
 }
 
-func CreateDir(dir string) (string, error) {
-	str, sErr := GetStorage()
-	if sErr != nil {
-		return "", sErr
+func (s *LocalStorage) CreateDir(dir string) error {
+	path, err := s.path(dir)
+	if err != nil {
+		return err
 	}
-	path := filepath.Join(str, dir)
-	if err := os.MkdirAll(path, 0777); err != nil {
-		return "", err
+	return os.MkdirAll(path, 0777)
+}
+
+func (s *LocalStorage) MoveDir(src, dst string) error {
+	from, err := s.path(src)
+	if err != nil {
+		return err
 	}
-	return path, nil
+	path, err := s.path(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return ErrDirExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(from, path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrFileNotFound
+		}
+		return err
+	}
+	return nil
 }
 
-func DeleteDir(dir string, force bool) error {
-	str, sErr := GetStorage()
-	if sErr != nil {
-		return sErr
+func (s *LocalStorage) DeleteDir(dir string, force bool) error {
+	path, err := s.path(dir)
+	if err != nil {
+		return err
 	}
-	path := filepath.Join(str, dir)
 	if force {
-		if err := os.RemoveAll(path); err != nil {
-			return err
+		return os.RemoveAll(path)
+	}
+	return removeEmptyDir(path)
+}
+
+// Remove sub directories then dir, removing fails on the first file found
+// even if it's written meanwhile
+func removeEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrFileNotFound
 		}
-	} else {
-		if err := os.Remove(path); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			return ErrDirNotEmpty
+		}
+		if err := removeEmptyDir(filepath.Join(dir, e.Name())); err != nil && err != ErrFileNotFound {
 			return err
 		}
 	}
+	if err := os.Remove(dir); err != nil {
+		if os.IsNotExist(err) {
+			return ErrFileNotFound
+		}
+		// both are used for directories that aren't empty
+		if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			return ErrDirNotEmpty
+		}
+		return err
+	}
 	return nil
 }
 
+func (s *LocalStorage) CleanStaging() (int, error) {
+	n := 0
+	err := filepath.Walk(s.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasPrefix(info.Name(), stagingPrefix) {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
 //Delete file giving the path as p
-func DeleteFile(p string) error {
-	str, sErr := GetStorage()
-	if sErr != nil {
-		return sErr
+func (s *LocalStorage) DeleteFile(p string) error {
+	path, err := s.path(p)
+	if err != nil {
+		return err
 	}
-	path := filepath.Join(str, p)
 	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrFileNotFound
+		}
 		return err
 	}
 	return nil
 }
 
-func Exists(p string) (bool, error) {
-	str, sErr := GetStorage()
-	if sErr != nil {
-		return false, sErr
+func (s *LocalStorage) MoveFile(src, dst string) error {
+	from, err := s.path(src)
+	if err != nil {
+		return err
 	}
-	path := filepath.Join(str, p)
-	_, err := os.Stat(path)
+	path, err := s.path(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(from, path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrFileNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) WalkFiles(fn func(p string, size int64) error) error {
+	return filepath.Walk(s.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), stagingPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info.Size())
+	})
+}
+
+func (s *LocalStorage) ModTime(p string) (time.Time, error) {
+	path, err := s.path(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, ErrFileNotFound
+		}
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (s *LocalStorage) Exists(p string) (bool, error) {
+	path, err := s.path(p)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
 	if err == nil {
 		return true, nil
 	}
@@ -98,13 +284,6 @@ func Exists(p string) (bool, error) {
 	return false, err
 }
 
-func GetStorage() (string, error) {
-	if err := os.MkdirAll("cloud", os.ModeDir); err != nil {
-		return "", err
-	}
-	return "./cloud", nil
-}
-
 func NameWithoutExt(fileName string) string {
 	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Orphan files are moved here on repair so they can be inspected before
+// being deleted by hand
+const quarantineDir = ".quarantine"
+
+// files written more recently aren't reported as orphans, they can belong to
+// saves started after the journal was read or in another process
+var FsckOrphanGrace = 15 * time.Minute
+
+// Fsck issue kinds
+const (
+	FsckOrphanFile       = "orphan_file"
+	FsckMissingFile      = "missing_file"
+	FsckSizeMismatch     = "size_mismatch"
+	FsckChecksumMismatch = "checksum_mismatch"
+	FsckChecksumMissing  = "checksum_missing"
+	FsckBlobRefs         = "blob_refs_mismatch"
+)
+
+type FsckOptions struct {
+	// read every file to verify its checksum, objects saved before checksums
+	// existed get them computed on repair
+	Checksums bool `json:"checksums"`
+	// quarantine orphan files, mark objects with missing or changed content
+	// as broken, update mismatched sizes and recount blob references
+	Repair bool `json:"repair"`
+}
+
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	Object   string `json:"object,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	// what repair did, or why it failed
+	Repair string `json:"repair,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type FsckReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Files      int       `json:"files"`
+	Objects    int       `json:"objects"`
+	// objects marked broken by a previous repair aren't checked again
+	Broken int         `json:"broken"`
+	Issues []FsckIssue `json:"issues"`
+}
+
+// storage directories that don't hold objects
+func isInternalPath(p string) bool {
+	switch strings.SplitN(p, "/", 2)[0] {
+	case uploadsDir, multipartDir, quarantineDir, variantsDir:
+		return true
+	}
+	return false
+}
+
+func objectFilePath(o *Object) string {
+	return filepath.ToSlash(o.Path())
+}
+
+// Walk the storage and the objects and report files without objects, objects
+// without files and files that don't match their object. The server can keep
+// running meanwhile, candidates are checked again before they are reported so
+// objects saved or deleted during the walk aren't reported.
+func Fsck(opts *FsckOptions) (*FsckReport, error) {
+	rep := &FsckReport{
+		StartedAt: time.Now(),
+		Issues:    []FsckIssue{},
+	}
+
+	// files of saves in progress don't have their object yet
+	pending := map[string]bool{}
+	entries, err := Metadata().FetchJournalEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Op == JournalObjectSave {
+			pending[e.Path] = true
+		}
+	}
+
+	// objects with the same content share a blob file
+	objects := map[string][]*Object{}
+	err = Metadata().EachObject(func(o *Object) error {
+		rep.Objects++
+		if o.Broken {
+			rep.Broken++
+		}
+		if !o.DeleteMarker {
+			p := objectFilePath(o)
+			objects[p] = append(objects[p], o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	err = Storage().WalkFiles(func(p string, size int64) error {
+		if isInternalPath(p) {
+			return nil
+		}
+		rep.Files++
+
+		obs, ok := objects[p]
+		if !ok {
+			if !pending[p] {
+				rep.add(checkOrphanFile(p, opts))
+			}
+			return nil
+		}
+		seen[p] = true
+		sums := fileChecksumsOnce(obs[0])
+		for _, o := range obs {
+			if !o.Broken {
+				rep.add(checkObjectFile(o, size, sums, opts)...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for p, obs := range objects {
+		if seen[p] {
+			continue
+		}
+		for _, o := range obs {
+			if !o.Broken {
+				rep.add(checkMissingFile(o, opts))
+			}
+		}
+	}
+
+	blobs, err := Metadata().FetchBlobs()
+	if err != nil {
+		return nil, err
+	}
+	for i := range blobs {
+		rep.add(checkBlobRefs(blobs[i].Path, opts))
+	}
+
+	rep.FinishedAt = time.Now()
+	return rep, nil
+}
+
+func (r *FsckReport) add(issues ...*FsckIssue) {
+	for _, i := range issues {
+		if i != nil {
+			r.Issues = append(r.Issues, *i)
+		}
+	}
+}
+
+func (i *FsckIssue) repaired(action string, err error) {
+	if err != nil {
+		i.Error = err.Error()
+		return
+	}
+	i.Repair = action
+}
+
+// object files are named <uuid><ext> and blobs by their content hash, the
+// object could have been saved after objects were read. The journal is read
+// again before the object so saves finishing meanwhile are seen either way.
+func checkOrphanFile(p string, opts *FsckOptions) *FsckIssue {
+	if t, err := Storage().ModTime(p); err != nil || time.Since(t) < FsckOrphanGrace {
+		return nil
+	}
+	if isBlobPath(p) {
+		// blobs are locked until the object referencing them is stored
+		unlock := lockBlob(p)
+		defer unlock()
+		if n, err := Metadata().CountBlobObjects(p); err == nil && n > 0 {
+			return nil
+		}
+	} else {
+		if pending, err := isPendingSave(p); err != nil || pending {
+			return nil
+		}
+		id := NameWithoutExt(path.Base(p))
+		if o, err := Metadata().FetchObject(id); err == nil && objectFilePath(o) == p {
+			return nil
+		}
+	}
+
+	i := &FsckIssue{Kind: FsckOrphanFile, Path: p}
+	if opts.Repair {
+		i.repaired("quarantined", Storage().MoveFile(p, path.Join(quarantineDir, p)))
+	}
+	return i
+}
+
+// Check if p belongs to a save in progress
+func isPendingSave(p string) (bool, error) {
+	entries, err := Metadata().FetchJournalEntries()
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Op == JournalObjectSave && filepath.ToSlash(e.Path) == p {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func checkMissingFile(o *Object, opts *FsckOptions) *FsckIssue {
+	p := objectFilePath(o)
+
+	// the object could have been deleted after objects were read
+	if _, err := Metadata().FetchObject(o.UUID); err == ErrRecordNotFound {
+		return nil
+	}
+	if ok, err := Storage().Exists(p); err == nil && ok {
+		return nil
+	}
+
+	i := &FsckIssue{Kind: FsckMissingFile, Path: p, Object: o.UUID}
+	if opts.Repair {
+		o.Broken = true
+		i.repaired("marked broken", Metadata().UpdateObject(o))
+	}
+	return i
+}
+
+func checkObjectFile(o *Object, size int64, fileSums func() (Checksums, error), opts *FsckOptions) []*FsckIssue {
+	var (
+		issues  []*FsckIssue
+		changed []*FsckIssue
+		p       = objectFilePath(o)
+	)
+
+	want := o.StoredBytes()
+	if want != size {
+		i := &FsckIssue{
+			Kind:     FsckSizeMismatch,
+			Path:     p,
+			Object:   o.UUID,
+			Expected: fmt.Sprint(want),
+			Actual:   fmt.Sprint(size),
+		}
+		issues = append(issues, i)
+		if opts.Repair {
+			// encrypted or compressed content can't change size without
+			// being corrupted
+			if o.Encrypted || o.Encoding != "" {
+				o.Broken = true
+			} else {
+				o.Size = int(size)
+				o.StoredSize = size
+			}
+			changed = append(changed, i)
+		}
+	}
+
+	// content encrypted with a customer key can't be read without it
+	if opts.Checksums && o.CustomerKeySHA256 == "" {
+		sums, err := fileSums()
+		if err != nil {
+			issues = append(issues, &FsckIssue{Kind: FsckChecksumMismatch, Path: p, Object: o.UUID, Error: err.Error()})
+		} else if o.SHA256 == "" {
+			i := &FsckIssue{Kind: FsckChecksumMissing, Path: p, Object: o.UUID, Actual: sums.SHA256}
+			issues = append(issues, i)
+			if opts.Repair {
+				o.SHA256, o.MD5 = sums.SHA256, sums.MD5
+				changed = append(changed, i)
+			}
+		} else if o.SHA256 != sums.SHA256 {
+			i := &FsckIssue{
+				Kind:     FsckChecksumMismatch,
+				Path:     p,
+				Object:   o.UUID,
+				Expected: o.SHA256,
+				Actual:   sums.SHA256,
+			}
+			issues = append(issues, i)
+			if opts.Repair {
+				o.Broken = true
+				changed = append(changed, i)
+			}
+		}
+	}
+
+	if len(changed) > 0 {
+		err := Metadata().UpdateObject(o)
+		for _, i := range changed {
+			switch i.Kind {
+			case FsckSizeMismatch:
+				if o.Broken {
+					i.repaired("marked broken", err)
+				} else {
+					i.repaired("size updated", err)
+				}
+			case FsckChecksumMissing:
+				i.repaired("checksums stored", err)
+			case FsckChecksumMismatch:
+				i.repaired("marked broken", err)
+			}
+		}
+	}
+	return issues
+}
+
+func fileChecksums(o *Object) (Checksums, error) {
+	f, err := OpenObject(o, nil)
+	if err != nil {
+		return Checksums{}, err
+	}
+	defer f.Close()
+
+	cr := newChecksumReader(f, Checksums{})
+	if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+		return Checksums{}, err
+	}
+	return cr.Sums(), nil
+}
+
+// checksums of an object file, read once for every object sharing it
+func fileChecksumsOnce(o *Object) func() (Checksums, error) {
+	var (
+		sums Checksums
+		err  error
+		read bool
+	)
+	return func() (Checksums, error) {
+		if !read {
+			sums, err = fileChecksums(o)
+			read = true
+		}
+		return sums, err
+	}
+}
+
+// blob references must match the objects referencing it, blobs without any
+// are deleted on repair
+func checkBlobRefs(p string, opts *FsckOptions) *FsckIssue {
+	unlock := lockBlob(p)
+	b, n, err := countBlobRefs(p)
+	unlock()
+	if err == ErrRecordNotFound || (err == nil && b.Refs == n) {
+		return nil
+	}
+
+	i := &FsckIssue{Kind: FsckBlobRefs, Path: p}
+	if err != nil {
+		i.Error = err.Error()
+		return i
+	}
+	i.Expected, i.Actual = fmt.Sprint(n), fmt.Sprint(b.Refs)
+	if opts.Repair {
+		_, n, err := recountBlob(p)
+		if n == 0 {
+			i.repaired("blob deleted", err)
+		} else {
+			i.repaired("references recounted", err)
+		}
+	}
+	return i
+}
+
+// Run fsck from the command line and print the report as json, exits with 1
+// when issues are found
+// ex: ./server fsck -checksums -repair
+func RunFsckCommand(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	opts := &FsckOptions{}
+	fs.BoolVar(&opts.Checksums, "checksums", false, "verify content checksums, reads every file")
+	fs.BoolVar(&opts.Repair, "repair", false, "quarantine orphans, mark broken objects and fix sizes")
+	fs.Parse(args)
+
+	rep, err := Fsck(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %v\n", err)
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(rep)
+
+	if len(rep.Issues) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Check storage against metadata, body is optional
+// ex: {"checksums": true, "repair": true}
+func HandleFsck(w http.ResponseWriter, r *http.Request) {
+	if err := AuthorizeAdmin(r); err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	var opts FsckOptions
+	if r.ContentLength != 0 {
+		if err := ParseAndValidate(r, &opts); err != nil {
+			SendValidationError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+		defer r.Body.Close()
+	}
+
+	rep, err := Fsck(&opts)
+	if err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{"report": rep})
+}
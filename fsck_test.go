@@ -0,0 +1,160 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func fsckIssues(rep *FsckReport) map[string]FsckIssue {
+	issues := map[string]FsckIssue{}
+	for _, i := range rep.Issues {
+		issues[i.Kind] = i
+	}
+	return issues
+}
+
+// report orphan files however recently they were written
+func noOrphanGrace(t *testing.T) {
+	grace := FsckOrphanGrace
+	FsckOrphanGrace = 0
+	t.Cleanup(func() { FsckOrphanGrace = grace })
+}
+
+func TestFsck(t *testing.T) {
+	setupStores(t)
+	noOrphanGrace(t)
+	b := newTestBucket(t, "photos")
+	saveTestObject(t, b, "good.png", "good")
+	missing := saveTestObject(t, b, "missing.png", "missing")
+	resized := saveTestObject(t, b, "resized.png", "resized")
+	changed := saveTestObject(t, b, "changed.png", "changed")
+
+	orphan := "photos/orphan.png"
+	files := map[string]string{
+		orphan:                          "orphan",
+		objectFilePath(resized):         "resized and grown",
+		objectFilePath(changed):         "CHANGED",
+		path.Join(uploadsDir, "upload"): "not an object",
+	}
+	for p, c := range files {
+		if _, err := Storage().CreateFile(p, strings.NewReader(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Storage().DeleteFile(missing.Path()); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := Fsck(&FsckOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := []string{}
+	for _, i := range rep.Issues {
+		kinds = append(kinds, i.Kind)
+	}
+	sort.Strings(kinds)
+	want := []string{FsckChecksumMismatch, FsckChecksumMismatch, FsckMissingFile, FsckOrphanFile, FsckSizeMismatch}
+	if strings.Join(kinds, ",") != strings.Join(want, ",") {
+		t.Fatalf("got issues %v, want %v", kinds, want)
+	}
+	if rep.Objects != 4 || rep.Files != 4 {
+		t.Errorf("checked %d objects and %d files", rep.Objects, rep.Files)
+	}
+	if i := fsckIssues(rep)[FsckSizeMismatch]; i.Object != resized.UUID || i.Expected != "7" || i.Actual != "17" {
+		t.Errorf("got size issue %+v", i)
+	}
+	if ok, _ := Storage().Exists(orphan); !ok {
+		t.Error("orphan moved without repair")
+	}
+
+	rep, err = Fsck(&FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issues := fsckIssues(rep)
+	if len(rep.Issues) != 3 || issues[FsckOrphanFile].Repair != "quarantined" ||
+		issues[FsckMissingFile].Repair != "marked broken" || issues[FsckSizeMismatch].Repair != "size updated" {
+		t.Errorf("got repairs %+v", rep.Issues)
+	}
+	if ok, _ := Storage().Exists(path.Join(quarantineDir, orphan)); !ok {
+		t.Error("orphan not quarantined")
+	}
+	if o, _ := FetchObject(missing.UUID); !o.Broken {
+		t.Error("object without file not marked broken")
+	}
+	if o, _ := FetchObject(resized.UUID); o.Size != 17 {
+		t.Errorf("got size %d", o.Size)
+	}
+
+	// changed content is still found with checksums, repairing it marks the
+	// objects broken and nothing is left
+	if _, err := Fsck(&FsckOptions{Checksums: true, Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{changed.UUID, resized.UUID} {
+		if o, _ := FetchObject(id); !o.Broken {
+			t.Errorf("object %s with changed content not marked broken", o.Key)
+		}
+	}
+	rep, err = Fsck(&FsckOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Issues) != 0 || rep.Broken != 3 {
+		t.Errorf("got %d broken objects and issues %+v after repair", rep.Broken, rep.Issues)
+	}
+}
+
+func TestFsckChecksumMissing(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "a")
+	sum := o.SHA256
+	// saved before checksums were kept
+	o.SHA256, o.MD5 = "", ""
+	if err := Metadata().UpdateObject(o); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := Fsck(&FsckOptions{Checksums: true, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Issues) != 1 || rep.Issues[0].Kind != FsckChecksumMissing || rep.Issues[0].Repair != "checksums stored" {
+		t.Fatalf("got issues %+v", rep.Issues)
+	}
+	if o, _ := FetchObject(o.UUID); o.SHA256 != sum {
+		t.Errorf("got sha256 %s, want %s", o.SHA256, sum)
+	}
+}
+
+func TestFsckRecentOrphans(t *testing.T) {
+	setupStores(t)
+	newTestBucket(t, "photos")
+	orphan := "photos/orphan.png"
+	if _, err := Storage().CreateFile(orphan, strings.NewReader("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	// files written during the grace period are left alone
+	rep, err := Fsck(&FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Issues) != 0 {
+		t.Errorf("got issues %+v for a recent file", rep.Issues)
+	}
+
+	// a save starting after the journal was first read isn't quarantined
+	noOrphanGrace(t)
+	addTestJournalEntry(t, &JournalEntry{Op: JournalObjectSave, Bucket: "photos", Object: "orphan", Path: orphan})
+	if i := checkOrphanFile(orphan, &FsckOptions{Repair: true}); i != nil {
+		t.Errorf("got issue %+v for a pending save", i)
+	}
+	if ok, _ := Storage().Exists(orphan); !ok {
+		t.Error("file of a pending save quarantined")
+	}
+}
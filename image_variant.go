@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Shared images can be resized and converted on the fly with width, height,
+// fit, format and quality query parameters. Variants are cached under
+// .variants/<object uuid>, objects never change once saved so variants are
+// only dropped along with their object.
+
+const variantsDir = ".variants"
+
+const (
+	FitContain = "contain"
+	FitCover   = "cover"
+	FitFill    = "fill"
+)
+
+const (
+	MaxImageDimension = 4096
+	// larger images aren't decoded
+	MaxImagePixels      = 16000000
+	DefaultImageQuality = 85
+)
+
+var (
+	ErrImageUnsupported = errors.New("object is not a supported image")
+	ErrImageTooLarge    = errors.New("image is too large to transform")
+)
+
+// format -> content type of the formats images are converted to
+var imageFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+// variants made at once, decoding and resizing take a lot of memory
+var variantSlots = make(chan struct{}, 4)
+
+var imageTransformParams = []string{"width", "height", "fit", "format", "quality"}
+
+type ImageTransform struct {
+	// zero keeps the aspect ratio of the other dimension
+	Width  int
+	Height int
+	Fit    string
+	// empty keeps the object format
+	Format string
+	// jpeg quality
+	Quality int
+}
+
+// Parse image transform query parameters, nil when none is set
+func ParseImageTransform(q url.Values) (*ImageTransform, error) {
+	set := false
+	for _, p := range imageTransformParams {
+		set = set || q.Get(p) != ""
+	}
+	if !set {
+		return nil, nil
+	}
+
+	t := &ImageTransform{
+		Fit:     q.Get("fit"),
+		Format:  strings.ToLower(q.Get("format")),
+		Quality: DefaultImageQuality,
+	}
+	var err error
+	if t.Width, err = dimensionParam(q, "width"); err != nil {
+		return nil, err
+	}
+	if t.Height, err = dimensionParam(q, "height"); err != nil {
+		return nil, err
+	}
+
+	switch t.Fit {
+	case "":
+		t.Fit = FitContain
+	case FitContain, FitCover, FitFill:
+	default:
+		return nil, errors.New("fit must be contain, cover or fill")
+	}
+
+	if t.Format == "jpg" {
+		t.Format = "jpeg"
+	}
+	if _, ok := imageFormats[t.Format]; t.Format != "" && !ok {
+		return nil, errors.New("format must be jpeg, png or gif")
+	}
+
+	if s := q.Get("quality"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			return nil, errors.New("quality must be between 1 and 100")
+		}
+		t.Quality = n
+	}
+	return t, nil
+}
+
+func dimensionParam(q url.Values, name string) (int, error) {
+	s := q.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > MaxImageDimension {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, MaxImageDimension)
+	}
+	return n, nil
+}
+
+// Format of the variant of an image of type t, images in formats that can't
+// be written are converted to png
+func (t *ImageTransform) format(typ string) string {
+	if t.Format != "" {
+		return t.Format
+	}
+	for f, ct := range imageFormats {
+		if ct == typ {
+			return f
+		}
+	}
+	return "png"
+}
+
+// Variant key of the transform in format, equal transforms share a variant
+func (t *ImageTransform) key(format string) string {
+	k := fmt.Sprintf("%dx%d", t.Width, t.Height)
+	if t.Width != 0 && t.Height != 0 {
+		k += "-" + t.Fit
+	}
+	if format == "jpeg" {
+		k += fmt.Sprintf("-q%d", t.Quality)
+	}
+	return k
+}
+
+// Resize src, the fit only matters when both width and height are set
+func (t *ImageTransform) apply(src image.Image) (image.Image, error) {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	w, h := t.Width, t.Height
+	switch {
+	case w == 0 && h == 0:
+		// format conversion only
+		return src, nil
+	case w == 0:
+		w = scaled(sw, h, sh)
+	case h == 0:
+		h = scaled(sh, w, sw)
+	case t.Fit == FitContain:
+		if w*sh < h*sw {
+			h = scaled(sh, w, sw)
+		} else {
+			w = scaled(sw, h, sh)
+		}
+	case t.Fit == FitCover:
+		// scale to cover the box then crop the middle
+		rw, rh := w, h
+		if w*sh > h*sw {
+			rh = scaled(sh, w, sw)
+		} else {
+			rw = scaled(sw, h, sh)
+		}
+		if rw > MaxImageDimension || rh > MaxImageDimension {
+			return nil, ErrImageTooLarge
+		}
+		img := resizeImage(src, rw, rh)
+		x, y := (rw-w)/2, (rh-h)/2
+		return img.SubImage(image.Rect(x, y, x+w, y+h)), nil
+	}
+	if w > MaxImageDimension || h > MaxImageDimension {
+		return nil, ErrImageTooLarge
+	}
+	return resizeImage(src, w, h), nil
+}
+
+// n scaled by to/from, at least 1
+func scaled(n, to, from int) int {
+	v := int(math.Round(float64(n) * float64(to) / float64(from)))
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+func variantsPath(uuid string) string {
+	return path.Join(variantsDir, uuid)
+}
+
+// file extension of format
+func imageExt(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+// Serve image object o transformed by t, variants are made on first request
+// and cached unless the object is encrypted
+func serveImageVariant(o *Object, t *ImageTransform, customerKey []byte) (*ServedFile, error) {
+	if !strings.HasPrefix(o.Type, "image/") {
+		return nil, ErrImageUnsupported
+	}
+	format := t.format(o.Type)
+	key := t.key(format)
+	name := o.DownloadName()
+	sf := &ServedFile{
+		Type:     imageFormats[format],
+		Filename: strings.TrimSuffix(name, path.Ext(name)) + "." + imageExt(format),
+		ModTime:  o.CreatedAt,
+	}
+	if o.SHA256 != "" {
+		sf.ETag = `"` + o.SHA256 + "-" + key + `"`
+	}
+
+	// decrypted variants would leak encrypted content
+	p := path.Join(variantsPath(o.UUID), key+"."+imageExt(format))
+	cache := !o.Encrypted
+	if cache {
+		f, err := Storage().GetFile(p)
+		if err == nil {
+			sf.File = f
+			return sf, nil
+		}
+		if err != ErrFileNotFound {
+			return nil, err
+		}
+	}
+
+	variantSlots <- struct{}{}
+	b, err := makeImageVariant(o, t, format, customerKey)
+	<-variantSlots
+	if err != nil {
+		return nil, err
+	}
+	if cache {
+		// failing to cache only costs transforming again
+		if _, err := Storage().CreateFile(p, bytes.NewReader(b)); err != nil {
+			log.Printf("caching image variant %s: %v\n", p, err)
+		} else if _, err := FetchObject(o.UUID); err == ErrRecordNotFound {
+			// deleted while transforming
+			ignoreNotFound(Storage().DeleteDir(variantsPath(o.UUID), true))
+		}
+	}
+	sf.File = &memoryFile{Reader: bytes.NewReader(b), name: path.Base(p)}
+	return sf, nil
+}
+
+func makeImageVariant(o *Object, t *ImageTransform, format string, customerKey []byte) ([]byte, error) {
+	f, err := OpenObject(o, customerKey)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// check the size before decoding the whole image
+	cfg, _, err := image.DecodeConfig(f)
+	if err == image.ErrFormat {
+		return nil, ErrImageUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > MaxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := t.apply(src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: t.Quality})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Draw img over white, jpeg has no transparency. Resized images are
+// flattened in place, others are only wrapped.
+func flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		return onWhite{img}
+	}
+	b := rgba.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := rgba.Pix[rgba.PixOffset(b.Min.X, y):rgba.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			// premultiplied, white shows through what's left
+			t := 255 - row[i+3]
+			row[i], row[i+1], row[i+2], row[i+3] = row[i]+t, row[i+1]+t, row[i+2]+t, 255
+		}
+	}
+	return rgba
+}
+
+type onWhite struct {
+	image.Image
+}
+
+func (img onWhite) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (img onWhite) At(x, y int) color.Color {
+	r, g, b, a := img.Image.At(x, y).RGBA()
+	t := 0xffff - a
+	return color.RGBA64{uint16(r + t), uint16(g + t), uint16(b + t), 0xffff}
+}
+
+// Resize src to w x h with a linear filter, widened when shrinking so every
+// source pixel counts. Pixels are blended premultiplied so transparent pixels
+// don't darken their neighbours. Source rows are read one at a time so only
+// the resized image is allocated in full.
+func resizeImage(src image.Image, w, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	read := rowReader(src)
+	xfws := resampleWeights(sw, w)
+	line := make([]uint8, sw*4)
+
+	// source rows resized to w, kept while output rows blend them
+	rows := map[int][]float64{}
+	row := func(y int) []float64 {
+		if r, ok := rows[y]; ok {
+			return r
+		}
+		read(y, line)
+		r := make([]float64, w*4)
+		for x, fw := range xfws {
+			for i, v := range fw.weights {
+				p := line[(fw.start+i)*4:]
+				for k := 0; k < 4; k++ {
+					r[x*4+k] += v * float64(p[k])
+				}
+			}
+		}
+		rows[y] = r
+		return r
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	c := make([]float64, w*4)
+	for y, fw := range resampleWeights(sh, h) {
+		for r := range rows {
+			if r < fw.start {
+				delete(rows, r)
+			}
+		}
+		for i := range c {
+			c[i] = 0
+		}
+		for i, v := range fw.weights {
+			for k, p := range row(fw.start + i) {
+				c[k] += v * p
+			}
+		}
+		setPixels(out.Pix[y*out.Stride:y*out.Stride+w*4], c)
+	}
+	return out
+}
+
+// Reader of the premultiplied RGBA pixels of src rows, the common decoded
+// image types are read without going through color conversions
+func rowReader(src image.Image) func(y int, dst []uint8) {
+	b := src.Bounds()
+	switch img := src.(type) {
+	case *image.RGBA:
+		return func(y int, dst []uint8) {
+			i := img.PixOffset(b.Min.X, b.Min.Y+y)
+			copy(dst, img.Pix[i:i+len(dst)])
+		}
+	case *image.NRGBA:
+		return func(y int, dst []uint8) {
+			i := img.PixOffset(b.Min.X, b.Min.Y+y)
+			src := img.Pix[i : i+len(dst)]
+			for j := 0; j < len(dst); j += 4 {
+				a := uint32(src[j+3])
+				dst[j] = uint8(uint32(src[j]) * a / 255)
+				dst[j+1] = uint8(uint32(src[j+1]) * a / 255)
+				dst[j+2] = uint8(uint32(src[j+2]) * a / 255)
+				dst[j+3] = uint8(a)
+			}
+		}
+	case *image.YCbCr:
+		return func(y int, dst []uint8) {
+			for x := 0; x < len(dst)/4; x++ {
+				yi := img.YOffset(b.Min.X+x, b.Min.Y+y)
+				ci := img.COffset(b.Min.X+x, b.Min.Y+y)
+				r, g, bl := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+				dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = r, g, bl, 255
+			}
+		}
+	case *image.Gray:
+		return func(y int, dst []uint8) {
+			i := img.PixOffset(b.Min.X, b.Min.Y+y)
+			for x, v := range img.Pix[i : i+len(dst)/4] {
+				dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = v, v, v, 255
+			}
+		}
+	}
+	return func(y int, dst []uint8) {
+		for x := 0; x < len(dst)/4; x++ {
+			r, g, bl, a := src.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = uint8(r>>8), uint8(g>>8), uint8(bl>>8), uint8(a>>8)
+		}
+	}
+}
+
+// source pixels blended into a destination pixel
+type filterWeights struct {
+	start   int
+	weights []float64
+}
+
+func resampleWeights(in, out int) []filterWeights {
+	scale := float64(in) / float64(out)
+	radius := math.Max(scale, 1)
+	fws := make([]filterWeights, out)
+	for i := range fws {
+		center := (float64(i)+0.5)*scale - 0.5
+		lo := int(math.Ceil(center - radius))
+		hi := int(math.Floor(center + radius))
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > in-1 {
+			hi = in - 1
+		}
+
+		ws := make([]float64, 0, hi-lo+1)
+		sum := 0.0
+		for j := lo; j <= hi; j++ {
+			v := math.Max(1-math.Abs(float64(j)-center)/radius, 0)
+			ws = append(ws, v)
+			sum += v
+		}
+		for j := range ws {
+			ws[j] /= sum
+		}
+		fws[i] = filterWeights{start: lo, weights: ws}
+	}
+	return fws
+}
+
+func setPixels(p []uint8, c []float64) {
+	for k, v := range c {
+		p[k] = uint8(math.Min(math.Max(v+0.5, 0), 255))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"testing"
+)
+
+func TestParseImageTransform(t *testing.T) {
+	if tr, err := ParseImageTransform(url.Values{"key": {"a"}}); tr != nil || err != nil {
+		t.Errorf("got %+v, %v without transform parameters", tr, err)
+	}
+
+	tr, err := ParseImageTransform(url.Values{"width": {"200"}, "format": {"JPG"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ImageTransform{Width: 200, Fit: FitContain, Format: "jpeg", Quality: DefaultImageQuality}
+	if *tr != want {
+		t.Errorf("got %+v, want %+v", *tr, want)
+	}
+
+	for _, q := range []string{"width=0", "height=5000", "width=a", "fit=crop", "format=webp", "quality=101"} {
+		v, _ := url.ParseQuery(q)
+		if _, err := ParseImageTransform(v); err == nil {
+			t.Errorf("%s accepted", q)
+		}
+	}
+}
+
+func TestImageTransformApply(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	tests := []struct {
+		tr   ImageTransform
+		w, h int
+	}{
+		{ImageTransform{Width: 100}, 100, 50},
+		{ImageTransform{Height: 100}, 200, 100},
+		{ImageTransform{Width: 100, Height: 100, Fit: FitContain}, 100, 50},
+		{ImageTransform{Width: 100, Height: 100, Fit: FitCover}, 100, 100},
+		{ImageTransform{Width: 100, Height: 300, Fit: FitFill}, 100, 300},
+		{ImageTransform{}, 400, 200},
+	}
+	for _, tt := range tests {
+		img, err := tt.tr.apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("%+v: got %dx%d, want %dx%d", tt.tr, b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+	}
+
+	// covering the box would need a too large image
+	tall := image.NewNRGBA(image.Rect(0, 0, 10, 1000))
+	tr := ImageTransform{Width: 1000, Height: 10, Fit: FitCover}
+	if _, err := tr.apply(tall); err != ErrImageTooLarge {
+		t.Errorf("got %v, want too large", err)
+	}
+}
+
+// images of every decoded type with the left half transparent or black and
+// the right half opaque white
+func testImages() map[string]image.Image {
+	r := image.Rect(0, 0, 40, 20)
+	nrgba, rgba, gray := image.NewNRGBA(r), image.NewRGBA(r), image.NewGray(r)
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	pal := image.NewPaletted(r, color.Palette{color.Transparent, color.White})
+	for y := 0; y < 20; y++ {
+		for x := 20; x < 40; x++ {
+			nrgba.Set(x, y, color.White)
+			rgba.Set(x, y, color.White)
+			gray.Set(x, y, color.White)
+			pal.Set(x, y, color.White)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = 255
+		}
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = 128, 128
+	}
+	return map[string]image.Image{"nrgba": nrgba, "rgba": rgba, "gray": gray, "ycbcr": ycbcr, "paletted": pal}
+}
+
+func TestResizeImage(t *testing.T) {
+	for name, src := range testImages() {
+		img := resizeImage(src, 10, 5)
+		if b := img.Bounds(); b.Dx() != 10 || b.Dy() != 5 {
+			t.Fatalf("%s: got %dx%d", name, b.Dx(), b.Dy())
+		}
+		// far from the middle pixels keep their colors
+		if c := img.RGBAAt(9, 2); c != (color.RGBA{255, 255, 255, 255}) {
+			t.Errorf("%s: right pixel %v, want white", name, c)
+		}
+		_, _, _, a := src.At(0, 0).RGBA()
+		if c := img.RGBAAt(0, 2); c.R != 0 || c.A != uint8(a>>8) {
+			t.Errorf("%s: left pixel %v", name, c)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	for name, src := range testImages() {
+		// transparent pixels turn white and black ones stay black
+		_, _, _, a := src.At(0, 0).RGBA()
+		want := uint32(0)
+		if a == 0 {
+			want = 0xffff
+		}
+		for _, img := range []image.Image{src, resizeImage(src, 10, 5)} {
+			r, _, _, a := flatten(img).At(0, 0).RGBA()
+			if r != want || a != 0xffff {
+				t.Errorf("%s %T: got red %x alpha %x, want red %x", name, img, r, a, want)
+			}
+		}
+	}
+}
+
+// png with only a header of a w x h image
+func pngHeader(w, h int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	data := make([]byte, 13)
+	binary.BigEndian.PutUint32(data, uint32(w))
+	binary.BigEndian.PutUint32(data[4:], uint32(h))
+	data[8], data[9] = 8, 6
+	chunk := append([]byte("IHDR"), data...)
+	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestServeImageVariant(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "images")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImages()["nrgba"]); err != nil {
+		t.Fatal(err)
+	}
+	o := saveTestObject(t, b, "a.png", buf.String())
+
+	tr := &ImageTransform{Width: 10, Fit: FitContain, Format: "jpeg", Quality: DefaultImageQuality}
+	sf, err := serveImageVariant(o, tr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.File.Close()
+	cfg, format, err := image.DecodeConfig(sf.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || cfg.Width != 10 || cfg.Height != 5 || sf.Type != "image/jpeg" || sf.Filename != "a.jpg" {
+		t.Errorf("got %s %dx%d served as %s %s", format, cfg.Width, cfg.Height, sf.Type, sf.Filename)
+	}
+	if _, err := Storage().GetFile(variantsPath(o.UUID) + "/10x0-q85.jpg"); err != nil {
+		t.Errorf("variant not cached: %v", err)
+	}
+
+	// variants are deleted with their object
+	if err := DeleteObject(o.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Storage().GetFile(variantsPath(o.UUID) + "/10x0-q85.jpg"); err != ErrFileNotFound {
+		t.Errorf("variant kept: %v", err)
+	}
+
+	large := saveTestObject(t, b, "large.png", string(pngHeader(5000, 4000)))
+	if _, err := serveImageVariant(large, tr, nil); err != ErrImageTooLarge {
+		t.Errorf("got %v, want too large", err)
+	}
+	text := saveTestObject(t, b, "a.txt", "text")
+	if _, err := serveImageVariant(text, tr, nil); err != ErrImageUnsupported {
+		t.Errorf("got %v, want unsupported", err)
+	}
+}
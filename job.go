@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+)
+
+// Jobs run long operations in the background, their progress is stored so
+// they can be queried and picked up again after a restart
+
+const (
+	JobBucketDelete = "bucket_delete"
+
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	// objects deleted between two progress updates
+	JobBatchSize = 100
+)
+
+var (
+	ErrBucketDeleting = errors.New("bucket is being deleted")
+	ErrJobNotFound    = errors.New("job does not exist")
+)
+
+type Job struct {
+	mgm.DefaultModel `bson:",inline"`
+	Type             string `json:"type"`
+	Bucket           string `json:"bucket"`
+	Status           string `json:"status"`
+	// access key that started the job
+	Owner string `json:"owner"`
+
+	// progress of bucket deletes
+	ObjectsDeleted  int `bson:"objects_deleted" json:"objects_deleted"`
+	SessionsRevoked int `bson:"sessions_revoked" json:"sessions_revoked"`
+
+	Error      string     `json:"error,omitempty"`
+	FinishedAt *time.Time `bson:"finished_at" json:"finished_at"`
+}
+
+func (j *Job) IsFinished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+func FetchJob(id string) (*Job, error) {
+	j, err := Metadata().FetchJob(id)
+	if err == ErrRecordNotFound {
+		return nil, ErrJobNotFound
+	}
+	return j, err
+}
+
+// Delete bucket with everything in it in the background, the bucket stops
+// accepting objects right away. Asking again while the delete is running
+// returns the running job.
+func DeleteBucketRecursive(b *Bucket, owner string) (*Job, error) {
+	jobs, err := Metadata().FetchUnfinishedJobs()
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		if jobs[i].Type == JobBucketDelete && jobs[i].Bucket == b.Name {
+			return &jobs[i], nil
+		}
+	}
+
+	if !b.Deleting {
+		if err := Metadata().SetBucketDeleting(b.Name); err != nil {
+			return nil, err
+		}
+		b.Deleting = true
+	}
+
+	j := &Job{
+		Type:   JobBucketDelete,
+		Bucket: b.Name,
+		Status: JobPending,
+		Owner:  owner,
+	}
+	if err := Metadata().CreateJob(j); err != nil {
+		return nil, err
+	}
+	// the job returned isn't the one running so it can be encoded safely
+	run := *j
+	go run.Run()
+	return j, nil
+}
+
+// Run job to the end recording its outcome
+func (j *Job) Run() {
+	j.Status = JobRunning
+	if err := Metadata().UpdateJob(j); err != nil {
+		log.Printf("job %s: %v\n", j.ID.Hex(), err)
+		return
+	}
+
+	var err error
+	switch j.Type {
+	case JobBucketDelete:
+		err = j.deleteBucket()
+	default:
+		err = fmt.Errorf("unknown job type %q", j.Type)
+	}
+
+	t := time.Now().UTC()
+	j.FinishedAt = &t
+	j.Status = JobDone
+	if err != nil {
+		j.Status = JobFailed
+		j.Error = err.Error()
+		log.Printf("job %s: %s of %s failed: %v\n", j.ID.Hex(), j.Type, j.Bucket, err)
+	}
+	if err := Metadata().UpdateJob(j); err != nil {
+		log.Printf("job %s: %v\n", j.ID.Hex(), err)
+	}
+}
+
+func (j *Job) deleteBucket() error {
+	b, err := FetchBucket(j.Bucket)
+	if err == ErrBucketNotFound {
+		// dropped before a restart
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// objects saved while the bucket was being marked are caught by the
+	// next round
+	for {
+		obs, err := Metadata().FetchBucketObjectsBatch(b.Name, JobBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(obs) == 0 {
+			err := DeleteBucket(b)
+			if err == ErrBucketNotEmpty {
+				continue
+			}
+			return err
+		}
+
+		for i := range obs {
+			n, err := revokeObjectSessions(obs[i].UUID)
+			j.SessionsRevoked += n
+			if err != nil {
+				return err
+			}
+			if err := DeleteObject(obs[i].UUID); err != nil && err != ErrRecordNotFound {
+				return err
+			}
+			j.ObjectsDeleted++
+		}
+		if err := Metadata().UpdateJob(j); err != nil {
+			return err
+		}
+	}
+}
+
+// Revoke every sharing session of object, returns how many were revoked
+func revokeObjectSessions(uuid string) (int, error) {
+	ss, err := FetchObjectSessions(uuid)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range ss {
+		if ss[i].IsRevoked() {
+			continue
+		}
+		if err := ss[i].Revoke(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Start jobs interrupted by a restart again, their steps can be repeated
+func ResumeJobs() (int, error) {
+	jobs, err := Metadata().FetchUnfinishedJobs()
+	if err != nil {
+		return 0, err
+	}
+	for i := range jobs {
+		go jobs[i].Run()
+	}
+	return len(jobs), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Wait for job to finish and return it as stored
+func waitJob(t *testing.T, id string) *Job {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		j, err := FetchJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.IsFinished() {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job didn't finish")
+	return nil
+}
+
+func TestDeleteBucketRecursive(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "doomed")
+	for _, k := range []string{"a.png", "b/c.png", "b/d.png"} {
+		saveTestObject(t, b, k, k)
+	}
+
+	j, err := DeleteBucketRecursive(b, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the returned job isn't touched by the running one
+	if j.Status != JobPending {
+		t.Errorf("returned job status %s, want pending", j.Status)
+	}
+	done := waitJob(t, j.ID.Hex())
+	if done.Status != JobDone || done.ObjectsDeleted != 3 {
+		t.Errorf("got %+v, want done with 3 objects deleted", done)
+	}
+	if ok, err := BucketExists(b.Name); err != nil || ok {
+		t.Errorf("bucket exists after delete: %v", err)
+	}
+	if ok, _ := Storage().Exists(b.Name); ok {
+		t.Error("bucket directory left")
+	}
+}
+
+func TestBucketDeletingKeptOnUpdate(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "doomed")
+	stale, err := FetchBucket(b.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Metadata().SetBucketDeleting(b.Name); err != nil {
+		t.Fatal(err)
+	}
+	// settings saved from a copy fetched before the delete started
+	on := true
+	if err := stale.Update(&BucketSettings{Versioning: &on}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = FetchBucket(b.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Deleting || !b.Versioning {
+		t.Errorf("got deleting %v versioning %v, want both set", b.Deleting, b.Versioning)
+	}
+	o := &Object{Type: "image/png"}
+	if _, err := SaveObject(o, &SaveConfig{BucketID: b.Name, Reader: nil, Key: "a.png"}); err != ErrBucketDeleting {
+		t.Errorf("save into deleting bucket got %v", err)
+	}
+}
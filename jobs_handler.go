@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Job status, visible to admin keys and the key that started the job
+func HandleJobFetch(w http.ResponseWriter, r *http.Request) {
+	j, err := FetchJob(mux.Vars(r)["id"])
+	if err != nil {
+		if err == ErrJobNotFound {
+			SendHttpJsonError(w, http.StatusNotFound, err)
+			return
+		}
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if k := Principal(r); k == nil || (!k.Admin && k.AccessKey != j.Owner) {
+		SendHttpJsonError(w, http.StatusNotFound, ErrJobNotFound)
+		return
+	}
+	SendJson(w, http.StatusOK, Payload{"job": j})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/kamva/mgm/v3"
+)
+
+// Operations touching both the storage and the metadata store record their
+// intent in the journal first and remove it once both sides are done, so a
+// crash in between leaves an entry behind that is recovered on startup.
+// Saves are rolled back since the client never got a response, deletes are
+// rolled forward. Recovery assumes a single server process.
+
+const (
+	JournalObjectSave   = "object_save"
+	JournalObjectDelete = "object_delete"
+	JournalBucketCreate = "bucket_create"
+	JournalBucketDelete = "bucket_delete"
+	JournalBucketRename = "bucket_rename"
+)
+
+type JournalEntry struct {
+	mgm.DefaultModel `bson:",inline"`
+	Op               string `json:"op"`
+	Bucket           string `json:"bucket"`
+	// object uuid and its storage path, delete markers have no path
+	Object string `json:"object"`
+	Path   string `json:"path"`
+	// new name of renamed bucket
+	Target string `json:"target"`
+}
+
+// Record operation intent before touching storage or metadata
+func beginJournal(e *JournalEntry) (*JournalEntry, error) {
+	if err := Metadata().CreateJournalEntry(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Mark operation done, failing here only means recovery redoes a finished
+// operation which is a no-op so it's logged instead of failing the request
+func (e *JournalEntry) Done() {
+	if err := Metadata().DeleteJournalEntry(e); err != nil {
+		log.Printf("journal: failed to remove %s entry %s: %v\n", e.Op, e.ID.Hex(), err)
+	}
+}
+
+// Recover operations left half done by a crash and clean up staging files of
+// interrupted writes, returns how many operations were recovered
+func RecoverJournal() (int, error) {
+	if _, err := Storage().CleanStaging(); err != nil {
+		return 0, err
+	}
+
+	entries, err := Metadata().FetchJournalEntries()
+	if err != nil {
+		return 0, err
+	}
+	buckets := map[string]bool{}
+	blobs := false
+	for i := range entries {
+		e := &entries[i]
+		if err := e.recover(); err != nil {
+			return i, fmt.Errorf("journal: recover %s entry %s: %w", e.Op, e.ID.Hex(), err)
+		}
+		if err := Metadata().DeleteJournalEntry(e); err != nil {
+			return i, err
+		}
+		if e.Op == JournalObjectSave || e.Op == JournalObjectDelete {
+			buckets[e.Bucket] = true
+			blobs = true
+		}
+	}
+
+	// usage could have been updated for only one side of the operation
+	for name := range buckets {
+		b, err := Metadata().FetchBucket(name)
+		if err == ErrRecordNotFound {
+			continue
+		}
+		if err == nil {
+			_, err = RecountBucketUsage(b)
+		}
+		if err != nil {
+			return len(entries), err
+		}
+	}
+	// so could blob references
+	if blobs {
+		if err := RecountBlobs(); err != nil {
+			return len(entries), err
+		}
+	}
+	return len(entries), nil
+}
+
+func (e *JournalEntry) recover() error {
+	switch e.Op {
+	case JournalObjectSave:
+		// object metadata is written last, without it the file is an orphan
+		if _, err := Metadata().FetchObject(e.Object); err != ErrRecordNotFound {
+			return err
+		}
+		return ignoreNotFound(Storage().DeleteFile(e.Path))
+
+	case JournalObjectDelete:
+		if err := Metadata().DeleteObject(e.Object); err != nil && err != ErrRecordNotFound {
+			return err
+		}
+		if err := ignoreNotFound(Storage().DeleteDir(variantsPath(e.Object), true)); err != nil {
+			return err
+		}
+		if e.Path == "" {
+			return nil
+		}
+		return ignoreNotFound(Storage().DeleteFile(e.Path))
+
+	case JournalBucketCreate:
+		if _, err := Metadata().FetchBucket(e.Bucket); err != ErrRecordNotFound {
+			return err
+		}
+		// nothing can be saved in a bucket without metadata, the directory is
+		// still removed only when empty to be safe
+		err := ignoreNotFound(Storage().DeleteDir(e.Bucket, false))
+		if err != nil {
+			log.Printf("journal: keeping directory of bucket %s: %v\n", e.Bucket, err)
+		}
+		return nil
+
+	case JournalBucketDelete:
+		b, err := Metadata().FetchBucket(e.Bucket)
+		if err != nil && err != ErrRecordNotFound {
+			return err
+		}
+		if b != nil {
+			// metadata is deleted first, objects added before it happened
+			// cancel the delete
+			obs, err := Metadata().FetchBucketObjectsBatch(b.Name, 1)
+			if err != nil {
+				return err
+			}
+			if len(obs) > 0 {
+				return nil
+			}
+			if err := Metadata().DeleteBucket(b); err != nil {
+				return err
+			}
+		}
+		err = ignoreNotFound(Storage().DeleteDir(e.Bucket, false))
+		if err == ErrDirNotEmpty {
+			log.Printf("journal: keeping directory of bucket %s: %v\n", e.Bucket, err)
+			return nil
+		}
+		return err
+
+	case JournalBucketRename:
+		// rolled forward, the directory is gone once moved and the metadata
+		// rename is finished by running it again
+		err := Storage().MoveDir(e.Bucket, e.Target)
+		if err == ErrDirExists {
+			// moved before the crash when only the target is left
+			left, serr := Storage().Exists(e.Bucket)
+			if serr != nil {
+				return serr
+			}
+			if !left {
+				err = nil
+			}
+		}
+		if err := ignoreNotFound(err); err != nil {
+			return err
+		}
+		if err := Metadata().RenameBucket(e.Bucket, e.Target); err != nil && err != ErrRecordNotFound {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown journal operation %q", e.Op)
+}
+
+func ignoreNotFound(err error) error {
+	if err == ErrFileNotFound {
+		return nil
+	}
+	return err
+}
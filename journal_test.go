@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func addTestJournalEntry(t *testing.T, e *JournalEntry) {
+	t.Helper()
+	if err := Metadata().CreateJournalEntry(e); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverObjectSave(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	saved := saveTestObject(t, b, "a.png", "a")
+
+	// crash after the file was stored but before its metadata
+	orphan := filepath.Join(b.Name, "orphan.png")
+	if _, err := Storage().CreateFile(orphan, strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	addTestJournalEntry(t, &JournalEntry{Op: JournalObjectSave, Bucket: b.Name, Object: "orphan", Path: orphan})
+	// crash after both were written
+	addTestJournalEntry(t, &JournalEntry{Op: JournalObjectSave, Bucket: b.Name, Object: saved.UUID, Path: saved.Path()})
+
+	n, err := RecoverJournal()
+	if err != nil || n != 2 {
+		t.Fatalf("recovered %d, %v", n, err)
+	}
+	if ok, _ := Storage().Exists(orphan); ok {
+		t.Error("file of unsaved object kept")
+	}
+	if ok, _ := Storage().Exists(saved.Path()); !ok {
+		t.Error("file of saved object deleted")
+	}
+	if es, _ := Metadata().FetchJournalEntries(); len(es) != 0 {
+		t.Errorf("%d entries left", len(es))
+	}
+	if u, _ := FetchBucketUsage(b); u.Objects != 1 || u.Bytes != 1 {
+		t.Errorf("got usage %+v", u)
+	}
+}
+
+func TestRecoverObjectDelete(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "a")
+
+	// crash after the file was deleted, the metadata delete is finished
+	if err := Storage().DeleteFile(o.Path()); err != nil {
+		t.Fatal(err)
+	}
+	addTestJournalEntry(t, &JournalEntry{Op: JournalObjectDelete, Bucket: b.Name, Object: o.UUID, Path: o.Path()})
+	if _, err := RecoverJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Metadata().FetchObject(o.UUID); err != ErrRecordNotFound {
+		t.Errorf("object fetched: %v", err)
+	}
+	if u, _ := FetchBucketUsage(b); u.Objects != 0 || u.Bytes != 0 {
+		t.Errorf("got usage %+v", u)
+	}
+}
+
+func TestRecoverBuckets(t *testing.T) {
+	setupStores(t)
+	// created directory without metadata
+	if err := Storage().CreateDir("created"); err != nil {
+		t.Fatal(err)
+	}
+	addTestJournalEntry(t, &JournalEntry{Op: JournalBucketCreate, Bucket: "created"})
+
+	// metadata deleted before the directory
+	if err := Storage().CreateDir("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	addTestJournalEntry(t, &JournalEntry{Op: JournalBucketDelete, Bucket: "deleted"})
+
+	// objects saved before the delete cancel it
+	kept := newTestBucket(t, "kept")
+	saveTestObject(t, kept, "a.png", "a")
+	addTestJournalEntry(t, &JournalEntry{Op: JournalBucketDelete, Bucket: "kept"})
+
+	// rename that didn't start
+	renamed := newTestBucket(t, "old")
+	o := saveTestObject(t, renamed, "a.png", "a")
+	addTestJournalEntry(t, &JournalEntry{Op: JournalBucketRename, Bucket: "old", Target: "new"})
+
+	if n, err := RecoverJournal(); err != nil || n != 4 {
+		t.Fatalf("recovered %d, %v", n, err)
+	}
+	for _, dir := range []string{"created", "deleted", "old"} {
+		if ok, _ := Storage().Exists(dir); ok {
+			t.Errorf("directory %s kept", dir)
+		}
+	}
+	if _, err := FetchBucket("kept"); err != nil {
+		t.Errorf("bucket with objects deleted: %v", err)
+	}
+	if _, err := FetchBucket("new"); err != nil {
+		t.Fatalf("renamed bucket: %v", err)
+	}
+	moved, err := FetchObject(o.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := Storage().Exists(moved.Path()); moved.BucketName != "new" || !ok {
+		t.Errorf("object in %s at %s", moved.BucketName, moved.Path())
+	}
+}
+
+func TestRecoverJournalCleansStaging(t *testing.T) {
+	setupStores(t)
+	root := t.TempDir()
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = s
+	if err := os.MkdirAll(filepath.Join(root, "photos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	staged := filepath.Join(root, "photos", stagingPrefix+"123")
+	if err := os.WriteFile(staged, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecoverJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Errorf("staging file kept: %v", err)
+	}
+}
+
+func TestRecoverBucketRenameMoved(t *testing.T) {
+	setupStores(t)
+	s, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = s
+	b := newTestBucket(t, "old")
+	o := saveTestObject(t, b, "a.png", "a")
+
+	// crash after the directory was moved but before the metadata rename
+	addTestJournalEntry(t, &JournalEntry{Op: JournalBucketRename, Bucket: "old", Target: "new"})
+	if err := Storage().MoveDir("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := RecoverJournal(); err != nil || n != 1 {
+		t.Fatalf("recovered %d, %v", n, err)
+	}
+	if _, err := FetchBucket("new"); err != nil {
+		t.Fatalf("renamed bucket: %v", err)
+	}
+	moved, err := FetchObject(o.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := Storage().Exists(moved.Path()); moved.BucketName != "new" || !ok {
+		t.Errorf("object in %s at %s", moved.BucketName, moved.Path())
+	}
+	if entries, _ := Metadata().FetchJournalEntries(); len(entries) != 0 {
+		t.Errorf("got %d journal entries left", len(entries))
+	}
+}
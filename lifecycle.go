@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LifecycleRule cleans up bucket objects on a schedule, it selects objects by
+// key prefix, content type and tags and applies its actions to them
+type LifecycleRule struct {
+	ID      string `json:"id" validate:"required,max=64"`
+	Enabled bool   `json:"enabled"`
+
+	// filter, empty fields match every object
+	Prefix string `json:"prefix" validate:"max=1024"`
+	// content type ex: video/mp4, or a group of them ex: video/*
+	Type string            `json:"type" validate:"max=256"`
+	Tags map[string]string `json:"tags" validate:"max=10"`
+
+	// actions, zero disables an action
+
+	// delete objects this many days after they were saved, versioned
+	// buckets get a delete marker instead
+	ExpireAfterDays int `bson:"expire_after_days" json:"expire_after_days" validate:"min=0,max=36500"`
+	// delete versions this many days after a newer one replaced them, it
+	// also removes delete markers left without versions, versioned buckets only
+	NoncurrentVersionsAfterDays int `bson:"noncurrent_versions_after_days" json:"delete_noncurrent_versions_after_days" validate:"min=0,max=36500"`
+	// abort multipart uploads initiated this many days ago, only the prefix
+	// filter applies to uploads
+	AbortIncompleteUploadsAfterDays int `bson:"abort_incomplete_uploads_after_days" json:"abort_incomplete_uploads_after_days" validate:"min=0,max=36500"`
+}
+
+var (
+	ErrLifecycleNoAction    = errors.New("lifecycle rule must have at least one action")
+	ErrLifecycleDuplicateID = errors.New("lifecycle rule ids must be unique")
+)
+
+func (r *LifecycleRule) hasAction() bool {
+	return r.ExpireAfterDays > 0 || r.NoncurrentVersionsAfterDays > 0 || r.AbortIncompleteUploadsAfterDays > 0
+}
+
+// Replace bucket lifecycle rules, no rules disables lifecycle
+func (b *Bucket) SetLifecycle(rules []LifecycleRule) error {
+	if err := checkLifecycle(rules); err != nil {
+		return err
+	}
+	b.Lifecycle = rules
+	return Metadata().UpdateBucket(b)
+}
+
+func checkLifecycle(rules []LifecycleRule) error {
+	ids := map[string]bool{}
+	for _, r := range rules {
+		if !r.hasAction() {
+			return fmt.Errorf("rule %s: %w", r.ID, ErrLifecycleNoAction)
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("rule %s: %w", r.ID, ErrLifecycleDuplicateID)
+		}
+		ids[r.ID] = true
+	}
+	return nil
+}
+
+// Check if object is selected by rule filter, delete markers have no type or
+// tags so only the prefix is checked for them
+func (r *LifecycleRule) Matches(o *Object) bool {
+	if !strings.HasPrefix(o.Key, r.Prefix) {
+		return false
+	}
+	if o.DeleteMarker {
+		return true
+	}
+	if r.Type != "" && !matchContentType(r.Type, o.Type) {
+		return false
+	}
+	for k, v := range r.Tags {
+		if o.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func matchContentType(pattern, t string) bool {
+	pattern = strings.ToLower(pattern)
+	t = strings.ToLower(strings.TrimSpace(strings.SplitN(t, ";", 2)[0]))
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(t, strings.TrimSuffix(pattern, "*"))
+	}
+	return t == pattern
+}
+
+func lifecycleDays(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+type LifecycleResult struct {
+	Expired        int `json:"expired"`
+	Noncurrent     int `json:"noncurrent"`
+	DeleteMarkers  int `json:"delete_markers"`
+	UploadsAborted int `json:"uploads_aborted"`
+}
+
+func (r *LifecycleResult) Total() int {
+	return r.Expired + r.Noncurrent + r.DeleteMarkers + r.UploadsAborted
+}
+
+// Apply enabled bucket lifecycle rules as of now
+func ApplyLifecycle(b *Bucket, now time.Time) (*LifecycleResult, error) {
+	res := &LifecycleResult{}
+	rules := []LifecycleRule{}
+	for _, r := range b.Lifecycle {
+		if r.Enabled {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return res, nil
+	}
+
+	obs, err := FetchBucketObjects(b)
+	if err != nil {
+		return res, err
+	}
+	keys := map[string][]Object{}
+	for _, o := range obs {
+		// objects saved before keys were kept would all be taken as versions
+		// of the same key until their keys are backfilled
+		if o.Key == "" {
+			continue
+		}
+		keys[o.Key] = append(keys[o.Key], o)
+	}
+	for _, vs := range keys {
+		sort.Slice(vs, func(i, j int) bool {
+			return vs[i].CreatedAt.After(vs[j].CreatedAt)
+		})
+		if err := applyKeyLifecycle(b, rules, vs, now, res); err != nil {
+			return res, err
+		}
+	}
+
+	for _, r := range rules {
+		if r.AbortIncompleteUploadsAfterDays == 0 {
+			continue
+		}
+		uploads, err := Metadata().FetchMultipartUploadsBefore(now.Add(-lifecycleDays(r.AbortIncompleteUploadsAfterDays)))
+		if err != nil {
+			return res, err
+		}
+		for i := range uploads {
+			u := &uploads[i]
+			if u.BucketName != b.Name || !strings.HasPrefix(u.Key, r.Prefix) {
+				continue
+			}
+			if err := u.Abort(); err == ErrUploadLocked || err == ErrUploadNotFound {
+				continue
+			} else if err != nil {
+				return res, err
+			}
+			res.UploadsAborted++
+		}
+	}
+	return res, nil
+}
+
+// Apply rules to the versions of a key ordered latest first
+func applyKeyLifecycle(b *Bucket, rules []LifecycleRule, vs []Object, now time.Time, res *LifecycleResult) error {
+	left := 1
+	if b.Versioning {
+		// a version is noncurrent since the next one was saved
+		for i := 1; i < len(vs); i++ {
+			v := &vs[i]
+			since := vs[i-1].CreatedAt
+			if !lifecycleDue(rules, v, since, now, func(r *LifecycleRule) int { return r.NoncurrentVersionsAfterDays }) {
+				left++
+				continue
+			}
+			if err := DeleteObject(v.UUID); err != nil {
+				return err
+			}
+			res.Noncurrent++
+		}
+	}
+
+	latest := &vs[0]
+	if latest.DeleteMarker {
+		// marker hides nothing once its versions are gone
+		if b.Versioning && left == 1 &&
+			lifecycleDue(rules, latest, latest.CreatedAt, now, func(r *LifecycleRule) int { return r.NoncurrentVersionsAfterDays }) {
+			if err := DeleteObject(latest.UUID); err != nil {
+				return err
+			}
+			res.DeleteMarkers++
+		}
+		return nil
+	}
+
+	if lifecycleDue(rules, latest, latest.CreatedAt, now, func(r *LifecycleRule) int { return r.ExpireAfterDays }) {
+		if _, err := DeleteObjectKey(b, latest.Key); err != nil && err != ErrRecordNotFound {
+			return err
+		}
+		res.Expired++
+	}
+	return nil
+}
+
+// Check if any rule matching o has its action due, days of the action are
+// counted from since
+func lifecycleDue(rules []LifecycleRule, o *Object, since time.Time, now time.Time, days func(r *LifecycleRule) int) bool {
+	for i := range rules {
+		r := &rules[i]
+		if d := days(r); d > 0 && r.Matches(o) && now.Sub(since) >= lifecycleDays(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply lifecycle rules of every bucket
+func RunLifecycle(now time.Time) error {
+	buckets, err := Metadata().FetchBuckets()
+	if err != nil {
+		return err
+	}
+	for i := range buckets {
+		b := &buckets[i]
+		if len(b.Lifecycle) == 0 || b.Deleting {
+			continue
+		}
+		res, err := ApplyLifecycle(b, now)
+		if err != nil {
+			log.Printf("lifecycle of bucket %s failed: %v\n", b.Name, err)
+			continue
+		}
+		if res.Total() > 0 {
+			log.Printf("lifecycle of bucket %s: %d expired, %d noncurrent versions, %d delete markers, %d uploads aborted\n",
+				b.Name, res.Expired, res.Noncurrent, res.DeleteMarkers, res.UploadsAborted)
+		}
+	}
+	return nil
+}
+
+// Periodically apply buckets lifecycle rules
+func RunLifecycleScheduler(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := RunLifecycle(time.Now()); err != nil {
+			log.Printf("lifecycle run failed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type lifecyclePayload struct {
+	Rules []LifecycleRule `json:"rules" validate:"max=100,dive"`
+}
+
+func HandleBucketLifecycleFetch(w http.ResponseWriter, r *http.Request) {
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionRead)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	rules := b.Lifecycle
+	if rules == nil {
+		rules = []LifecycleRule{}
+	}
+	SendJson(w, http.StatusOK, Payload{"rules": rules})
+}
+
+// Replace bucket lifecycle rules, an empty list removes them
+func HandleBucketLifecycle(w http.ResponseWriter, r *http.Request) {
+	var payload lifecyclePayload
+	if err := ParseAndValidate(r, &payload); err != nil {
+		SendValidationError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	defer r.Body.Close()
+
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionAdmin)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := b.SetLifecycle(payload.Rules); err != nil {
+		if errors.Is(err, ErrLifecycleNoAction) || errors.Is(err, ErrLifecycleDuplicateID) {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"message": "bucket lifecycle updated",
+		"rules":   payload.Rules,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifecycleRuleMatches(t *testing.T) {
+	o := &Object{Key: "tmp/a.mp4", Type: "video/mp4", Tags: map[string]string{"env": "tmp"}}
+	tests := []struct {
+		rule LifecycleRule
+		want bool
+	}{
+		{LifecycleRule{}, true},
+		{LifecycleRule{Prefix: "tmp/"}, true},
+		{LifecycleRule{Prefix: "photos/"}, false},
+		{LifecycleRule{Type: "video/*"}, true},
+		{LifecycleRule{Type: "VIDEO/MP4"}, true},
+		{LifecycleRule{Type: "image/*"}, false},
+		{LifecycleRule{Tags: map[string]string{"env": "tmp"}}, true},
+		{LifecycleRule{Tags: map[string]string{"env": "prod"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Matches(o); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestCheckLifecycle(t *testing.T) {
+	if err := checkLifecycle([]LifecycleRule{{ID: "a"}}); err == nil {
+		t.Error("rule without action accepted")
+	}
+	dup := []LifecycleRule{{ID: "a", ExpireAfterDays: 1}, {ID: "a", ExpireAfterDays: 2}}
+	if err := checkLifecycle(dup); err == nil {
+		t.Error("duplicate rule ids accepted")
+	}
+}
+
+func TestApplyLifecycleExpire(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "lifecycle")
+	saveTestObject(t, b, "tmp/a.png", "a")
+	saveTestObject(t, b, "keep/b.png", "b")
+	// saved before keys were kept
+	legacy := &Object{UUID: "legacy", Title: "legacy.png", Directory: ".", BucketName: b.Name}
+	if err := Metadata().CreateObject(legacy); err != nil {
+		t.Fatal(err)
+	}
+	b.Lifecycle = []LifecycleRule{
+		{ID: "tmp", Enabled: true, Prefix: "tmp/", ExpireAfterDays: 1},
+		{ID: "all", Enabled: true, ExpireAfterDays: 3},
+	}
+
+	res, err := ApplyLifecycle(b, time.Now().Add(36*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Expired != 1 {
+		t.Errorf("expired %d objects, want 1", res.Expired)
+	}
+	if _, err := FetchObjectByKey(b.Name, "tmp/a.png"); err != ErrRecordNotFound {
+		t.Errorf("expired object fetched: %v", err)
+	}
+	if _, err := FetchObjectByKey(b.Name, "keep/b.png"); err != nil {
+		t.Errorf("object not due deleted: %v", err)
+	}
+	if _, err := FetchObject(legacy.UUID); err != nil {
+		t.Errorf("legacy object deleted: %v", err)
+	}
+}
+
+func TestApplyLifecycleNoncurrent(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "lifecycle")
+	b.Versioning = true
+	if err := Metadata().UpdateBucket(b); err != nil {
+		t.Fatal(err)
+	}
+	old := saveTestObject(t, b, "a.png", "v1")
+	time.Sleep(2 * time.Millisecond)
+	latest := saveTestObject(t, b, "a.png", "v2")
+	b.Lifecycle = []LifecycleRule{{ID: "versions", Enabled: true, NoncurrentVersionsAfterDays: 1}}
+
+	res, err := ApplyLifecycle(b, time.Now().Add(36*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Noncurrent != 1 || res.Expired != 0 {
+		t.Errorf("got %+v, want 1 noncurrent version", res)
+	}
+	if _, err := FetchObject(old.UUID); err != ErrRecordNotFound {
+		t.Errorf("noncurrent version kept: %v", err)
+	}
+	if _, err := FetchObject(latest.UUID); err != nil {
+		t.Errorf("latest version deleted: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Objects listing sort fields
+const (
+	SortByName = "name"
+	SortBySize = "size"
+	SortByDate = "date"
+
+	DefaultMaxKeys = 1000
+)
+
+var (
+	ErrInvalidListToken = errors.New("continuation token is invalid")
+	ErrInvalidListSort  = errors.New("sort must be one of name, size or date")
+	ErrDelimiterSort    = errors.New("delimiter can only be used when sorting by name")
+)
+
+// ObjectsQuery selects the current objects of a bucket, the latest version
+// of every key unless it's a delete marker, ordered by Sort then key
+type ObjectsQuery struct {
+	Bucket string
+	Prefix string
+	Sort   string
+	Desc   bool
+	// only objects strictly after the cursor in the query order
+	After *ObjectsCursor
+	Limit int
+}
+
+// ObjectsCursor is the position of an object in a listing
+type ObjectsCursor struct {
+	Key       string    `json:"k"`
+	Size      int       `json:"s,omitempty"`
+	CreatedAt time.Time `json:"t,omitempty"`
+}
+
+func cursorOf(o *Object) *ObjectsCursor {
+	return &ObjectsCursor{Key: o.Key, Size: o.Size, CreatedAt: o.CreatedAt}
+}
+
+// Check if o comes after c in the order of sort
+func (c *ObjectsCursor) Before(o *Object, sort string, desc bool) bool {
+	cmp := 0
+	switch sort {
+	case SortBySize:
+		cmp = compareInt(int64(o.Size), int64(c.Size))
+	case SortByDate:
+		cmp = compareInt(o.CreatedAt.UnixNano(), c.CreatedAt.UnixNano())
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(o.Key, c.Key)
+	}
+	if desc {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type ListOptions struct {
+	Prefix    string
+	Delimiter string
+	Sort      string
+	Desc      bool
+	MaxKeys   int
+	// continuation token returned by the previous page
+	Token string
+	// start listing after this key, ignored when token is set
+	StartAfter string
+}
+
+type ObjectListing struct {
+	Objects        []Object `json:"objects"`
+	CommonPrefixes []string `json:"common_prefixes"`
+	KeyCount       int      `json:"key_count"`
+	IsTruncated    bool     `json:"is_truncated"`
+	NextToken      string   `json:"next_continuation_token,omitempty"`
+}
+
+// continuation tokens carry the sort they were made for
+type listToken struct {
+	Sort   string         `json:"o"`
+	Desc   bool           `json:"d,omitempty"`
+	Cursor *ObjectsCursor `json:"c"`
+}
+
+func encodeListToken(opts *ListOptions, c *ObjectsCursor) string {
+	b, _ := json.Marshal(&listToken{Sort: opts.Sort, Desc: opts.Desc, Cursor: c})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeListToken(opts *ListOptions) (*ObjectsCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(opts.Token)
+	if err != nil {
+		return nil, ErrInvalidListToken
+	}
+	var t listToken
+	if err := json.Unmarshal(b, &t); err != nil || t.Cursor == nil {
+		return nil, ErrInvalidListToken
+	}
+	if t.Sort != opts.Sort || t.Desc != opts.Desc {
+		return nil, ErrInvalidListToken
+	}
+	return t.Cursor, nil
+}
+
+// List bucket current objects a page at a time, with a delimiter keys sharing
+// the part of their name up to the delimiter are grouped into a common prefix
+// ex: prefix "photos/" and delimiter "/" lists photos/ like a folder
+func ListBucketObjects(b *Bucket, opts *ListOptions) (*ObjectListing, error) {
+	if opts.Sort == "" {
+		opts.Sort = SortByName
+	}
+	if opts.Sort != SortByName && opts.Sort != SortBySize && opts.Sort != SortByDate {
+		return nil, ErrInvalidListSort
+	}
+	if opts.Delimiter != "" && opts.Sort != SortByName {
+		return nil, ErrDelimiterSort
+	}
+	if opts.MaxKeys <= 0 || opts.MaxKeys > DefaultMaxKeys {
+		opts.MaxKeys = DefaultMaxKeys
+	}
+
+	var (
+		cursor *ObjectsCursor
+		err    error
+	)
+	if opts.Token != "" {
+		if cursor, err = decodeListToken(opts); err != nil {
+			return nil, err
+		}
+	} else if opts.StartAfter != "" && opts.Sort == SortByName {
+		cursor = &ObjectsCursor{Key: opts.StartAfter}
+	}
+
+	res := &ObjectListing{
+		Objects:        []Object{},
+		CommonPrefixes: []string{},
+	}
+	q := &ObjectsQuery{
+		Bucket: b.Name,
+		Prefix: opts.Prefix,
+		Sort:   opts.Sort,
+		Desc:   opts.Desc,
+	}
+
+	for res.KeyCount < opts.MaxKeys {
+		q.After = cursor
+		q.Limit = opts.MaxKeys - res.KeyCount
+		obs, err := Metadata().ListObjects(q)
+		if err != nil {
+			return nil, err
+		}
+
+		skipped := false
+		for i := range obs {
+			o := &obs[i]
+			if cp := commonPrefix(o.Key, opts.Prefix, opts.Delimiter); cp != "" {
+				res.CommonPrefixes = append(res.CommonPrefixes, cp)
+				res.KeyCount++
+
+				// continue past every key under the prefix, keys under it
+				// sort right after the prefix itself
+				cursor = &ObjectsCursor{Key: afterPrefix(cp)}
+				if opts.Desc {
+					cursor.Key = cp
+				}
+				skipped = true
+				break
+			}
+			res.Objects = append(res.Objects, *o)
+			res.KeyCount++
+			cursor = cursorOf(o)
+		}
+		if !skipped && len(obs) < q.Limit {
+			return res, nil
+		}
+	}
+
+	// more objects after the page
+	q.After = cursor
+	q.Limit = 1
+	more, err := Metadata().ListObjects(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(more) > 0 {
+		res.IsTruncated = true
+		res.NextToken = encodeListToken(opts, cursor)
+	}
+	return res, nil
+}
+
+// part of key after prefix up to and including the delimiter
+func commonPrefix(key, prefix, delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+		return key[:len(prefix)+i+len(delimiter)]
+	}
+	return ""
+}
+
+// smallest key sorting after all keys starting with p
+func afterPrefix(p string) string {
+	return p + string(utf8.MaxRune)
+}
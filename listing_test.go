@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// keys and prefixes of a listing page
+func listed(l *ObjectListing) []string {
+	keys := []string{}
+	for _, o := range l.Objects {
+		keys = append(keys, o.Key)
+	}
+	for _, p := range l.CommonPrefixes {
+		keys = append(keys, "prefix:"+p)
+	}
+	return keys
+}
+
+func TestListBucketObjectsDelimiter(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "listing")
+	for _, k := range []string{"a/1.txt", "a/2.txt", "a/3.txt", "b.txt", "c/1.txt"} {
+		saveTestObject(t, b, k, k)
+	}
+
+	tests := []struct {
+		name    string
+		opts    ListOptions
+		objects []string
+		prefix  []string
+	}{
+		{"asc", ListOptions{Delimiter: "/"}, []string{"b.txt"}, []string{"a/", "c/"}},
+		{"desc", ListOptions{Delimiter: "/", Desc: true}, []string{"b.txt"}, []string{"c/", "a/"}},
+		{"prefix", ListOptions{Prefix: "a/", Delimiter: "/", Desc: true}, []string{"a/3.txt", "a/2.txt", "a/1.txt"}, []string{}},
+		{"no delimiter desc", ListOptions{Desc: true}, []string{"c/1.txt", "b.txt", "a/3.txt", "a/2.txt", "a/1.txt"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.MaxKeys = 10
+			l, err := ListBucketObjects(b, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []string{}
+			for _, o := range l.Objects {
+				keys = append(keys, o.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.objects) || !reflect.DeepEqual(l.CommonPrefixes, tt.prefix) {
+				t.Errorf("got objects %v prefixes %v, want %v %v", keys, l.CommonPrefixes, tt.objects, tt.prefix)
+			}
+			if l.IsTruncated {
+				t.Error("listing is truncated")
+			}
+		})
+	}
+}
+
+func TestListBucketObjectsPages(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "listing")
+	for _, k := range []string{"a/1.txt", "a/2.txt", "a/3.txt", "b.txt", "c/1.txt"} {
+		saveTestObject(t, b, k, k)
+	}
+
+	for _, desc := range []bool{false, true} {
+		want := []string{"prefix:a/", "b.txt", "prefix:c/"}
+		if desc {
+			want = []string{"prefix:c/", "b.txt", "prefix:a/"}
+		}
+		got := []string{}
+		opts := &ListOptions{Delimiter: "/", Desc: desc, MaxKeys: 1}
+		for i := 0; i < 5; i++ {
+			l, err := ListBucketObjects(b, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, listed(l)...)
+			if !l.IsTruncated {
+				break
+			}
+			opts.Token = l.NextToken
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("desc %v: got %v, want %v", desc, got, want)
+		}
+	}
+}
+
+func TestListBucketObjectsToken(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "listing")
+	saveTestObject(t, b, "a.txt", "a")
+	saveTestObject(t, b, "b.txt", "b")
+
+	l, err := ListBucketObjects(b, &ListOptions{MaxKeys: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.IsTruncated {
+		t.Fatal("first page isn't truncated")
+	}
+	// tokens only continue the listing they were made for
+	_, err = ListBucketObjects(b, &ListOptions{MaxKeys: 1, Desc: true, Token: l.NextToken})
+	if err != ErrInvalidListToken {
+		t.Errorf("got %v, want ErrInvalidListToken", err)
+	}
+	if _, err := ListBucketObjects(b, &ListOptions{Sort: "owner"}); err != ErrInvalidListSort {
+		t.Errorf("got %v, want ErrInvalidListSort", err)
+	}
+}
+
+func TestBackfillObjectKeys(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "legacy")
+	// objects saved before keys were kept
+	for _, o := range []*Object{
+		{UUID: "1", Title: "1.png", Directory: ".", BucketName: b.Name},
+		{UUID: "2", Title: "2.png", Directory: "legacy/photos", BucketName: b.Name},
+	} {
+		if err := Metadata().CreateObject(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := BackfillObjectKeys()
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	l, err := ListBucketObjects(b, &ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listed(l), []string{"1.png", "photos/2.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if n, err := BackfillObjectKeys(); err != nil || n != 0 {
+		t.Errorf("second run got %d, %v", n, err)
+	}
+}
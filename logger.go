@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"log"
 	"net/http"
 	"time"
@@ -12,7 +11,6 @@ import (
 type LogResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
-	buf        bytes.Buffer
 }
 
 func NewLogResponseWriter(w http.ResponseWriter) *LogResponseWriter {
@@ -24,9 +22,9 @@ func (w *LogResponseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func (w *LogResponseWriter) Write(body []byte) (int, error) {
-	w.buf.Write(body)
-	return w.ResponseWriter.Write(body)
+// response controllers reach the connection through it
+func (w *LogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 type LogMiddleware struct {
@@ -16,10 +16,46 @@ func main() {
 		panic(err)
 	}
 
+	if err := OpenStorage(); err != nil {
+		panic(err)
+	}
+
 	if err := OpenDBConnection(); err != nil {
 		panic(err)
 	}
 
+	// admin commands run next to the server so they skip startup recovery
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(RunFsckCommand(os.Args[2:]))
+		case "rotate-keys":
+			os.Exit(RunRotateKeysCommand(os.Args[2:]))
+		}
+	}
+
+	n, err := RecoverJournal()
+	if err != nil {
+		panic(err)
+	}
+	if n > 0 {
+		log.Printf("recovered %d interrupted operations\n", n)
+	}
+	if n, err := BackfillObjectKeys(); err != nil {
+		panic(err)
+	} else if n > 0 {
+		log.Printf("backfilled keys of %d objects\n", n)
+	}
+	if n, err := ResumeJobs(); err != nil {
+		panic(err)
+	} else if n > 0 {
+		log.Printf("resumed %d background jobs\n", n)
+	}
+
+	go RunMultipartJanitor(time.Hour)
+	go RunUploadJanitor(time.Hour)
+	go RunLifecycleScheduler(time.Hour)
+
 	r := mux.NewRouter()
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 
@@ -35,21 +71,70 @@ func main() {
 		SendJson(w, http.StatusOK, Payload{"message": "pong"})
 	}).Methods("GET")
 
-	// Buckets
-	r.HandleFunc("/bucket", HandleBucketCreation).Methods(http.MethodPost)
-	r.HandleFunc("/bucket/{name}", HandleBucketDeletion).Methods(http.MethodDelete)
-	r.HandleFunc("/bucket/{name}/objects", HandleObjectsFetch).Methods(http.MethodGet)
+	r.HandleFunc("/upload", Transfer(HandleFileUpload)).Methods(http.MethodPost)
 
-	// Objects
-	r.HandleFunc("/object", HandleObjectCreation).Methods(http.MethodPost)
-	r.HandleFunc("/object/{uuid}/external", HandleGeneratingSharableLink).Methods(http.MethodPost)
-	r.HandleFunc("/object/{uuid}", HandleObjectDeletion).Methods(http.MethodDelete)
-	r.HandleFunc("/object/{uuid}", HandleObjectFetch).Methods(http.MethodGet)
+	// Object share
+	r.HandleFunc("/share/{bucket}/{uuid}", Transfer(HandleServingRequestedObject)).Methods(http.MethodGet, http.MethodHead)
 
-	r.HandleFunc("/upload", HandleFileUpload).Methods(http.MethodPost)
+	// Resumable uploads discovery, it's public as tus clients probe it first
+	r.HandleFunc("/uploads", HandleUploadOptions).Methods(http.MethodOptions)
 
-	// Object share
-	r.HandleFunc("/share/{bucket}/{uuid}", HandleServingRequestedObject).Methods(http.MethodGet)
+	// Authenticated routes
+	api := r.NewRoute().Subrouter()
+	api.Use(AuthMiddleware)
+
+	// Api keys
+	api.HandleFunc("/keys", HandleApiKeyCreation).Methods(http.MethodPost)
+	api.HandleFunc("/keys", HandleApiKeysFetch).Methods(http.MethodGet)
+	api.HandleFunc("/keys/{access_key}", HandleApiKeyDeletion).Methods(http.MethodDelete)
+
+	// Buckets
+	api.HandleFunc("/bucket", HandleBucketCreation).Methods(http.MethodPost)
+	api.HandleFunc("/buckets", HandleBucketsFetch).Methods(http.MethodGet)
+	api.HandleFunc("/bucket/{name}", HandleBucketFetch).Methods(http.MethodGet)
+	api.HandleFunc("/bucket/{name}", HandleBucketUpdate).Methods(http.MethodPatch)
+	api.HandleFunc("/bucket/{name}", HandleBucketDeletion).Methods(http.MethodDelete)
+	api.HandleFunc("/bucket/{name}/rename", HandleBucketRename).Methods(http.MethodPost)
+	api.HandleFunc("/bucket/{name}/objects", HandleObjectsFetch).Methods(http.MethodGet)
+	api.HandleFunc("/bucket/{name}/grants", HandleBucketGrant).Methods(http.MethodPut)
+	api.HandleFunc("/bucket/{name}/grants/{access_key}", HandleBucketRevoke).Methods(http.MethodDelete)
+	api.HandleFunc("/bucket/{name}/objects", HandleObjectKeyDeletion).Methods(http.MethodDelete)
+
+	// Object versions
+	api.HandleFunc("/bucket/{name}/versioning", HandleBucketVersioning).Methods(http.MethodPut)
+	api.HandleFunc("/bucket/{name}/versions", HandleObjectVersionsFetch).Methods(http.MethodGet)
+	api.HandleFunc("/bucket/{name}/versions/{version}", HandleObjectVersionFetch).Methods(http.MethodGet)
+	api.HandleFunc("/bucket/{name}/versions/{version}", HandleObjectVersionDeletion).Methods(http.MethodDelete)
+	api.HandleFunc("/bucket/{name}/versions/{version}/restore", HandleObjectVersionRestore).Methods(http.MethodPost)
+
+	// Bucket lifecycle
+	api.HandleFunc("/bucket/{name}/lifecycle", HandleBucketLifecycleFetch).Methods(http.MethodGet)
+	api.HandleFunc("/bucket/{name}/lifecycle", HandleBucketLifecycle).Methods(http.MethodPut)
+
+	// Bucket quota
+	api.HandleFunc("/bucket/{name}/quota", HandleBucketQuotaFetch).Methods(http.MethodGet)
+	api.HandleFunc("/bucket/{name}/quota", HandleBucketQuota).Methods(http.MethodPut)
+
+	// Objects
+	api.HandleFunc("/object", Transfer(HandleObjectCreation)).Methods(http.MethodPost)
+	api.HandleFunc("/object/{uuid}/external", HandleGeneratingSharableLink).Methods(http.MethodPost)
+	api.HandleFunc("/object/{uuid}/external", HandleObjectSessionsFetch).Methods(http.MethodGet)
+	api.HandleFunc("/object/{uuid}/external/{session}", HandleObjectSessionFetch).Methods(http.MethodGet)
+	api.HandleFunc("/object/{uuid}/external/{session}", HandleObjectSessionRevoke).Methods(http.MethodDelete)
+	api.HandleFunc("/object/{uuid}", HandleObjectDeletion).Methods(http.MethodDelete)
+	api.HandleFunc("/object/{uuid}", HandleObjectFetch).Methods(http.MethodGet)
+
+	// Admin
+	api.HandleFunc("/admin/fsck", HandleFsck).Methods(http.MethodPost)
+
+	// Background jobs
+	api.HandleFunc("/jobs/{id}", HandleJobFetch).Methods(http.MethodGet)
+
+	// Resumable uploads
+	api.HandleFunc("/uploads", HandleUploadCreation).Methods(http.MethodPost)
+	api.HandleFunc("/uploads/{id}", HandleUploadStatus).Methods(http.MethodHead)
+	api.HandleFunc("/uploads/{id}", Transfer(HandleUploadChunk)).Methods(http.MethodPatch)
+	api.HandleFunc("/uploads/{id}", HandleUploadTermination).Methods(http.MethodDelete)
 
 	// middlewares
 	r.Use(func(n http.Handler) http.Handler {
@@ -60,18 +145,25 @@ func main() {
 	})
 	r.Use(NewLogMiddleware(logger).Func())
 
-	router := func() http.Handler {
-		rps := 1.0
-		l := tollbooth.NewLimiter(rps, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour})
-		return tollbooth.LimitHandler(l, r)
-	}()
+	// S3 compatible api, it's kept apart from the json api middlewares and
+	// limit since S3 clients upload parts in parallel and retry throttled
+	// requests. S3_RATE_LIMIT sets its requests per second per client.
+	s3 := mux.NewRouter()
+	MountS3(s3)
+	s3.Use(NewLogMiddleware(logger).Func())
+
+	router := mux.NewRouter()
+	router.PathPrefix(S3PathPrefix + "/").Handler(rateLimit(s3, S3RateLimit()))
+	router.PathPrefix("/").Handler(rateLimit(r, 1))
 
 	addr := GetAddr()
+	// uploads and downloads routes lift the read and write timeouts, see
+	// Transfer
 	srv := &http.Server{
 		Addr:         addr,
 		Handler:      router,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		ReadTimeout:  ServerTimeout,
+		WriteTimeout: ServerTimeout,
 		IdleTimeout:  60 * time.Second,
 	}
 	SetTLSConfigs(srv.TLSConfig)
@@ -80,3 +172,12 @@ func main() {
 
 	log.Fatal(srv.ListenAndServe())
 }
+
+// Limit requests per second of each client address, rps <= 0 doesn't limit
+func rateLimit(h http.Handler, rps float64) http.Handler {
+	if rps <= 0 {
+		return h
+	}
+	l := tollbooth.NewLimiter(rps, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour})
+	return tollbooth.LimitHandler(l, h)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps objects in process memory, everything is lost on restart
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+	dirs  map[string]bool
+	// files last write time
+	times map[string]time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files: map[string][]byte{},
+		dirs:  map[string]bool{},
+		times: map[string]time.Time{},
+	}
+}
+
+type memoryFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
+
+func (f *memoryFile) Name() string {
+	return f.name
+}
+
+// p relative to the storage root, paths leading out of it or to it are
+// rejected like on disk
+func cleanPath(p string) (string, error) {
+	c := filepath.Clean(strings.TrimPrefix(p, "/"))
+	if c == "." || c == ".." || strings.HasPrefix(c, "../") {
+		return "", ErrInvalidPath
+	}
+	return c, nil
+}
+
+func (s *MemoryStorage) CreateFile(p string, r io.Reader) (int64, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	p, err = cleanPath(p)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mkdirAll(filepath.Dir(p))
+	s.files[p] = b
+	s.times[p] = time.Now()
+	return int64(len(b)), nil
+}
+
+func (s *MemoryStorage) AppendFile(p string, r io.Reader) (int64, error) {
+	p, perr := cleanPath(p)
+	if perr != nil {
+		return 0, perr
+	}
+	b, err := ioutil.ReadAll(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mkdirAll(filepath.Dir(p))
+	s.files[p] = append(s.files[p], b...)
+	s.times[p] = time.Now()
+	return int64(len(b)), err
+}
+
+func (s *MemoryStorage) GetFile(p string) (StoredFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := s.files[p]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	return &memoryFile{Reader: bytes.NewReader(b), name: p}, nil
+}
+
+//Delete file giving the path as p
+func (s *MemoryStorage) DeleteFile(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.files[p]; !ok {
+		return ErrFileNotFound
+	}
+	delete(s.files, p)
+	delete(s.times, p)
+	return nil
+}
+
+func (s *MemoryStorage) MoveFile(src, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, err := cleanPath(src)
+	if err != nil {
+		return err
+	}
+	dst, err = cleanPath(dst)
+	if err != nil {
+		return err
+	}
+	b, ok := s.files[src]
+	if !ok {
+		return ErrFileNotFound
+	}
+	s.mkdirAll(filepath.Dir(dst))
+	s.files[dst] = b
+	s.times[dst] = s.times[src]
+	delete(s.files, src)
+	delete(s.times, src)
+	return nil
+}
+
+// files are walked in path order like filepath.Walk does
+func (s *MemoryStorage) WalkFiles(fn func(p string, size int64) error) error {
+	s.mu.RLock()
+	paths := make([]string, 0, len(s.files))
+	sizes := make(map[string]int64, len(s.files))
+	for p, b := range s.files {
+		paths = append(paths, p)
+		sizes[p] = int64(len(b))
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := fn(p, sizes[p]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) CreateDir(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	s.mkdirAll(dir)
+	return nil
+}
+
+func (s *MemoryStorage) mkdirAll(dir string) {
+	for dir != "." && dir != "" {
+		s.dirs[dir] = true
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (s *MemoryStorage) MoveDir(src, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, err := cleanPath(src)
+	if err != nil {
+		return err
+	}
+	dst, err = cleanPath(dst)
+	if err != nil {
+		return err
+	}
+	if !s.dirs[src] {
+		return ErrFileNotFound
+	}
+	if _, ok := s.files[dst]; ok || s.dirs[dst] {
+		return ErrDirExists
+	}
+
+	prefix := src + "/"
+	for p, b := range s.files {
+		if strings.HasPrefix(p, prefix) {
+			s.files[dst+p[len(src):]] = b
+			s.times[dst+p[len(src):]] = s.times[p]
+			delete(s.files, p)
+			delete(s.times, p)
+		}
+	}
+	for d := range s.dirs {
+		if strings.HasPrefix(d, prefix) {
+			s.dirs[dst+d[len(src):]] = true
+			delete(s.dirs, d)
+		}
+	}
+	delete(s.dirs, src)
+	s.mkdirAll(dst)
+	return nil
+}
+
+func (s *MemoryStorage) DeleteDir(dir string, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	prefix := dir + "/"
+	if !force {
+		if !s.dirs[dir] {
+			return ErrFileNotFound
+		}
+		for p := range s.files {
+			if strings.HasPrefix(p, prefix) {
+				return ErrDirNotEmpty
+			}
+		}
+	}
+
+	for p := range s.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(s.files, p)
+			delete(s.times, p)
+		}
+	}
+	for d := range s.dirs {
+		if strings.HasPrefix(d, prefix) {
+			delete(s.dirs, d)
+		}
+	}
+	delete(s.dirs, dir)
+	return nil
+}
+
+func (s *MemoryStorage) ModTime(p string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, err := cleanPath(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, ok := s.times[p]
+	if !ok {
+		return time.Time{}, ErrFileNotFound
+	}
+	return t, nil
+}
+
+func (s *MemoryStorage) Exists(p string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, err := cleanPath(p)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := s.files[p]; ok {
+		return true, nil
+	}
+	return s.dirs[p], nil
+}
+
+// nothing is staged in memory, files are stored once fully read
+func (s *MemoryStorage) CleanStaging() (int, error) {
+	return 0, nil
+}
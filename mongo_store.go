@@ -0,0 +1,779 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore keeps metadata in MongoDB collections through mgm
+type MongoStore struct{}
+
+func NewMongoStore(uri string, db string) (*MongoStore, error) {
+	err := mgm.SetDefaultConfig(
+		nil,
+		db,
+		options.Client().ApplyURI(uri),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	processIndexes()
+
+	return &MongoStore{}, nil
+}
+
+func processIndexes() error {
+	if err := (&Object{}).CreateIndex(); err != nil {
+		return err
+	}
+	if err := (&ObjectSharingSession{}).CreateIndex(); err != nil {
+		return err
+	}
+	if err := (&ApiKey{}).CreateIndex(); err != nil {
+		return err
+	}
+	if err := (&UploadPart{}).CreateIndex(); err != nil {
+		return err
+	}
+	if err := (&BucketUsage{}).CreateIndex(); err != nil {
+		return err
+	}
+	if err := (&Blob{}).CreateIndex(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func mongoErr(err error) error {
+	// malformed ids can't match any record
+	if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) CreateBucket(b *Bucket) error {
+	return mgm.Coll(b).Create(b)
+}
+
+func (s *MongoStore) FetchBucket(name string) (*Bucket, error) {
+	var b Bucket
+	if err := mgm.Coll(&Bucket{}).First(bson.M{"name": name}, &b); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &b, nil
+}
+
+func (s *MongoStore) FetchBuckets() ([]Bucket, error) {
+	buckets := []Bucket{}
+	if err := mgm.Coll(&Bucket{}).SimpleFind(&buckets, bson.M{}); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// every field but the deleting flag is set, a stale copy of the bucket
+// can't clear it
+func (s *MongoStore) UpdateBucket(b *Bucket) error {
+	b.Saving()
+	raw, err := bson.Marshal(b)
+	if err != nil {
+		return err
+	}
+	var fields bson.M
+	if err := bson.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+	delete(fields, "_id")
+	delete(fields, "deleting")
+	delete(fields, "grants")
+	_, err = mgm.Coll(b).UpdateByID(context.Background(), b.ID, bson.M{"$set": fields})
+	return err
+}
+
+// grants are replaced in a single pipeline update so concurrent changes of
+// other keys aren't lost, buckets created without grants have them null
+func (s *MongoStore) PutBucketGrant(name string, g BucketGrant) ([]BucketGrant, error) {
+	return s.updateBucketGrants(name, bson.M{"$concatArrays": bson.A{
+		mongoGrantsWithout(g.AccessKey),
+		bson.A{bson.M{"access_key": g.AccessKey, "permission": g.Permission}},
+	}})
+}
+
+func (s *MongoStore) DeleteBucketGrant(name string, accessKey string) ([]BucketGrant, error) {
+	return s.updateBucketGrants(name, mongoGrantsWithout(accessKey))
+}
+
+func mongoGrantsWithout(accessKey string) bson.M {
+	return bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$grants", bson.A{}}},
+		"cond":  bson.M{"$ne": bson.A{"$$this.access_key", accessKey}},
+	}}
+}
+
+func (s *MongoStore) updateBucketGrants(name string, grants bson.M) ([]BucketGrant, error) {
+	var b Bucket
+	err := mgm.Coll(&b).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"name": name},
+		bson.A{bson.M{"$set": bson.M{"grants": grants, "updated_at": time.Now().UTC()}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&b)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return b.Grants, nil
+}
+
+func (s *MongoStore) SetBucketDeleting(name string) error {
+	res, err := mgm.Coll(&Bucket{}).UpdateOne(context.Background(),
+		bson.M{"name": name},
+		bson.M{"$set": bson.M{"deleting": true, "updated_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) SetBucketDataKey(name string, masterKeyID string, dataKey string) error {
+	res, err := mgm.Coll(&Bucket{}).UpdateOne(context.Background(),
+		bson.M{"name": name},
+		bson.M{"$set": bson.M{
+			"encryption.master_key_id": masterKeyID,
+			"encryption.data_key":      dataKey,
+			"updated_at":               time.Now().UTC(),
+		}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) DeleteBucket(b *Bucket) error {
+	_, err := mgm.Coll(b).DeleteOne(context.Background(), bson.M{"name": b.Name})
+	return err
+}
+
+func (s *MongoStore) ListBuckets(prefix string, after string, limit int) ([]Bucket, error) {
+	name := bson.M{"$gt": after}
+	if prefix != "" {
+		name["$regex"] = "^" + regexp.QuoteMeta(prefix)
+	}
+	filter := bson.M{"name": name}
+	buckets := []Bucket{}
+	err := mgm.Coll(&Bucket{}).SimpleFind(&buckets, filter,
+		options.Find().SetSort(bson.M{"name": 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// records referencing the bucket are updated first and the bucket last, so a
+// failed rename still finds the bucket under its old name when run again
+func (s *MongoStore) RenameBucket(name string, newName string) error {
+	ctx := context.Background()
+	if n, err := mgm.Coll(&Bucket{}).CountDocuments(ctx, bson.M{"name": newName}); err != nil {
+		return err
+	} else if n > 0 {
+		return ErrBucketExists
+	}
+
+	// directories start with the bucket name
+	_, err := mgm.Coll(&Object{}).UpdateMany(ctx,
+		bson.M{"bucketname": name, "directory": bson.M{"$regex": "^" + regexp.QuoteMeta(name+"/")}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"directory": bson.M{"$concat": bson.A{newName, bson.M{"$substrBytes": bson.A{"$directory", len(name), -1}}}},
+		}}}},
+	)
+	if err != nil {
+		return err
+	}
+	renames := []struct {
+		model mgm.Model
+		field string
+	}{
+		{&Object{}, "bucketname"},
+		{&Upload{}, "bucket_name"},
+		{&MultipartUpload{}, "bucket_name"},
+		{&BucketUsage{}, "bucket"},
+	}
+	for _, r := range renames {
+		_, err := mgm.Coll(r.model).UpdateMany(ctx, bson.M{r.field: name}, bson.M{"$set": bson.M{r.field: newName}})
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := mgm.Coll(&Bucket{}).UpdateOne(ctx, bson.M{"name": name},
+		bson.M{"$set": bson.M{"name": newName, "updated_at": time.Now().UTC()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) FetchBucketUsage(bucket string) (*BucketUsage, error) {
+	var u BucketUsage
+	if err := mgm.Coll(&u).First(bson.M{"bucket": bucket}, &u); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &u, nil
+}
+
+func (s *MongoStore) PutBucketUsage(u *BucketUsage) error {
+	now := time.Now().UTC()
+	_, err := mgm.Coll(u).UpdateOne(
+		context.Background(),
+		bson.M{"bucket": u.Bucket},
+		bson.M{
+			"$set":         bson.M{"bytes": u.Bytes, "stored_bytes": u.StoredBytes, "objects": u.Objects, "updated_at": now},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *MongoStore) AddBucketUsage(bucket string, bytes int64, stored int64, objects int, q *BucketQuota) error {
+	filter := bson.M{"bucket": bucket}
+	if q != nil && q.MaxBytes > 0 {
+		filter["bytes"] = bson.M{"$lte": q.MaxBytes - bytes}
+	}
+	if q != nil && q.MaxObjects > 0 {
+		filter["objects"] = bson.M{"$lte": q.MaxObjects - objects}
+	}
+	res, err := mgm.Coll(&BucketUsage{}).UpdateOne(
+		context.Background(),
+		filter,
+		bson.M{
+			"$inc": bson.M{"bytes": bytes, "stored_bytes": stored, "objects": objects},
+			"$set": bson.M{"updated_at": time.Now().UTC()},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) DeleteBucketUsage(bucket string) error {
+	_, err := mgm.Coll(&BucketUsage{}).DeleteOne(context.Background(), bson.M{"bucket": bucket})
+	return err
+}
+
+func (s *MongoStore) CreateObject(o *Object) error {
+	return mgm.Coll(o).Create(o)
+}
+
+func (s *MongoStore) FetchObject(uuid string) (*Object, error) {
+	o := &Object{}
+	if err := mgm.Coll(o).FindOne(context.Background(), bson.M{"uuid": uuid}).Decode(o); err != nil {
+		return nil, mongoErr(err)
+	}
+	return o, nil
+}
+
+func (s *MongoStore) FetchObjectByKey(bucket string, key string) (*Object, error) {
+	o := &Object{}
+	if err := mgm.Coll(o).FindOne(
+		context.Background(),
+		bson.M{"bucketname": bucket, "key": key},
+		options.FindOne().SetSort(bson.M{"created_at": -1}),
+	).Decode(o); err != nil {
+		return nil, mongoErr(err)
+	}
+	return o, nil
+}
+
+func (s *MongoStore) FetchObjectVersions(bucket string, key string) ([]Object, error) {
+	objects := []Object{}
+	err := mgm.Coll(&Object{}).SimpleFind(
+		&objects,
+		bson.M{"bucketname": bucket, "key": key},
+		options.Find().SetSort(bson.M{"created_at": -1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *MongoStore) UpdateObject(o *Object) error {
+	return mgm.Coll(o).Update(o)
+}
+
+func (s *MongoStore) EachObject(fn func(o *Object) error) error {
+	ctx := context.Background()
+	cur, err := mgm.Coll(&Object{}).Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var o Object
+		if err := cur.Decode(&o); err != nil {
+			return err
+		}
+		if err := fn(&o); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (s *MongoStore) DeleteObject(uuid string) error {
+	_, err := mgm.Coll(&Object{}).DeleteOne(
+		context.Background(),
+		bson.M{"uuid": uuid},
+	)
+	return err
+}
+
+func (s *MongoStore) FetchBucketObjects(bucket string) ([]Object, error) {
+	var objects []Object
+	cur, err := mgm.Coll(&Object{}).Find(
+		context.Background(),
+		bson.M{"bucketname": bucket},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(context.Background(), &objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// sort field of listings, ties are broken by key
+var mongoSortFields = map[string]string{
+	SortByName: "key",
+	SortBySize: "size",
+	SortByDate: "created_at",
+}
+
+func (s *MongoStore) FetchBucketObjectsBatch(bucket string, limit int) ([]Object, error) {
+	objects := []Object{}
+	err := mgm.Coll(&Object{}).SimpleFind(&objects, bson.M{"bucketname": bucket},
+		options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *MongoStore) ListObjects(q *ObjectsQuery) ([]Object, error) {
+	field := mongoSortFields[q.Sort]
+	dir, cmp := 1, "$gt"
+	if q.Desc {
+		dir, cmp = -1, "$lt"
+	}
+
+	match := bson.M{"bucketname": q.Bucket}
+	if q.Prefix != "" {
+		match["key"] = bson.M{"$regex": "^" + regexp.QuoteMeta(q.Prefix)}
+	}
+
+	// keep the latest version of every key
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.D{{Key: "key", Value: 1}, {Key: "created_at", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$key", "doc": bson.M{"$first": "$$ROOT"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$doc"}}},
+		{{Key: "$match", Value: bson.M{"delete_marker": bson.M{"$ne": true}}}},
+	}
+	if c := q.After; c != nil {
+		var after bson.M
+		switch q.Sort {
+		case SortBySize, SortByDate:
+			v := any(c.Size)
+			if q.Sort == SortByDate {
+				v = c.CreatedAt
+			}
+			after = bson.M{"$or": bson.A{
+				bson.M{field: bson.M{cmp: v}},
+				bson.M{field: v, "key": bson.M{cmp: c.Key}},
+			}}
+		default:
+			after = bson.M{"key": bson.M{cmp: c.Key}}
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: after}})
+	}
+	sort := bson.D{{Key: field, Value: dir}}
+	if field != "key" {
+		sort = append(sort, bson.E{Key: "key", Value: dir})
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: sort}},
+		bson.D{{Key: "$limit", Value: q.Limit}},
+	)
+
+	cur, err := mgm.Coll(&Object{}).Aggregate(
+		context.Background(),
+		pipeline,
+		options.Aggregate().SetAllowDiskUse(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	objects := []Object{}
+	if err := cur.All(context.Background(), &objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *MongoStore) CreateSession(ss *ObjectSharingSession) error {
+	return mgm.Coll(ss).Create(ss)
+}
+
+func (s *MongoStore) FetchSession(id string) (*ObjectSharingSession, error) {
+	var ss ObjectSharingSession
+	if err := mgm.Coll(&ss).FindByID(id, &ss); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &ss, nil
+}
+
+func (s *MongoStore) FetchLatestSession(ouuid string) (*ObjectSharingSession, error) {
+	var ss []ObjectSharingSession
+	crs, err := mgm.Coll(&ObjectSharingSession{}).Find(
+		context.Background(),
+		bson.M{"ouuid": ouuid},
+		options.Find().SetSort(bson.M{
+			"expiry_date": -1,
+		}).SetLimit(1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := crs.All(context.Background(), &ss); err != nil {
+		return nil, err
+	}
+	if len(ss) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return &ss[0], nil
+}
+
+func (s *MongoStore) FetchObjectSessions(ouuid string) ([]ObjectSharingSession, error) {
+	ss := []ObjectSharingSession{}
+	err := mgm.Coll(&ObjectSharingSession{}).SimpleFind(
+		&ss,
+		bson.M{"ouuid": ouuid},
+		options.Find().SetSort(bson.M{"created_at": -1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (s *MongoStore) RevokeSession(id string, at time.Time) (*ObjectSharingSession, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+
+	var ss ObjectSharingSession
+	err = mgm.Coll(&ss).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": oid},
+		bson.A{bson.M{"$set": bson.M{
+			"revoked_at": bson.M{"$ifNull": bson.A{"$revoked_at", at}},
+			"updated_at": time.Now().UTC(),
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ss)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return &ss, nil
+}
+
+func (s *MongoStore) IncrementSessionDownloads(id string) (*ObjectSharingSession, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+
+	var ss ObjectSharingSession
+	filter := bson.M{
+		"_id": oid,
+		"$or": bson.A{
+			bson.M{"max_downloads": bson.M{"$in": bson.A{0, nil}}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$downloads", "$max_downloads"}}},
+		},
+	}
+	err = mgm.Coll(&ss).FindOneAndUpdate(
+		context.Background(),
+		filter,
+		bson.M{"$inc": bson.M{"downloads": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ss)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return &ss, nil
+}
+
+func (s *MongoStore) CreateUpload(u *Upload) error {
+	return mgm.Coll(u).Create(u)
+}
+
+func (s *MongoStore) FetchUpload(id string) (*Upload, error) {
+	var u Upload
+	if err := mgm.Coll(&u).FindByID(id, &u); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &u, nil
+}
+
+func (s *MongoStore) UpdateUpload(u *Upload) error {
+	return mgm.Coll(u).Update(u)
+}
+
+func (s *MongoStore) DeleteUpload(u *Upload) error {
+	return mgm.Coll(u).Delete(u)
+}
+
+func (s *MongoStore) FetchUploadsExpiredBefore(t time.Time) ([]Upload, error) {
+	uploads := []Upload{}
+	err := mgm.Coll(&Upload{}).SimpleFind(&uploads, bson.M{
+		"expires_at": bson.M{"$lt": t},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (s *MongoStore) CreateMultipartUpload(u *MultipartUpload) error {
+	return mgm.Coll(u).Create(u)
+}
+
+func (s *MongoStore) FetchMultipartUpload(id string) (*MultipartUpload, error) {
+	var u MultipartUpload
+	if err := mgm.Coll(&u).FindByID(id, &u); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &u, nil
+}
+
+func (s *MongoStore) FetchMultipartUploadsBefore(t time.Time) ([]MultipartUpload, error) {
+	uploads := []MultipartUpload{}
+	err := mgm.Coll(&MultipartUpload{}).SimpleFind(&uploads, bson.M{
+		"created_at": bson.M{"$lt": t},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (s *MongoStore) FetchIdleMultipartUploads(t time.Time) ([]MultipartUpload, error) {
+	uploads := []MultipartUpload{}
+	err := mgm.Coll(&MultipartUpload{}).SimpleFind(&uploads, bson.M{
+		"updated_at": bson.M{"$lt": t},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (s *MongoStore) TouchMultipartUpload(id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrRecordNotFound
+	}
+	res, err := mgm.Coll(&MultipartUpload{}).UpdateByID(context.Background(), oid,
+		bson.M{"$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) DeleteMultipartUpload(u *MultipartUpload) error {
+	return mgm.Coll(u).Delete(u)
+}
+
+func (s *MongoStore) PutUploadPart(p *UploadPart) error {
+	now := time.Now().UTC()
+	_, err := mgm.Coll(p).UpdateOne(
+		context.Background(),
+		bson.M{"upload_id": p.UploadID, "number": p.Number},
+		bson.M{
+			"$set":         bson.M{"etag": p.ETag, "size": p.Size, "updated_at": now},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *MongoStore) FetchUploadParts(uploadID string) ([]UploadPart, error) {
+	parts := []UploadPart{}
+	err := mgm.Coll(&UploadPart{}).SimpleFind(&parts, bson.M{"upload_id": uploadID})
+	if err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+func (s *MongoStore) DeleteUploadParts(uploadID string) error {
+	_, err := mgm.Coll(&UploadPart{}).DeleteMany(
+		context.Background(),
+		bson.M{"upload_id": uploadID},
+	)
+	return err
+}
+
+func (s *MongoStore) CreateApiKey(k *ApiKey) error {
+	return mgm.Coll(k).Create(k)
+}
+
+func (s *MongoStore) FetchApiKey(accessKey string) (*ApiKey, error) {
+	var k ApiKey
+	if err := mgm.Coll(&k).First(bson.M{"access_key": accessKey}, &k); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &k, nil
+}
+
+func (s *MongoStore) FetchApiKeys() ([]ApiKey, error) {
+	keys := []ApiKey{}
+	if err := mgm.Coll(&ApiKey{}).SimpleFind(&keys, bson.M{}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *MongoStore) DeleteApiKey(accessKey string) error {
+	_, err := mgm.Coll(&ApiKey{}).DeleteOne(
+		context.Background(),
+		bson.M{"access_key": accessKey},
+	)
+	return err
+}
+
+func (s *MongoStore) CreateJournalEntry(e *JournalEntry) error {
+	return mgm.Coll(e).Create(e)
+}
+
+func (s *MongoStore) FetchJournalEntries() ([]JournalEntry, error) {
+	entries := []JournalEntry{}
+	err := mgm.Coll(&JournalEntry{}).SimpleFind(&entries, bson.M{},
+		options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *MongoStore) DeleteJournalEntry(e *JournalEntry) error {
+	return mgm.Coll(e).Delete(e)
+}
+
+func (s *MongoStore) AddBlobRefs(b *Blob, n int) (int, error) {
+	now := time.Now().UTC()
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetUpsert(n > 0)
+	var cur Blob
+	err := mgm.Coll(b).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"path": b.Path},
+		bson.M{
+			"$inc":         bson.M{"refs": n},
+			"$set":         bson.M{"updated_at": now},
+			"$setOnInsert": bson.M{"sha256": b.SHA256, "size": b.Size, "created_at": now},
+		},
+		opts,
+	).Decode(&cur)
+	if err != nil {
+		return 0, mongoErr(err)
+	}
+	return cur.Refs, nil
+}
+
+func (s *MongoStore) FetchBlob(path string) (*Blob, error) {
+	var b Blob
+	if err := mgm.Coll(&b).First(bson.M{"path": path}, &b); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &b, nil
+}
+
+func (s *MongoStore) FetchBlobs() ([]Blob, error) {
+	blobs := []Blob{}
+	if err := mgm.Coll(&Blob{}).SimpleFind(&blobs, bson.M{}); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+func (s *MongoStore) DeleteBlob(path string) error {
+	_, err := mgm.Coll(&Blob{}).DeleteOne(context.Background(), bson.M{"path": path})
+	return err
+}
+
+func (s *MongoStore) CountBlobObjects(path string) (int, error) {
+	n, err := mgm.Coll(&Object{}).CountDocuments(context.Background(), bson.M{"blob": path})
+	return int(n), err
+}
+
+func (s *MongoStore) CreateJob(j *Job) error {
+	return mgm.Coll(j).Create(j)
+}
+
+func (s *MongoStore) FetchJob(id string) (*Job, error) {
+	var j Job
+	if err := mgm.Coll(&j).FindByID(id, &j); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &j, nil
+}
+
+func (s *MongoStore) FetchUnfinishedJobs() ([]Job, error) {
+	jobs := []Job{}
+	err := mgm.Coll(&Job{}).SimpleFind(&jobs,
+		bson.M{"status": bson.M{"$in": bson.A{JobPending, JobRunning}}},
+		options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *MongoStore) UpdateJob(j *Job) error {
+	return mgm.Coll(j).Update(j)
+}
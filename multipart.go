@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MultipartUpload collects parts uploaded independently, ex: in parallel,
+// until they are completed into a single object
+type MultipartUpload struct {
+	mgm.DefaultModel `bson:",inline"`
+	BucketName       string `bson:"bucket_name" json:"bucket_name"`
+	Key              string `json:"key"`
+	Type             string `json:"type"`
+	Initiator        string `json:"initiator"`
+}
+
+// UploadPart is a stored part of a multipart upload, uploading the same
+// part number again replaces it
+type UploadPart struct {
+	mgm.DefaultModel `bson:",inline"`
+	UploadID         string `bson:"upload_id" json:"upload_id"`
+	Number           int    `json:"number"`
+	ETag             string `json:"etag"`
+	Size             int64  `json:"size"`
+}
+
+func (p *UploadPart) CreateIndex() error {
+	col := mgm.Coll(p)
+	_, err := col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "upload_id", Value: 1}, {Key: "number", Value: 1}},
+		Options: options.MergeIndexOptions(
+			options.Index().SetUnique(true),
+			options.Index().SetName("upload_id_number"),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CompletedPart is a part listed by the client when completing an upload
+type CompletedPart struct {
+	Number int
+	ETag   string
+}
+
+const (
+	MultipartMaxParts    = 10000
+	MultipartMinPartSize = 5 << 20 // 5 MB, except the last part
+
+	// uploads without new parts for this long are cleaned up
+	MultipartUploadTTL = 24 * time.Hour
+
+	multipartDir = ".multipart"
+)
+
+var (
+	ErrInvalidPart      = errors.New("one or more of the specified parts could not be found")
+	ErrInvalidPartOrder = errors.New("parts must be listed in ascending order")
+	ErrPartTooSmall     = errors.New("upload part is smaller than the minimum allowed size")
+)
+
+func (u *MultipartUpload) dir() string {
+	return path.Join(multipartDir, u.ID.Hex())
+}
+
+func (u *MultipartUpload) partPath(n int) string {
+	return path.Join(u.dir(), strconv.Itoa(n))
+}
+
+func (u *MultipartUpload) Create() error {
+	return CreateMultipartUpload(u)
+}
+
+func CreateMultipartUpload(u *MultipartUpload) error {
+	if _, err := FetchBucket(u.BucketName); err != nil {
+		return err
+	}
+	u.Key = CleanKey(u.Key)
+	return Metadata().CreateMultipartUpload(u)
+}
+
+func FetchMultipartUpload(id string) (*MultipartUpload, error) {
+	u, err := Metadata().FetchMultipartUpload(id)
+	if err == ErrRecordNotFound {
+		return nil, ErrUploadNotFound
+	}
+	return u, err
+}
+
+// Take the upload lock, completing and aborting the upload can't run at the
+// same time. Fails with ErrUploadNotFound once another request removed it.
+func (u *MultipartUpload) lock() (func(), error) {
+	return u.lockWith(lockUpload)
+}
+
+// Take the shared upload lock parts are stored under
+func (u *MultipartUpload) rlock() (func(), error) {
+	return u.lockWith(rlockUpload)
+}
+
+func (u *MultipartUpload) lockWith(lock func(string) (func(), error)) (func(), error) {
+	unlock, err := lock(u.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := FetchMultipartUpload(u.ID.Hex()); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// Store part n read from r, its ETag is the md5 of the part and it's only
+// stored when it matches the expected checksums. The upload counts as active
+// from the moment the part starts.
+func (u *MultipartUpload) PutPart(n int, r io.Reader, sums Checksums) (*UploadPart, error) {
+	if n < 1 || n > MultipartMaxParts {
+		return nil, ErrInvalidPart
+	}
+	if err := u.touch(); err != nil {
+		return nil, err
+	}
+
+	// the part is received aside and only moved in place under the lock, so
+	// it can't land in an upload completed or aborted meanwhile
+	tmp := fmt.Sprintf("%s.%s", u.partPath(n), primitive.NewObjectID().Hex())
+	cr := newChecksumReader(r, sums)
+	size, err := Storage().CreateFile(tmp, cr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := u.storePart(n, tmp, size, cr.Sums().MD5)
+	if err != nil {
+		if err := Storage().DeleteFile(tmp); err != nil && err != ErrFileNotFound {
+			log.Printf("removing part %s failed: %v\n", tmp, err)
+		}
+		return nil, err
+	}
+	return p, u.touch()
+}
+
+func (u *MultipartUpload) storePart(n int, tmp string, size int64, etag string) (*UploadPart, error) {
+	unlock, err := u.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := Storage().MoveFile(tmp, u.partPath(n)); err != nil {
+		return nil, err
+	}
+	p := &UploadPart{
+		UploadID: u.ID.Hex(),
+		Number:   n,
+		ETag:     etag,
+		Size:     size,
+	}
+	if err := Metadata().PutUploadPart(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (u *MultipartUpload) touch() error {
+	err := Metadata().TouchMultipartUpload(u.ID.Hex())
+	if err == ErrRecordNotFound {
+		return ErrUploadNotFound
+	}
+	return err
+}
+
+// Uploaded parts ordered by number
+func (u *MultipartUpload) Parts() ([]UploadPart, error) {
+	parts, err := Metadata().FetchUploadParts(u.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	return parts, nil
+}
+
+// Assemble listed parts into a single object saved under the upload key, the
+// returned ETag follows S3 multipart format <md5 of parts md5>-<parts count>
+func (u *MultipartUpload) Complete(cps []CompletedPart) (*Object, string, error) {
+	if len(cps) == 0 {
+		return nil, "", ErrInvalidPart
+	}
+	unlock, err := u.lock()
+	if err != nil {
+		return nil, "", err
+	}
+	defer unlock()
+
+	stored, err := u.Parts()
+	if err != nil {
+		return nil, "", err
+	}
+	byNumber := map[int]UploadPart{}
+	for _, p := range stored {
+		byNumber[p.Number] = p
+	}
+
+	h := md5.New()
+	paths := make([]string, 0, len(cps))
+	for i, cp := range cps {
+		if i > 0 && cp.Number <= cps[i-1].Number {
+			return nil, "", ErrInvalidPartOrder
+		}
+		p, ok := byNumber[cp.Number]
+		if !ok || strings.Trim(cp.ETag, `"`) != p.ETag {
+			return nil, "", ErrInvalidPart
+		}
+		if i < len(cps)-1 && p.Size < MultipartMinPartSize {
+			return nil, "", ErrPartTooSmall
+		}
+		b, _ := hex.DecodeString(p.ETag)
+		h.Write(b)
+		paths = append(paths, u.partPath(p.Number))
+	}
+
+	rd := &partsReader{paths: paths}
+	defer rd.Close()
+
+	o := &Object{
+		Type: u.Type,
+	}
+	if _, err := o.Save(&SaveConfig{
+		BucketID: u.BucketName,
+		Reader:   rd,
+		Key:      u.Key,
+	}); err != nil {
+		return nil, "", err
+	}
+
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(cps))
+	return o, etag, u.remove()
+}
+
+// Abort upload removing its parts, fails with ErrUploadLocked while the
+// upload is being completed
+func (u *MultipartUpload) Abort() error {
+	unlock, err := u.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return u.remove()
+}
+
+// remove upload and its parts, it's also used to clean up after completion
+func (u *MultipartUpload) remove() error {
+	if err := Storage().DeleteDir(u.dir(), true); err != nil {
+		return err
+	}
+	if err := Metadata().DeleteUploadParts(u.ID.Hex()); err != nil {
+		return err
+	}
+	if err := Metadata().DeleteMultipartUpload(u); err != nil {
+		return err
+	}
+	uploadLocks.Delete(u.ID.Hex())
+	return nil
+}
+
+// partsReader reads part files one after another, opening each only when
+// it's reached so large uploads don't hold thousands of open files
+type partsReader struct {
+	paths []string
+	cur   StoredFile
+}
+
+func (r *partsReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			f, err := Storage().GetFile(r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.paths = f, r.paths[1:]
+		}
+
+		n, err := r.cur.Read(b)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// Abort uploads without parts stored since t, uploads being completed are
+// left alone. Returns how many were removed.
+func CleanupMultipartUploads(t time.Time) (int, error) {
+	uploads, err := Metadata().FetchIdleMultipartUploads(t)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range uploads {
+		err := uploads[i].Abort()
+		if err == ErrUploadLocked || err == ErrUploadNotFound {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Periodically clean up abandoned multipart uploads
+func RunMultipartJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := CleanupMultipartUploads(time.Now().Add(-MultipartUploadTTL))
+		if err != nil {
+			log.Printf("multipart cleanup failed: %v\n", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("multipart cleanup removed %d abandoned uploads\n", n)
+		}
+	}
+}
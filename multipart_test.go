@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMultipartUpload(t *testing.T, b *Bucket, key string) *MultipartUpload {
+	t.Helper()
+	u := &MultipartUpload{BucketName: b.Name, Key: key, Type: "image/png"}
+	if err := CreateMultipartUpload(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func putTestPart(t *testing.T, u *MultipartUpload, n int, content []byte) CompletedPart {
+	t.Helper()
+	p, err := u.PutPart(n, bytes.NewReader(content), Checksums{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CompletedPart{Number: n, ETag: `"` + p.ETag + `"`}
+}
+
+func TestMultipartComplete(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "multipart")
+	u := newTestMultipartUpload(t, b, "a.png")
+	first := bytes.Repeat([]byte("a"), MultipartMinPartSize)
+	cps := []CompletedPart{
+		putTestPart(t, u, 1, first),
+		putTestPart(t, u, 2, []byte("end")),
+	}
+
+	if _, _, err := u.Complete([]CompletedPart{cps[0], cps[0]}); err != ErrInvalidPartOrder {
+		t.Errorf("got %v, want invalid order", err)
+	}
+	small := putTestPart(t, u, 3, []byte("small"))
+	if _, _, err := u.Complete([]CompletedPart{cps[1], small}); err != ErrPartTooSmall {
+		t.Errorf("got %v, want part too small", err)
+	}
+
+	o, etag, err := u.Complete(cps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := md5.New()
+	for _, p := range [][]byte{first, []byte("end")} {
+		s := md5.Sum(p)
+		h.Write(s[:])
+	}
+	if want := hex.EncodeToString(h.Sum(nil)) + "-2"; etag != want {
+		t.Errorf("got etag %s, want %s", etag, want)
+	}
+	f, err := OpenObject(o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if c, _ := io.ReadAll(f); !bytes.Equal(c, append(first, "end"...)) {
+		t.Errorf("object holds %d bytes", len(c))
+	}
+
+	// the upload is gone once completed
+	if _, _, err := u.Complete(cps); err != ErrUploadNotFound {
+		t.Errorf("completing again got %v", err)
+	}
+	if ok, _ := Storage().Exists(u.partPath(1)); ok {
+		t.Error("part kept after completion")
+	}
+}
+
+func TestMultipartCompleteLocked(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "multipart")
+	u := newTestMultipartUpload(t, b, "a.png")
+	cps := []CompletedPart{putTestPart(t, u, 1, []byte("a"))}
+
+	unlock, err := u.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := u.Complete(cps); err != ErrUploadLocked {
+		t.Errorf("completing got %v, want locked", err)
+	}
+	if err := u.Abort(); err != ErrUploadLocked {
+		t.Errorf("aborting got %v, want locked", err)
+	}
+	unlock()
+
+	if _, _, err := u.Complete(cps); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanupMultipartUploads(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "multipart")
+	active := newTestMultipartUpload(t, b, "a.png")
+	idle := newTestMultipartUpload(t, b, "b.png")
+	putTestPart(t, idle, 1, []byte("b"))
+	time.Sleep(2 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	// parts keep uploads started earlier alive
+	putTestPart(t, active, 1, []byte("a"))
+
+	n, err := CleanupMultipartUploads(cutoff)
+	if err != nil || n != 1 {
+		t.Fatalf("removed %d uploads, %v", n, err)
+	}
+	if _, err := FetchMultipartUpload(idle.ID.Hex()); err != ErrUploadNotFound {
+		t.Errorf("idle upload fetched: %v", err)
+	}
+	if ok, _ := Storage().Exists(idle.partPath(1)); ok {
+		t.Error("part of idle upload kept")
+	}
+	if _, err := FetchMultipartUpload(active.ID.Hex()); err != nil {
+		t.Errorf("active upload removed: %v", err)
+	}
+	if _, err := idle.PutPart(2, strings.NewReader("b"), Checksums{}); err != ErrUploadNotFound {
+		t.Errorf("part of removed upload got %v", err)
+	}
+}
+
+// abortingReader aborts the upload once the part body starts being read
+type abortingReader struct {
+	io.Reader
+	u *MultipartUpload
+}
+
+func (r *abortingReader) Read(b []byte) (int, error) {
+	if r.u != nil {
+		r.u.Abort()
+		r.u = nil
+	}
+	return r.Reader.Read(b)
+}
+
+func TestPutPartLocked(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "multipart")
+	u := newTestMultipartUpload(t, b, "a.png")
+
+	// parts are stored in parallel but not while completing
+	unlock, err := u.rlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestPart(t, u, 1, []byte("a"))
+	unlock()
+	unlock, err = u.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.PutPart(2, strings.NewReader("b"), Checksums{}); err != ErrUploadLocked {
+		t.Errorf("got %v while completing, want locked", err)
+	}
+	unlock()
+	if parts, _ := u.Parts(); len(parts) != 1 {
+		t.Errorf("got %d parts", len(parts))
+	}
+
+	r := &abortingReader{Reader: strings.NewReader("c"), u: u}
+	if _, err := u.PutPart(3, r, Checksums{}); err != ErrUploadNotFound {
+		t.Errorf("got %v storing a part of an aborted upload", err)
+	}
+	if parts, _ := Metadata().FetchUploadParts(u.ID.Hex()); len(parts) != 0 {
+		t.Errorf("got %d parts after aborting", len(parts))
+	}
+	Storage().WalkFiles(func(p string, size int64) error {
+		if strings.HasPrefix(p, u.dir()+"/") {
+			t.Errorf("file %s kept after aborting", p)
+		}
+		return nil
+	})
+}
@@ -1,19 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 )
 
 const (
-	MaxUploadLimit = 1024 * 1024 * 1 // 1 MB
+	MaxUploadLimit = 1024 * 1024 * 1024 * 5 // 5 GB
+	MaxMemoryLimit = 1024 * 1024 * 1        // 1 MB
+
+	// requests have to be read and answered within ServerTimeout, uploads
+	// and downloads only have to move a byte every TransferTimeout
+	ServerTimeout   = 30 * time.Second
+	TransferTimeout = 30 * time.Second
 )
 
 var (
@@ -23,6 +33,12 @@ var (
 	tlsConfig *tls.Config
 )
 
+// Content-Disposition types
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
 var vdr *validator.Validate
 
 type Payload map[string]any
@@ -75,10 +91,32 @@ func (e ValidationError) Error() string {
 	return fmt.Sprintf("%v", e.Errors)
 }
 
+// Parse body into v rejecting fields v doesn't have
+func ParseBodyStrict(r *http.Request, v any) error {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(b) == 0 {
+		return ErrInvalidRequest
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
 func ParseAndValidate(r *http.Request, v any) error {
 	if err := ParseBody(r, v); err != nil {
 		return err
 	}
+	return validate(v)
+}
+
+func ParseStrictAndValidate(r *http.Request, v any) error {
+	if err := ParseBodyStrict(r, v); err != nil {
+		return err
+	}
+	return validate(v)
+}
+
+func validate(v any) error {
 	if err := Validator().Struct(v); err != nil {
 		if _, ok := err.(*validator.InvalidValidationError); ok {
 			return err
@@ -122,3 +160,99 @@ func GetAddr() string {
 	prt := os.Getenv("PORT")
 	return ":" + prt
 }
+
+// ContentDisposition header value for file name, non ASCII names are sent
+// RFC 5987 encoded in filename* with an ASCII fallback for old clients
+// ex: résumé.pdf is sent as r%C3%A9sum%C3%A9.pdf
+func ContentDisposition(typ, name string) string {
+	if name == "" {
+		return typ
+	}
+
+	ascii := true
+	fb := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			ascii = false
+			return '_'
+		}
+		if r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	v := fmt.Sprintf(`%s; filename="%s"`, typ, fb)
+	if !ascii {
+		v += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	return v
+}
+
+func encodeRFC5987(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if isRFC5987AttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func isRFC5987AttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// Transfer lifts the server timeouts off upload and download handlers so
+// large files aren't cut off, the connection is dropped once the client
+// stops sending or reading for TransferTimeout instead. The response has no
+// deadline until it's written so handlers can take their time in between.
+func Transfer(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+		if r.Body == nil || r.Body == http.NoBody {
+			rc.SetReadDeadline(time.Time{})
+		} else {
+			rc.SetReadDeadline(time.Now().Add(TransferTimeout))
+			r.Body = &transferBody{ReadCloser: r.Body, rc: rc}
+		}
+		h(&transferWriter{ResponseWriter: w, rc: rc}, r)
+	}
+}
+
+type transferBody struct {
+	io.ReadCloser
+	rc *http.ResponseController
+}
+
+func (b *transferBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		// nothing left to wait for, the server reads the next request
+		// with its own deadline
+		b.rc.SetReadDeadline(time.Time{})
+	} else if n > 0 {
+		b.rc.SetReadDeadline(time.Now().Add(TransferTimeout))
+	}
+	return n, err
+}
+
+type transferWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	w.rc.SetWriteDeadline(time.Now().Add(TransferTimeout))
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *transferWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
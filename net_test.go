@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// server with timeouts much shorter than the transfers it serves
+func newTimeoutServer(h http.Handler) *httptest.Server {
+	s := httptest.NewUnstartedServer(h)
+	s.Config.ReadTimeout = 100 * time.Millisecond
+	s.Config.WriteTimeout = 100 * time.Millisecond
+	s.Start()
+	return s
+}
+
+// write 10 chunks 50ms apart
+func slowDownload(w http.ResponseWriter, r *http.Request) {
+	for i := 0; i < 10; i++ {
+		w.Write([]byte(strings.Repeat("x", 1000)))
+		http.NewResponseController(w).Flush()
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTransferDownload(t *testing.T) {
+	for _, transfer := range []bool{false, true} {
+		h := http.HandlerFunc(slowDownload)
+		if transfer {
+			h = Transfer(slowDownload)
+		}
+		s := newTimeoutServer(h)
+		res, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		s.Close()
+
+		if complete := len(b) == 10000; complete != transfer {
+			t.Errorf("transfer %v: got %d bytes", transfer, len(b))
+		}
+	}
+}
+
+func TestTransferUpload(t *testing.T) {
+	read := make(chan int, 1)
+	s := newTimeoutServer(Transfer(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		read <- len(b)
+		// the response isn't cut off by the server timeout either
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 10; i++ {
+			pw.Write([]byte(strings.Repeat("x", 1000)))
+			time.Sleep(50 * time.Millisecond)
+		}
+		pw.Close()
+	}()
+	res, err := http.Post(s.URL, "application/octet-stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if n := <-read; n != 10000 || string(b) != "ok" {
+		t.Errorf("server read %d bytes and answered %q", n, b)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		typ, name, want string
+	}{
+		{DispositionInline, "", "inline"},
+		{DispositionAttachment, "report.pdf", `attachment; filename="report.pdf"`},
+		{DispositionInline, `a "b".txt`, `inline; filename="a _b_.txt"`},
+		{DispositionAttachment, "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{DispositionAttachment, "a b.txt", `attachment; filename="a b.txt"`},
+	}
+	for _, tt := range tests {
+		if got := ContentDisposition(tt.typ, tt.name); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"log"
+	"net/url"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -28,16 +29,67 @@ type Object struct {
 	Size       int    `json:"size"`
 	Directory  string `json:"directory"`
 	BucketName string `json:"bucket_name"`
+	Key        string `json:"key"`
+
+	// name of the file as uploaded, title is the stored file name
+	Filename string `bson:"filename" json:"filename"`
+
+	// hex checksums of the content, md5 is kept for S3 ETags
+	SHA256 string `bson:"sha256" json:"sha256"`
+	MD5    string `bson:"md5" json:"md5"`
+
+	// delete markers have no file, they hide the key in versioned buckets
+	DeleteMarker bool `bson:"delete_marker" json:"delete_marker"`
+
+	// saved while the bucket kept versions, other objects are null versions
+	// replaced by the next object saved under their key
+	Versioned bool `bson:"versioned" json:"versioned"`
+
+	// set by fsck repair when the file is missing or its content changed
+	Broken bool `bson:"broken" json:"broken"`
+
+	// content is stored encrypted with the bucket data key, or the customer
+	// key whose fingerprint is kept
+	Encrypted         bool   `bson:"encrypted" json:"encrypted"`
+	CustomerKeySHA256 string `bson:"customer_key_sha256" json:"customer_key_sha256,omitempty"`
+
+	// content is stored compressed with encoding, stored size is what the
+	// file takes once compressed and encrypted
+	Encoding   string `bson:"encoding,omitempty" json:"encoding,omitempty"`
+	StoredSize int64  `bson:"stored_size" json:"stored_size"`
+
+	// path of the blob shared with objects of the same content, objects
+	// without one have a file of their own
+	Blob string `bson:"blob,omitempty" json:"-"`
+
+	// user tags, lifecycle rules can select objects by them
+	Tags map[string]string `bson:"tags,omitempty" json:"tags,omitempty"`
 }
 
 func (o *Object) CreateIndex() error {
 	col := mgm.Coll(o)
-	_, err := col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
-		Keys: bson.M{"uuid": 1},
-		Options: options.MergeIndexOptions(
-			options.Index().SetUnique(true),
-			options.Index().SetName("uuid"),
-		),
+	_, err := col.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys: bson.M{"uuid": 1},
+			Options: options.MergeIndexOptions(
+				options.Index().SetUnique(true),
+				options.Index().SetName("uuid"),
+			),
+		},
+		{
+			// key lookups and listings
+			Keys: bson.D{
+				{Key: "bucketname", Value: 1},
+				{Key: "key", Value: 1},
+				{Key: "created_at", Value: -1},
+			},
+			Options: options.Index().SetName("bucket_key"),
+		},
+		{
+			// blob reference counts
+			Keys:    bson.M{"blob": 1},
+			Options: options.Index().SetName("blob").SetSparse(true),
+		},
 	})
 	if err != nil {
 		return err
@@ -45,96 +97,402 @@ func (o *Object) CreateIndex() error {
 	return nil
 }
 
+// Path of the object file in the storage backend, directory already
+// contains the bucket name when the object is saved in a sub directory
+func (o *Object) Path() string {
+	if o.Blob != "" {
+		return filepath.FromSlash(o.Blob)
+	}
+	if o.Directory == "." || o.Directory == "" {
+		return filepath.Join(o.BucketName, o.Title)
+	}
+	return filepath.Join(o.Directory, o.Title)
+}
+
 type SaveConfig struct {
 	BucketID string
 	Reader   io.Reader
 	Key      string
+	// original file name, defaults to the key base name
+	Filename string
+	// expected content checksums, the object isn't saved if they don't match
+	Checksums Checksums
+	Tags      map[string]string
+	// encrypt content with this key instead of the bucket data key
+	CustomerKey []byte
 }
 
 func (o *Object) Save(cfg *SaveConfig) (string, error) {
 	return SaveObject(o, cfg)
 }
 
+// Save object, without versioning it replaces the object saved under its key
+// before
 func SaveObject(o *Object, cfg *SaveConfig) (string, error) {
+	id, err := saveObject(o, cfg)
+	if err != nil {
+		return "", err
+	}
+	// the object is saved even if older ones linger, the next save or
+	// delete of the key removes them
+	if !o.Versioned {
+		if err := replaceNullVersions(o); err != nil {
+			log.Printf("replaced versions of %s in %s not deleted: %v\n", o.Key, o.BucketName, err)
+		}
+	}
+	return id, nil
+}
+
+func saveObject(o *Object, cfg *SaveConfig) (string, error) {
 	// Validate bucket existence
 	bkt, err := FetchBucket(cfg.BucketID)
 	if err != nil {
 		return "", err
 	}
+	if bkt.Deleting {
+		return "", ErrBucketDeleting
+	}
+	if !bkt.AllowsType(o.Type) {
+		return "", ErrTypeNotAllowed
+	}
+	var key []byte
+	switch {
+	case cfg.CustomerKey != nil:
+		key = cfg.CustomerKey
+		o.CustomerKeySHA256 = customerKeyFingerprint(key)
+	case bkt.Encryption.Enabled:
+		if key, err = bkt.dataKey(); err != nil {
+			return "", err
+		}
+	}
 
 	// Create uuid
 	uuid, _ := uuid.NewRandom()
 	o.UUID = uuid.String()
 
-	// parse path to handle sub directories in bucket
-	k := cfg.Key
+	// parse path to handle sub directories in bucket, objects saved without
+	// a key get a key of their own so they never replace another object
+	k := CleanKey(cfg.Key)
 	if k == "" {
-		k = o.Title
+		k = CleanKey(o.Title)
+	}
+	if k == "" {
+		k = uuid.String() + filepath.Ext(CleanFilename(cfg.Filename))
+	}
+
+	// the null versions replaced are removed after the save, their room
+	// counts as free
+	replaced, err := bkt.replacedUsage(k)
+	if err != nil {
+		return "", err
+	}
+	r, err := bkt.quotaReader(cfg.Reader, replaced)
+	if err != nil {
+		return "", err
 	}
 
 	t := uuid.String() + filepath.Ext(k)
 	o.Title = t
+	o.Key = k
+	o.Tags = cfg.Tags
+	o.Filename = CleanFilename(cfg.Filename)
+	if o.Filename == "" {
+		o.Filename = path.Base(k)
+	}
 
-	dir := filepath.Dir(cfg.Key)
+	dir := filepath.Dir(k)
 	p := filepath.Join(bkt.Name, dir, t) // bucket/new/image.jpg
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(cfg.Reader)
+	j, err := beginJournal(&JournalEntry{
+		Op:     JournalObjectSave,
+		Bucket: bkt.Name,
+		Object: o.UUID,
+		Path:   p,
+	})
+	if err != nil {
+		return "", err
+	}
 
-	f, err := CreateFile(p, buf.Bytes())
+	// content is compressed before it's encrypted
+	cr := newChecksumReader(r, cfg.Checksums)
+	var content io.Reader = cr
+	if IsCompressible(o.Type) {
+		zr := newGzipReader(cr)
+		defer zr.Close()
+		content = zr
+		o.Encoding = EncodingGzip
+	}
+	if key != nil {
+		if content, err = newEncryptingReader(content, key); err != nil {
+			j.Done()
+			return "", err
+		}
+		o.Encrypted = true
+	}
+	stored, err := Storage().CreateFile(p, content)
 	if err != nil {
+		// storage never shows partially written files
+		j.Done()
+		return "", err
+	}
+	o.StoredSize = stored
+
+	// quotas count content, not what is actually stored
+	n := cr.Size()
+
+	// objects saved meanwhile can leave no room for this one
+	if err := reserveUsage(bkt, n, stored, replaced); err != nil {
+		if Storage().DeleteFile(p) == nil {
+			j.Done()
+		}
 		return "", err
 	}
-	defer f.Close()
 
 	// Update object
-	o.Size = int(buf.Len())
+	sums := cr.Sums()
+	o.SHA256 = sums.SHA256
+	o.MD5 = sums.MD5
+	o.Size = int(n)
 	o.BucketName = bkt.Name
+	o.Versioned = bkt.Versioning
 
 	if dir != "." {
 		dir = filepath.Join(bkt.Name, dir)
 	}
 	o.Directory = dir
 
-	// Store object
-	if err := mgm.Coll(o).Create(o); err != nil {
+	// content already stored is shared, the blob stays locked until the
+	// object referencing it is stored
+	if bp := blobPath(bkt, o); bp != "" {
+		unlock := lockBlob(bp)
+		defer unlock()
+		if err := storeBlob(p, bp, o.SHA256, stored); err != nil {
+			releaseUsage(bkt.Name, n, stored)
+			if ignoreNotFound(Storage().DeleteFile(p)) == nil {
+				j.Done()
+			}
+			return "", err
+		}
+		o.Blob = bp
+	}
+
+	// Store object, the file is removed if that fails
+	if err := Metadata().CreateObject(o); err != nil {
+		releaseUsage(bkt.Name, n, stored)
+		derr := Storage().DeleteFile(p)
+		if o.Blob != "" {
+			derr = unrefBlob(o.Blob)
+		}
+		if derr == nil {
+			j.Done()
+		}
 		return "", err
 	}
+	j.Done()
 	return uuid.String(), nil
 }
 
+// CleanKey normalizes object key and drops any parent references so the
+// object can't escape its bucket directory
+func CleanKey(k string) string {
+	return strings.TrimPrefix(path.Clean("/"+k), "/")
+}
+
+// Key of objects saved before keys were kept, the path of their file inside
+// the bucket. Stored file names are unique so no two objects share it.
+func legacyKey(o *Object) string {
+	dir := filepath.ToSlash(o.Directory)
+	if dir == "." || dir == o.BucketName {
+		dir = ""
+	}
+	return CleanKey(path.Join(strings.TrimPrefix(dir, o.BucketName+"/"), o.Title))
+}
+
+// Give objects saved before keys were kept their legacy key, listings and
+// lifecycle rules group objects by key. Returns how many were updated.
+func BackfillObjectKeys() (int, error) {
+	legacy := []Object{}
+	err := Metadata().EachObject(func(o *Object) error {
+		if o.Key == "" && !o.DeleteMarker {
+			legacy = append(legacy, *o)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range legacy {
+		o := &legacy[i]
+		o.Key = legacyKey(o)
+		if err := Metadata().UpdateObject(o); err != nil {
+			return i, err
+		}
+	}
+	return len(legacy), nil
+}
+
+// Object tags limits, same as S3
+const (
+	MaxObjectTags   = 10
+	MaxTagKeyLength = 128
+	MaxTagValLength = 256
+)
+
+var ErrInvalidTags = errors.New("tags must be url encoded key=value pairs, at most 10")
+
+// Parse tags sent as url query ex: env=tmp&team=media
+func ParseTags(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	q, err := url.ParseQuery(s)
+	if err != nil || len(q) > MaxObjectTags {
+		return nil, ErrInvalidTags
+	}
+	tags := make(map[string]string, len(q))
+	for k, v := range q {
+		if k == "" || len(k) > MaxTagKeyLength || len(v) != 1 || len(v[0]) > MaxTagValLength {
+			return nil, ErrInvalidTags
+		}
+		tags[k] = v[0]
+	}
+	return tags, nil
+}
+
+// CleanFilename drops any directories from client sent file name, some
+// clients send the full path of the file
+func CleanFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// Name to download object with, objects saved before filenames were kept
+// use their key
+func (o *Object) DownloadName() string {
+	if o.Filename != "" {
+		return o.Filename
+	}
+	if o.Key != "" {
+		return path.Base(o.Key)
+	}
+	return o.Title
+}
+
+// Entity tag of object content, objects saved before checksums have none
+func (o *Object) ETag() string {
+	if o.SHA256 == "" {
+		return ""
+	}
+	return `"` + o.SHA256 + `"`
+}
+
+// ETag of the content served with encoding, representations must have
+// different ETags
+func (o *Object) EncodedETag(encoding string) string {
+	if o.SHA256 == "" || encoding == "" {
+		return o.ETag()
+	}
+	return `"` + o.SHA256 + "-" + encoding + `"`
+}
+
+// Bytes the object file takes, objects saved before it was recorded take
+// their size
+func (o *Object) StoredBytes() int64 {
+	if o.StoredSize > 0 || o.Size == 0 {
+		return o.StoredSize
+	}
+	if o.Encrypted {
+		return encryptedSize(int64(o.Size))
+	}
+	return int64(o.Size)
+}
+
+// Open object content, encrypted content is decrypted and compressed content
+// decompressed as it's read
+func OpenObject(o *Object, customerKey []byte) (StoredFile, error) {
+	f, err := openStoredObject(o, customerKey)
+	if err != nil || o.Encoding == "" {
+		return f, err
+	}
+	return newGzipFile(f, int64(o.Size)), nil
+}
+
+// S3 clients expect the md5 of the content as ETag
+func (o *Object) S3ETag() string {
+	if o.MD5 == "" {
+		return ""
+	}
+	return `"` + o.MD5 + `"`
+}
+
 // Fetch object by uuid
 func FetchObject(uuid string) (*Object, error) {
-	o := &Object{}
-	if err := mgm.Coll(o).FindOne(context.Background(), bson.M{"uuid": uuid}).Decode(o); err != nil {
+	return Metadata().FetchObject(uuid)
+}
+
+// Fetch the latest object saved under key in bucket
+func FetchObjectByKey(bucket string, key string) (*Object, error) {
+	o, err := Metadata().FetchObjectByKey(bucket, CleanKey(key))
+	if err != nil {
 		return nil, err
 	}
+	if o.DeleteMarker {
+		return nil, ErrRecordNotFound
+	}
 	return o, nil
 }
 
 func DeleteObject(uuid string) error {
 	// Fetch metadata from database
-	o := &Object{}
-	if err := mgm.Coll(o).FindOne(
-		context.Background(),
-		bson.M{"uuid": uuid},
-	).Decode(o); err != nil {
+	o, err := FetchObject(uuid)
+	if err != nil {
 		return err
 	}
 
-	// Delete file
-	p := filepath.Join(o.BucketName, o.Directory, o.Title)
-	if err := DeleteFile(p); err != nil {
+	j := &JournalEntry{
+		Op:     JournalObjectDelete,
+		Bucket: o.BucketName,
+		Object: o.UUID,
+	}
+	// blobs are dropped with their last reference, recovery counts them
+	// again instead
+	if !o.DeleteMarker && o.Blob == "" {
+		j.Path = o.Path()
+	}
+	if _, err := beginJournal(j); err != nil {
 		return err
 	}
+	if o.Blob != "" {
+		unlock := lockBlob(o.Blob)
+		defer unlock()
+	}
+
+	// Delete object first so it's gone even if the file lingers, the journal
+	// entry is kept for recovery to finish the delete
+	if err := Metadata().DeleteObject(uuid); err != nil {
+		return err
+	}
+	if !o.DeleteMarker {
+		releaseUsage(o.BucketName, int64(o.Size), o.StoredBytes())
+	}
 
-	// Delete object
-	if _, err := mgm.Coll(o).DeleteOne(
-		context.Background(),
-		bson.M{"uuid": uuid},
-	); err != nil {
+	// Delete file
+	if o.Blob != "" {
+		if err := unrefBlob(o.Blob); err != nil {
+			return err
+		}
+	} else if j.Path != "" {
+		if err := ignoreNotFound(Storage().DeleteFile(j.Path)); err != nil {
+			return err
+		}
+	}
+	if err := ignoreNotFound(Storage().DeleteDir(variantsPath(o.UUID), true)); err != nil {
 		return err
 	}
+	j.Done()
 	return nil
 }
 
@@ -142,6 +500,15 @@ type ObjectShare struct {
 	// Link expiration date in seconds
 	TTL time.Duration
 
+	// Label to tell sessions apart, ex: the recipient
+	Label string
+
+	// Optional restrictions, one time links allow a single download
+	MaxDownloads int
+	OneTime      bool
+	AllowedCIDRs []string
+	Password     string
+
 	Metadata map[string]interface{}
 }
 
@@ -165,19 +532,35 @@ func (o *Object) GenerateSharableLink(shr *ObjectShare) (string, *ObjectSharingS
 		OUUID:      o.UUID,
 		TTL:        ttl,
 		ExpiryDate: CalculateExpiration(ttl),
+		Label:      shr.Label,
+		Metadata:   shr.Metadata,
+
+		MaxDownloads: shr.MaxDownloads,
+		OneTime:      shr.OneTime,
+		AllowedCIDRs: shr.AllowedCIDRs,
+	}
+	if shr.OneTime {
+		session.MaxDownloads = 1
+	}
+	if err := session.SetPassword(shr.Password); err != nil {
+		return "", nil, err
 	}
 	if err := CreateSession(session); err != nil {
 		return "", nil, err
 	}
+	return o.SessionLink(bkt.Name, session), session, nil
+}
 
+// Link to object using sharing session
+func (o *Object) SessionLink(bucket string, s *ObjectSharingSession) string {
 	l := fmt.Sprintf(
 		"/share/%s/%s?ttl=%d&session=%s",
-		bkt.Name,
+		bucket,
 		o.Title,
-		ttl,
-		session.ID.Hex(),
+		s.TTL,
+		s.ID.Hex(),
 	)
-	return JoinUrl(l), session, nil
+	return JoinUrl(l)
 }
 
 func CalculateExpiration(ttl time.Duration) time.Time {
@@ -185,8 +568,16 @@ func CalculateExpiration(ttl time.Duration) time.Time {
 }
 
 type ServedFile struct {
-	File *os.File
+	File StoredFile
 	Type string
+	// original file name of the object
+	Filename string
+	ETag     string
+	ModTime  time.Time
+	// content encoding of File, the encoding served depends on the
+	// client when VaryEncoding is set
+	Encoding     string
+	VaryEncoding bool
 }
 
 // close ServedFile
@@ -204,51 +595,103 @@ var (
 	ErrSessionNotFound = errors.New("session not found")
 )
 
-// Serve object from local filesystem
-func ServeObject(uuid string, sn string) (*ServedFile, error) {
-	// fetch object latest sharing session
-	if err := checkSession(uuid, sn); err != nil {
+// Serve object from storage using sharing session
+func ServeObject(uuid string, sn string, acc *SessionAccess) (*ServedFile, error) {
+	s, err := checkSession(uuid, sn, acc)
+	if err != nil {
 		return nil, err
 	}
 
 	// Fetch metadata from database
-	o := &Object{}
-	if err := mgm.Coll(o).FindOne(
-		context.Background(),
-		bson.M{"uuid": uuid},
-	).Decode(o); err != nil {
+	o, err := FetchObject(uuid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := serveObject(o, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	// only count downloads once the file is there, revalidating a cached
+	// copy isn't a new download
+	if acc.Download && s.MaxDownloads > 0 && !acc.NotModified(f.ETag, f.ModTime) {
+		if err := s.CountDownload(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Serve object from storage using signed link query, session restrictions
+// in acc don't apply
+func ServeSignedObject(method, bucket, uuid string, q url.Values, acc *SessionAccess) (*ServedFile, error) {
+	if err := VerifySignedLink(method, bucket, uuid, q); err != nil {
 		return nil, err
 	}
 
-	// Serve object
-	p := filepath.Join(o.BucketName, o.Directory, o.Title)
-	f, err := GetFile(p)
+	o, err := FetchObject(uuid)
 	if err != nil {
 		return nil, err
 	}
-	return &ServedFile{
-		File: f,
-		Type: o.Type,
-	}, nil
+	return serveObject(o, acc)
 }
 
-func checkSession(uuid string, sn string) error {
-	// fetch object latest sharing session
+// Serve object content, compressed content is served as stored to clients
+// accepting its encoding and images are transformed when asked
+func serveObject(o *Object, acc *SessionAccess) (*ServedFile, error) {
+	if o.DeleteMarker {
+		return nil, ErrRecordNotFound
+	}
+	if acc.Transform != nil {
+		return serveImageVariant(o, acc.Transform, acc.CustomerKey)
+	}
+	sf := &ServedFile{
+		Type:         o.Type,
+		Filename:     o.DownloadName(),
+		ETag:         o.ETag(),
+		ModTime:      o.CreatedAt,
+		VaryEncoding: o.Encoding != "",
+	}
+
+	var err error
+	if o.Encoding != "" && AcceptsEncoding(acc.AcceptEncoding, o.Encoding) {
+		sf.File, err = openStoredObject(o, acc.CustomerKey)
+		sf.Encoding = o.Encoding
+		sf.ETag = o.EncodedETag(o.Encoding)
+	} else {
+		sf.File, err = OpenObject(o, acc.CustomerKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+func checkSession(uuid string, sn string, acc *SessionAccess) (*ObjectSharingSession, error) {
 	s, err := FetchSession(sn)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return ErrSessionExpired
+		if err == ErrRecordNotFound {
+			return nil, ErrSessionExpired
 		}
-		return err
+		return nil, err
 	}
 	if bgs, _ := s.BelongToObj(uuid); !bgs {
-		return ErrSessionNotFound
+		return nil, ErrSessionNotFound
+	}
+
+	if s.IsRevoked() {
+		return nil, ErrSessionRevoked
 	}
 
 	if s.CheckExpiration() {
-		return ErrSessionExpired
+		return nil, ErrSessionExpired
 	}
-	return nil
+
+	if err := s.CheckAccess(acc); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 var (
@@ -258,7 +701,12 @@ var (
 		"^audio/*",
 		"^application/pdf",
 		"^application/vnd.apple.mpegurl",
-		"^application/dash+xml",
+		"^application/dash\\+xml",
+		// text types browsers don't render as documents, html and xml
+		// served from shared links could run scripts
+		"^application/json(;|$)",
+		"^text/plain(;|$)",
+		"^text/csv(;|$)",
 	}
 )
 
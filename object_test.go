@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCleanFilename(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"/home/user/photo.jpg", "photo.jpg"},
+		{`C:\Users\me\photo.jpg`, "photo.jpg"},
+		{"", ""},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		if got := CleanFilename(tt.in); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCheckType(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want bool
+	}{
+		{"image/png", true},
+		{"text/plain", true},
+		{"text/plain; charset=utf-8", true},
+		{"text/csv", true},
+		{"application/json", true},
+		{"text/html", false},
+		{"text/xml", false},
+		{"text/plainx", false},
+		{"application/jsonp", false},
+		{"textual/plain", false},
+		{"application/x-msdownload", false},
+	}
+	for _, tt := range tests {
+		if got := CheckType(tt.typ); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestSaveObjectKeepsFilename(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := &Object{Type: "image/png"}
+	if _, err := SaveObject(o, &SaveConfig{
+		BucketID: b.Name,
+		Reader:   strings.NewReader("a"),
+		Key:      "2024/holiday.png",
+		Filename: `C:\photos\Été à la plage.png`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	o, err := FetchObject(o.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Key != "2024/holiday.png" || o.Filename != "Été à la plage.png" || o.Title != o.UUID+".png" {
+		t.Errorf("got key %q, filename %q, title %q", o.Key, o.Filename, o.Title)
+	}
+
+	// the key base name is used without a file name
+	k := saveTestObject(t, b, "2024/beach.png", "b")
+	if k.DownloadName() != "beach.png" {
+		t.Errorf("got download name %q", k.DownloadName())
+	}
+	if n := (&Object{Title: "uuid.png"}).DownloadName(); n != "uuid.png" {
+		t.Errorf("got download name %q for an object saved without key", n)
+	}
+}
+
+func TestSaveObjectWithoutKey(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+
+	// uploads of the same file name without a key don't replace each other
+	var saved []*Object
+	for _, c := range []string{"first", "second"} {
+		o := &Object{Type: "image/png"}
+		if _, err := SaveObject(o, &SaveConfig{
+			BucketID: b.Name,
+			Reader:   strings.NewReader(c),
+			Filename: "photo.png",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, o)
+	}
+	for _, o := range saved {
+		o, err := FetchObject(o.UUID)
+		if err != nil {
+			t.Fatalf("object replaced: %v", err)
+		}
+		if o.Key != o.UUID+".png" || o.Filename != "photo.png" {
+			t.Errorf("got key %q, filename %q", o.Key, o.Filename)
+		}
+	}
+}
+
+func TestHandleServingDisposition(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := &Object{Type: "image/png"}
+	if _, err := SaveObject(o, &SaveConfig{
+		BucketID: b.Name,
+		Reader:   strings.NewReader("a"),
+		Key:      "a.png",
+		Filename: "photo d'été.png",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, o, &ObjectShare{})
+
+	get := func(disp string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/share/photos/"+o.Title+"?session="+s.ID.Hex()+"&disposition="+disp, nil)
+		r = mux.SetURLVars(r, map[string]string{"bucket": "photos", "uuid": o.Title})
+		w := httptest.NewRecorder()
+		HandleServingRequestedObject(w, r)
+		return w
+	}
+	tests := []struct {
+		disp   string
+		status int
+		want   string
+	}{
+		{"", http.StatusOK, `inline; filename="photo d'_t_.png"; filename*=UTF-8''photo%20d%27%C3%A9t%C3%A9.png`},
+		{"attachment", http.StatusOK, `attachment; filename="photo d'_t_.png"; filename*=UTF-8''photo%20d%27%C3%A9t%C3%A9.png`},
+		{"download", http.StatusUnprocessableEntity, ""},
+	}
+	for _, tt := range tests {
+		w := get(tt.disp)
+		if w.Code != tt.status {
+			t.Errorf("%q: got %d %s", tt.disp, w.Code, w.Body)
+			continue
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.disp, got, tt.want)
+		}
+		if w.Code == http.StatusOK && w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%q: served without nosniff", tt.disp)
+		}
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
@@ -12,71 +15,195 @@ import (
 )
 
 func HandleObjectCreation(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(MaxUploadLimit); err != nil {
-		SendHttpJsonError(w, http.StatusBadRequest, err)
-		return
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadLimit)
+	defer r.Body.Close()
 
-	}
-	f, h, err := r.FormFile("file")
+	mr, err := r.MultipartReader()
 	if err != nil {
 		SendHttpJsonError(w, http.StatusBadRequest, err)
 		return
 	}
-	defer f.Close()
-	defer r.Body.Close()
 
-	typ := h.Header.Get("Content-Type")
-	if r := CheckType(typ); !r {
-		SendHttpJsonError(w, http.StatusForbidden, errors.New("file type is not allowed"))
+	var (
+		cfg   = &SaveConfig{}
+		typ   string
+		o     *Object
+		spool *os.File
+	)
+	if cfg.CustomerKey, err = ParseCustomerKey(r.Header); err != nil {
+		SendHttpJsonError(w, http.StatusBadRequest, err)
 		return
 	}
+	defer func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			SendHttpJsonError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		switch part.FormName() {
+		case "bucket", "key", "tags":
+			v, err := readFormValue(part)
+			if err != nil {
+				SendHttpJsonError(w, http.StatusBadRequest, err)
+				return
+			}
+			switch part.FormName() {
+			case "bucket":
+				cfg.BucketID = v
+			case "key":
+				cfg.Key = v
+			case "tags":
+				if cfg.Tags, err = ParseTags(v); err != nil {
+					SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+					return
+				}
+			}
+		case "file":
+			if o != nil || spool != nil {
+				SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("only one file is allowed"))
+				return
+			}
+			// the type is checked against the bucket when saving
+			typ = part.Header.Get("Content-Type")
+			cfg.Filename = part.FileName()
+
+			// checksums of the file are sent with its part or the request
+			cfg.Checksums, err = ParseChecksums(http.Header(part.Header))
+			if err == nil && cfg.Checksums.IsEmpty() {
+				cfg.Checksums, err = ParseChecksums(r.Header)
+			}
+			if err != nil {
+				SendHttpJsonError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			// bucket and key are already known, stream the file directly to
+			// the storage, otherwise spool it to disk until the form is read
+			if cfg.BucketID != "" && cfg.Key != "" {
+				cfg.Reader = part
+				o, err = saveUploadedObject(r, cfg, typ)
+			} else {
+				spool, err = spoolPart(part)
+			}
+			if err != nil {
+				sendSaveError(w, err)
+				return
+			}
+		}
+		part.Close()
+	}
 
-	b := r.FormValue("bucket")
-	if b == "" {
-		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("bucket name is required"))
+	if o == nil && spool == nil {
+		SendHttpJsonError(w, http.StatusBadRequest, http.ErrMissingFile)
 		return
 	}
+	if o == nil {
+		if cfg.BucketID == "" {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("bucket name is required"))
+			return
+		}
+		cfg.Reader = spool
+		o, err = saveUploadedObject(r, cfg, typ)
+		if err != nil {
+			sendSaveError(w, err)
+			return
+		}
+	}
 
-	k := r.FormValue("key")
-	if k == "" {
-		k = h.Filename
+	SendJson(w, http.StatusOK, Payload{
+		"message": "object created",
+		"uuid":    o.UUID,
+		"sha256":  o.SHA256,
+		"md5":     o.MD5,
+	})
+}
+
+func sendSaveError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		return SendHttpJsonError(w, http.StatusBadRequest, err)
+	case errors.Is(err, ErrCustomerKeyRequired), errors.Is(err, ErrCustomerKeyMismatch):
+		return sendCustomerKeyError(w, err)
+	case errors.Is(err, ErrTypeNotAllowed), errors.Is(err, ErrQuotaExceeded):
+		return SendHttpJsonError(w, http.StatusForbidden, err)
+	case errors.Is(err, ErrObjectTooLarge):
+		return SendHttpJsonError(w, http.StatusRequestEntityTooLarge, err)
+	case errors.Is(err, ErrBucketDeleting):
+		return SendHttpJsonError(w, http.StatusConflict, err)
 	}
+	return SendAccessError(w, err)
+}
+
+// wrong keys are forbidden, missing or malformed ones are bad requests
+func sendCustomerKeyError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, ErrCustomerKeyMismatch) {
+		return SendHttpJsonError(w, http.StatusForbidden, err)
+	}
+	return SendHttpJsonError(w, http.StatusBadRequest, err)
+}
 
-	cfg := &SaveConfig{
-		BucketID: b,
-		Reader:   f,
-		Key:      k,
+func saveUploadedObject(r *http.Request, cfg *SaveConfig, typ string) (*Object, error) {
+	if _, err := AuthorizeBucket(r, cfg.BucketID, PermissionWrite); err != nil {
+		return nil, err
 	}
+
 	o := &Object{
 		Type: typ,
 	}
-
 	if _, err := o.Save(cfg); err != nil {
-		SendHttpJsonError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
+	return o, nil
+}
 
-	SendJson(w, http.StatusOK, Payload{
-		"message": "object created",
-		"uuid":    o.UUID,
-	})
+// write multipart file part into a temp file and rewind it for reading
+func spoolPart(part io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, part); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
 }
 
-func HandleObjectFetch(w http.ResponseWriter, r *http.Request) {
-	if IsProduction() {
-		SendHttpJsonError(w, http.StatusUnauthorized, errors.New("access is not allowed"))
-		return
+func readFormValue(part io.Reader) (string, error) {
+	v, err := ioutil.ReadAll(io.LimitReader(part, 1024))
+	if err != nil {
+		return "", err
 	}
+	return string(v), nil
+}
 
+func HandleObjectFetch(w http.ResponseWriter, r *http.Request) {
 	uuid := mux.Vars(r)["uuid"]
 	if uuid == "" {
 		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("uuid is required"))
 		return
 	}
 
-	o, err := FetchObject(uuid)
+	o, err := AuthorizeObject(r, uuid, PermissionRead)
 	if err != nil {
-		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		SendAccessError(w, err)
 		return
 	}
 
@@ -90,6 +217,11 @@ func HandleObjectDeletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := AuthorizeObject(r, uuid, PermissionWrite); err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
 	if err := DeleteObject(uuid); err != nil {
 		SendHttpJsonError(w, http.StatusInternalServerError, err)
 		return
@@ -114,47 +246,234 @@ func HandleGeneratingSharableLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	o, err := FetchObject(uuid)
+	o, err := AuthorizeObject(r, uuid, PermissionRead)
 	if err != nil {
-		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		SendAccessError(w, err)
+		return
+	}
+
+	// only holders of the customer key can share the object, the link still
+	// needs the key to be sent when it's used
+	if o.CustomerKeySHA256 != "" {
+		key, err := ParseCustomerKey(r.Header)
+		if err == nil {
+			err = o.CheckCustomerKey(key)
+		}
+		if err != nil {
+			sendCustomerKeyError(w, err)
+			return
+		}
+	}
+
+	// stateless link signed with server secret, no session is stored
+	if r.URL.Query().Get("mode") == "signed" {
+		m := r.URL.Query().Get("method")
+		if m == "" {
+			m = http.MethodGet
+		}
+		l, exp, err := o.GenerateSignedLink(time.Duration(ttl), m)
+		if err != nil {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		SendJson(w, http.StatusOK, Payload{
+			"url":       l,
+			"uuid":      o.UUID,
+			"method":    m,
+			"expire_at": exp.Format(time.RFC3339),
+		})
 		return
 	}
 
+	// body is optional, it only carries the session label and metadata
+	var payload sharePayload
+	if r.ContentLength != 0 {
+		if err := ParseAndValidate(r, &payload); err != nil {
+			SendValidationError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
 	l, s, err := o.GenerateSharableLink(&ObjectShare{
-		TTL: time.Duration(ttl),
+		TTL:          time.Duration(ttl),
+		Label:        payload.Label,
+		Metadata:     payload.Metadata,
+		MaxDownloads: payload.MaxDownloads,
+		OneTime:      payload.OneTime,
+		AllowedCIDRs: payload.AllowedCIDRs,
+		Password:     payload.Password,
 	})
 	if err != nil {
 		SendHttpJsonError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	SendJson(w, http.StatusOK, Payload{
-		"url":        l,
+	p := sessionPayload(o, s)
+	p["url"] = l
+	SendJson(w, http.StatusOK, p)
+}
+
+type sharePayload struct {
+	Label        string                 `json:"label" validate:"max=256"`
+	Metadata     map[string]interface{} `json:"metadata"`
+	MaxDownloads int                    `json:"max_downloads" validate:"min=0"`
+	OneTime      bool                   `json:"one_time"`
+	AllowedCIDRs []string               `json:"allowed_cidrs" validate:"max=32,dive,cidr"`
+	Password     string                 `json:"password" validate:"omitempty,min=4,max=72"`
+}
+
+func sessionPayload(o *Object, s *ObjectSharingSession) Payload {
+	return Payload{
+		"session_id": s.ID,
 		"uuid":       s.OUUID,
+		"label":      s.Label,
+		"url":        o.SessionLink(o.BucketName, s),
 		"ttl":        s.TTL,
-		"session_id": s.ID,
+		"metadata":   s.Metadata,
+		"created_at": s.CreatedAt.Format(time.RFC3339),
 		"expire_at":  s.ExpiryDate.Format(time.RFC3339),
-	})
+		"expired":    s.CheckExpiration(),
+		"revoked_at": s.RevokedAt,
+
+		"max_downloads":      s.MaxDownloads,
+		"downloads":          s.Downloads,
+		"one_time":           s.OneTime,
+		"exhausted":          s.IsExhausted(),
+		"allowed_cidrs":      s.AllowedCIDRs,
+		"password_protected": s.HasPassword(),
+	}
+}
+
+func HandleObjectSessionsFetch(w http.ResponseWriter, r *http.Request) {
+	o, err := AuthorizeObject(r, mux.Vars(r)["uuid"], PermissionRead)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	ss, err := FetchObjectSessions(o.UUID)
+	if err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sessions := make([]Payload, 0, len(ss))
+	for i := range ss {
+		sessions = append(sessions, sessionPayload(o, &ss[i]))
+	}
+	SendJson(w, http.StatusOK, Payload{"sessions": sessions})
+}
+
+// Fetch object session, sessions of other objects are reported as missing
+func fetchObjectSession(r *http.Request, perm Permission) (*Object, *ObjectSharingSession, error) {
+	vars := mux.Vars(r)
+	o, err := AuthorizeObject(r, vars["uuid"], perm)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := FetchSession(vars["session"])
+	if err != nil {
+		return nil, nil, err
+	}
+	if bgs, _ := s.BelongToObj(o.UUID); !bgs {
+		return nil, nil, ErrRecordNotFound
+	}
+	return o, s, nil
+}
+
+func HandleObjectSessionFetch(w http.ResponseWriter, r *http.Request) {
+	o, s, err := fetchObjectSession(r, PermissionRead)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+	SendJson(w, http.StatusOK, sessionPayload(o, s))
+}
+
+func HandleObjectSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	o, s, err := fetchObjectSession(r, PermissionWrite)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := s.Revoke(); err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	p := sessionPayload(o, s)
+	p["message"] = "session revoked"
+	SendJson(w, http.StatusOK, p)
 }
 
 func HandleServingRequestedObject(w http.ResponseWriter, r *http.Request) {
-	uuid := mux.Vars(r)["uuid"]
-	session := r.URL.Query().Get("session")
+	vars := mux.Vars(r)
+	uuid := vars["uuid"]
+	q := r.URL.Query()
+	session := q.Get("session")
 
-	if uuid == "" || session == "" {
+	if uuid == "" || (session == "" && !IsSignedLink(q)) {
 		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("uuid and session are required"))
 		return
 	}
 
 	uuid = NameWithoutExt(uuid) //remove extension from uuid
-	f, err := ServeObject(uuid, session)
+
+	// objects open in the browser unless asked to be downloaded
+	disp := q.Get("disposition")
+	if disp == "" {
+		disp = DispositionInline
+	}
+	if disp != DispositionInline && disp != DispositionAttachment {
+		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("disposition must be inline or attachment"))
+		return
+	}
+
+	key, err := ParseCustomerKey(r.Header)
 	if err != nil {
-		if errors.Is(err, ErrSessionExpired) {
+		SendHttpJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t, err := ParseImageTransform(q)
+	if err != nil {
+		SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	var f *ServedFile
+	acc := sessionAccess(r)
+	acc.CustomerKey = key
+	acc.Transform = t
+	if IsSignedLink(q) {
+		f, err = ServeSignedObject(r.Method, vars["bucket"], uuid, q, acc)
+	} else {
+		f, err = ServeObject(uuid, session, acc)
+	}
+	if err != nil {
+		if errors.Is(err, ErrSessionExpired) || errors.Is(err, ErrSessionRevoked) ||
+			errors.Is(err, ErrSessionExhausted) || errors.Is(err, ErrSessionIPDenied) ||
+			errors.Is(err, ErrSignatureExpired) || errors.Is(err, ErrSignatureInvalid) {
 			SendHttpJsonError(w, http.StatusForbidden, err)
 			return
+		} else if errors.Is(err, ErrSessionPassword) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="shared object"`)
+			SendHttpJsonError(w, http.StatusUnauthorized, err)
+			return
 		} else if errors.Is(err, ErrSessionNotFound) {
 			SendHttpJsonError(w, http.StatusUnauthorized, err)
 			return
+		} else if errors.Is(err, ErrCustomerKeyInvalid) || errors.Is(err, ErrCustomerKeyRequired) ||
+			errors.Is(err, ErrCustomerKeyMismatch) {
+			sendCustomerKeyError(w, err)
+			return
+		} else if errors.Is(err, ErrImageUnsupported) {
+			SendHttpJsonError(w, http.StatusUnsupportedMediaType, err)
+			return
+		} else if errors.Is(err, ErrImageTooLarge) {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
 		}
 		SendHttpJsonError(w, http.StatusInternalServerError, err)
 		return
@@ -162,9 +481,43 @@ func HandleServingRequestedObject(w http.ResponseWriter, r *http.Request) {
 
 	defer f.Close()
 
+	// browsers must not guess another type than the one stored
 	w.Header().Set("Content-Type", f.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", ContentDisposition(disp, f.Filename))
+	if f.ETag != "" {
+		w.Header().Set("ETag", f.ETag)
+	}
+	if f.VaryEncoding {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if f.Encoding != "" {
+		w.Header().Set("Content-Encoding", f.Encoding)
+	}
 
-	http.ServeContent(w, r, f.Name(), time.Time{}, f.File)
+	http.ServeContent(w, r, f.Name(), f.ModTime, f.File)
+}
+
+// Session restrictions input, password is sent with X-Share-Password header
+// or as basic auth password so browsers can prompt for it
+func sessionAccess(r *http.Request) *SessionAccess {
+	acc := &SessionAccess{
+		Password:        r.Header.Get("X-Share-Password"),
+		IfNoneMatch:     r.Header.Get("If-None-Match"),
+		IfModifiedSince: r.Header.Get("If-Modified-Since"),
+		AcceptEncoding:  r.Header.Get("Accept-Encoding"),
+	}
+	if _, p, ok := r.BasicAuth(); ok && acc.Password == "" {
+		acc.Password = p
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		acc.IP = net.ParseIP(host)
+	}
+
+	// every GET serving bytes counts, range requests included, so limited
+	// sessions can't be read piece by piece past their max downloads
+	acc.Download = r.Method == http.MethodGet
+	return acc
 }
 
 func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
@@ -173,7 +526,7 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(MaxUploadLimit); err != nil {
+	if err := r.ParseMultipartForm(MaxMemoryLimit); err != nil {
 		SendHttpJsonError(w, http.StatusBadRequest, err)
 		return
 	}
@@ -192,16 +545,14 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// only the first 1024 bytes are echoed back
 	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, f); err != nil {
+	if _, err := io.Copy(&buf, io.LimitReader(f, 1024)); err != nil {
 		SendHttpJsonError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	c := buf.String()
-	if h.Size > 1024 {
-		c = c[:1024]
-	}
 
 	SendJson(w, http.StatusOK, Payload{
 		"message": "object uploaded",
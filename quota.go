@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BucketQuota limits what can be saved in a bucket, zero values don't limit
+type BucketQuota struct {
+	// total size of the bucket objects, every version counts
+	MaxBytes      int64 `bson:"max_bytes" json:"max_bytes" validate:"min=0"`
+	MaxObjects    int   `bson:"max_objects" json:"max_objects" validate:"min=0"`
+	MaxObjectSize int64 `bson:"max_object_size" json:"max_object_size" validate:"min=0"`
+	// content types ex: image/png, or a group of them ex: image/*, the global
+	// AllowedObjectTypes apply when empty
+	AllowedTypes []string `bson:"allowed_types" json:"allowed_types" validate:"max=100,dive,required,max=256"`
+}
+
+// BucketUsage is what the bucket objects take, delete markers aside. It's
+// kept apart from the bucket so bucket updates don't overwrite it.
+type BucketUsage struct {
+	mgm.DefaultModel `bson:",inline" json:"-"`
+	Bucket           string `json:"-"`
+	// content size, quotas apply to it
+	Bytes int64 `json:"bytes"`
+	// size of the files once compressed and encrypted
+	StoredBytes int64 `bson:"stored_bytes" json:"stored_bytes"`
+	Objects     int   `json:"objects"`
+}
+
+func (u *BucketUsage) CreateIndex() error {
+	col := mgm.Coll(u)
+	_, err := col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.M{"bucket": 1},
+		Options: options.MergeIndexOptions(
+			options.Index().SetUnique(true),
+			options.Index().SetName("bucket"),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+var (
+	ErrTypeNotAllowed = errors.New("file type is not allowed")
+	ErrObjectTooLarge = errors.New("object is larger than the bucket allows")
+	ErrQuotaExceeded  = errors.New("bucket quota exceeded")
+)
+
+// Replace bucket quota, it only applies to objects saved from now on
+func (b *Bucket) SetQuota(q BucketQuota) error {
+	b.Quota = q
+	return Metadata().UpdateBucket(b)
+}
+
+// Check if objects of content type t can be saved in the bucket
+func (b *Bucket) AllowsType(t string) bool {
+	if len(b.Quota.AllowedTypes) == 0 {
+		return CheckType(t)
+	}
+	for _, p := range b.Quota.AllowedTypes {
+		if matchContentType(p, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that an object can be saved under key in the bucket before receiving
+// it, size is -1 when it isn't known yet. Saving still checks the quota since
+// other objects can be saved meanwhile.
+func (b *Bucket) CheckUpload(key string, size int64, typ string) error {
+	if b.Deleting {
+		return ErrBucketDeleting
+	}
+	if !b.AllowsType(typ) {
+		return ErrTypeNotAllowed
+	}
+	replaced, err := b.replacedUsage(key)
+	if err != nil {
+		return err
+	}
+	u, err := b.usageReplacing(replaced)
+	if err != nil {
+		return err
+	}
+	limit, lerr := b.sizeLimit(u)
+	if lerr != nil {
+		return lerr
+	}
+	switch {
+	case size < 0 || limit < 0 || size <= limit:
+		return nil
+	case b.Quota.MaxObjectSize > 0 && size > b.Quota.MaxObjectSize:
+		return ErrObjectTooLarge
+	}
+	return ErrQuotaExceeded
+}
+
+// How many bytes a new object can take given bucket usage, -1 for no limit
+func (b *Bucket) sizeLimit(u *BucketUsage) (int64, error) {
+	q := &b.Quota
+	if q.MaxObjects > 0 && u.Objects >= q.MaxObjects {
+		return 0, ErrQuotaExceeded
+	}
+	limit := int64(-1)
+	if q.MaxObjectSize > 0 {
+		limit = q.MaxObjectSize
+	}
+	if q.MaxBytes > 0 {
+		left := q.MaxBytes - u.Bytes
+		if left < 0 {
+			left = 0
+		}
+		if limit < 0 || left < limit {
+			limit = left
+		}
+	}
+	return limit, nil
+}
+
+// Usage of the null versions saving key replaces, nothing is replaced in
+// versioned buckets or without a key
+func (b *Bucket) replacedUsage(key string) (*BucketUsage, error) {
+	u := &BucketUsage{Bucket: b.Name}
+	if b.Versioning || CleanKey(key) == "" {
+		return u, nil
+	}
+	vs, err := FetchObjectVersions(b.Name, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vs {
+		if !v.Versioned && !v.DeleteMarker {
+			u.Bytes += int64(v.Size)
+			u.StoredBytes += v.StoredBytes()
+			u.Objects++
+		}
+	}
+	return u, nil
+}
+
+// Bucket usage once the replaced objects are removed
+func (b *Bucket) usageReplacing(replaced *BucketUsage) (*BucketUsage, error) {
+	u, err := FetchBucketUsage(b)
+	if err != nil {
+		return nil, err
+	}
+	left := *u
+	left.Bytes -= replaced.Bytes
+	left.StoredBytes -= replaced.StoredBytes
+	left.Objects -= replaced.Objects
+	return &left, nil
+}
+
+// Reader of a new object replacing the replaced objects failing once it
+// goes over the bucket quota
+func (b *Bucket) quotaReader(r io.Reader, replaced *BucketUsage) (io.Reader, error) {
+	u, err := b.usageReplacing(replaced)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := b.sizeLimit(u)
+	if err != nil || limit < 0 {
+		return r, err
+	}
+	err = ErrQuotaExceeded
+	if b.Quota.MaxObjectSize > 0 && limit == b.Quota.MaxObjectSize {
+		err = ErrObjectTooLarge
+	}
+	return &limitedReader{r: r, n: limit, err: err}, nil
+}
+
+// limitedReader fails with err as soon as more than n bytes are read
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		return n, r.err
+	}
+	return n, err
+}
+
+// Fetch bucket usage, buckets created before usage was kept get it counted
+// from their objects
+func FetchBucketUsage(b *Bucket) (*BucketUsage, error) {
+	u, err := Metadata().FetchBucketUsage(b.Name)
+	if err == ErrRecordNotFound {
+		return RecountBucketUsage(b)
+	}
+	return u, err
+}
+
+// Count bucket usage from its objects and store it
+func RecountBucketUsage(b *Bucket) (*BucketUsage, error) {
+	obs, err := FetchBucketObjects(b)
+	if err != nil {
+		return nil, err
+	}
+	u := &BucketUsage{Bucket: b.Name}
+	for _, o := range obs {
+		if !o.DeleteMarker {
+			u.Bytes += int64(o.Size)
+			u.StoredBytes += o.StoredBytes()
+			u.Objects++
+		}
+	}
+	if err := Metadata().PutBucketUsage(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Add a saved object to bucket usage, it fails when the object doesn't fit in
+// the quota anymore because of objects saved meanwhile. The replaced objects
+// are released once they are removed, until then the quota is raised by them.
+func reserveUsage(b *Bucket, size int64, stored int64, replaced *BucketUsage) error {
+	if _, err := FetchBucketUsage(b); err != nil {
+		return err
+	}
+	q := b.Quota
+	if q.MaxBytes > 0 {
+		q.MaxBytes += replaced.Bytes
+	}
+	if q.MaxObjects > 0 {
+		q.MaxObjects += replaced.Objects
+	}
+	err := Metadata().AddBucketUsage(b.Name, size, stored, 1, &q)
+	if err == ErrRecordNotFound {
+		return ErrQuotaExceeded
+	}
+	return err
+}
+
+// Remove a deleted object from bucket usage, usage left off is fixed by
+// recounting so failing here is only logged
+func releaseUsage(bucket string, size int64, stored int64) {
+	if err := Metadata().AddBucketUsage(bucket, -size, -stored, -1, nil); err != nil && err != ErrRecordNotFound {
+		log.Printf("usage of bucket %s not updated: %v\n", bucket, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Bucket quota along with what the bucket currently uses
+func HandleBucketQuotaFetch(w http.ResponseWriter, r *http.Request) {
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionRead)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	u, err := FetchBucketUsage(b)
+	if err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	SendJson(w, http.StatusOK, Payload{
+		"quota": b.Quota,
+		"usage": u,
+	})
+}
+
+// Replace bucket quota, zero values remove a limit
+func HandleBucketQuota(w http.ResponseWriter, r *http.Request) {
+	var payload BucketQuota
+	if err := ParseAndValidate(r, &payload); err != nil {
+		SendValidationError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	defer r.Body.Close()
+
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionAdmin)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := b.SetQuota(payload); err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"message": "bucket quota updated",
+		"quota":   b.Quota,
+	})
+}
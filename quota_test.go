@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func saveTypedObject(b *Bucket, key, typ, content string) (*Object, error) {
+	o := &Object{Type: typ}
+	_, err := SaveObject(o, &SaveConfig{
+		BucketID: b.Name,
+		Reader:   strings.NewReader(content),
+		Key:      key,
+	})
+	return o, err
+}
+
+func TestBucketAllowsType(t *testing.T) {
+	b := &Bucket{}
+	if !b.AllowsType("image/png") || b.AllowsType("application/x-msdownload") {
+		t.Error("global types not applied without bucket types")
+	}
+	b.Quota.AllowedTypes = []string{"image/*", "application/pdf"}
+	tests := []struct {
+		typ  string
+		want bool
+	}{
+		{"image/jpeg", true},
+		{"IMAGE/PNG", true},
+		{"application/pdf; charset=binary", true},
+		{"application/pdfx", false},
+		{"video/mp4", false},
+	}
+	for _, tt := range tests {
+		if got := b.AllowsType(tt.typ); got != tt.want {
+			t.Errorf("%s: got %v", tt.typ, got)
+		}
+	}
+}
+
+func TestBucketCheckUpload(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	if err := b.SetQuota(BucketQuota{MaxBytes: 10, MaxObjectSize: 6, AllowedTypes: []string{"image/*"}}); err != nil {
+		t.Fatal(err)
+	}
+	saveTestObject(t, b, "a.png", "abcde")
+
+	tests := []struct {
+		size int64
+		typ  string
+		err  error
+	}{
+		{5, "image/png", nil},
+		{-1, "image/png", nil},
+		{1, "video/mp4", ErrTypeNotAllowed},
+		{7, "image/png", ErrObjectTooLarge},
+		{6, "image/png", ErrQuotaExceeded},
+	}
+	for _, tt := range tests {
+		if err := b.CheckUpload("", tt.size, tt.typ); err != tt.err {
+			t.Errorf("%d bytes of %s: got %v, want %v", tt.size, tt.typ, err, tt.err)
+		}
+	}
+
+	b.Quota.MaxObjects = 1
+	if err := b.CheckUpload("", 1, "image/png"); err != ErrQuotaExceeded {
+		t.Errorf("got %v over max objects", err)
+	}
+}
+
+func TestSaveObjectQuota(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	if err := b.SetQuota(BucketQuota{MaxBytes: 10, MaxObjects: 2, MaxObjectSize: 6}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := saveTypedObject(b, "a.exe", "application/x-msdownload", "a"); !errors.Is(err, ErrTypeNotAllowed) {
+		t.Errorf("got %v, want type not allowed", err)
+	}
+	if _, err := saveTypedObject(b, "big.png", "image/png", "1234567"); !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("got %v, want too large", err)
+	}
+	if _, err := saveTypedObject(b, "a.png", "image/png", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveTypedObject(b, "b.png", "image/png", "12345"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("got %v over max bytes", err)
+	}
+	second, err := saveTypedObject(b, "b.png", "image/png", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveTypedObject(b, "c.png", "image/png", "1"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("got %v over max objects", err)
+	}
+	if ok, _ := Storage().Exists("photos/c.png"); ok {
+		t.Error("file of rejected object kept")
+	}
+
+	u, err := FetchBucketUsage(b)
+	if err != nil || u.Bytes != 10 || u.Objects != 2 {
+		t.Errorf("got usage %+v, %v", u, err)
+	}
+
+	// overwriting a key at the quota only needs room for the difference
+	if _, err := saveTypedObject(b, "a.png", "image/png", "654321"); err != nil {
+		t.Fatalf("same size overwrite at the quota got %v", err)
+	}
+	if _, err := saveTypedObject(b, "a.png", "image/png", "7654321"); !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("got %v over max object size", err)
+	}
+	if err := b.CheckUpload("a.png", 6, "image/png"); err != nil {
+		t.Errorf("checking an overwrite at the quota got %v", err)
+	}
+	u, _ = FetchBucketUsage(b)
+	if u.Bytes != 10 || u.Objects != 2 {
+		t.Errorf("got usage %+v after overwriting", u)
+	}
+
+	// deleted and replaced objects are released, the replaced one once the
+	// new one is saved
+	if err := DeleteObject(second.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveTypedObject(b, "a.png", "image/png", "12"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = FetchBucketUsage(b)
+	if u.Bytes != 2 || u.Objects != 1 {
+		t.Errorf("got usage %+v", u)
+	}
+}
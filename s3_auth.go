@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm        = "AWS4-HMAC-SHA256"
+	sigV4ChunkAlgorithm   = "AWS4-HMAC-SHA256-PAYLOAD"
+	sigV4TimeFormat       = "20060102T150405Z"
+	sigV4MaxSkew          = 15 * time.Minute
+	sigV4MaxPresignExpiry = 7 * 24 * 60 * 60
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3SecretLookup returns the secret key of the givin access key
+type S3SecretLookup func(accessKey string) (string, error)
+
+var ErrUnknownAccessKey = errors.New("unknown access key")
+
+// signed request data extracted from Authorization header or presigned query
+type sigV4Request struct {
+	accessKey     string
+	scope         string // 20130524/us-east-1/s3/aws4_request
+	date          string // 20130524
+	region        string
+	service       string
+	amzDate       string // 20130524T000000Z
+	signedHeaders []string
+	signature     string
+	presigned     bool
+	expires       int64
+}
+
+// VerifySigV4 authenticates r using AWS Signature Version 4, either from the
+// Authorization header or presigned url query, and returns the access key.
+// The request body is wrapped so its payload hash, or chunk signatures for
+// aws-chunked uploads, are verified while it's being read
+func VerifySigV4(r *http.Request, lookup S3SecretLookup) (string, error) {
+	sr, err := parseSigV4(r)
+	if err != nil {
+		return "", err
+	}
+
+	t, err := time.Parse(sigV4TimeFormat, sr.amzDate)
+	if err != nil || sr.amzDate[:8] != sr.date {
+		return "", errS3MalformedAuth
+	}
+	now := time.Now().UTC()
+	if sr.presigned {
+		if now.Before(t.Add(-sigV4MaxSkew)) || now.After(t.Add(time.Duration(sr.expires)*time.Second)) {
+			return "", errS3ExpiredRequest
+		}
+	} else if now.Sub(t) > sigV4MaxSkew || t.Sub(now) > sigV4MaxSkew {
+		return "", errS3TimeTooSkewed
+	}
+
+	secret, err := lookup(sr.accessKey)
+	if err != nil {
+		if err == ErrUnknownAccessKey || err == ErrRecordNotFound {
+			return "", errS3InvalidAccessKey
+		}
+		return "", err
+	}
+
+	payload := unsignedPayload
+	if !sr.presigned {
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+		if payload == "" {
+			return "", errS3MissingContentSHA256
+		}
+	}
+
+	key := sigV4SigningKey(secret, sr.date, sr.region, sr.service)
+	creq := canonicalRequest(r, sr, payload)
+	sts := strings.Join([]string{
+		sigV4Algorithm,
+		sr.amzDate,
+		sr.scope,
+		hexSHA256([]byte(creq)),
+	}, "\n")
+	sig := hex.EncodeToString(hmacSHA256(key, []byte(sts)))
+	if !hmac.Equal([]byte(sig), []byte(sr.signature)) {
+		return "", errS3SignatureMismatch
+	}
+
+	switch payload {
+	case unsignedPayload:
+	case streamingPayload, streamingPayloadTrailer, streamingUnsignedTrailer:
+		cr := &awsChunkedReader{
+			body:   bufio.NewReader(r.Body),
+			closer: r.Body,
+			signed: payload != streamingUnsignedTrailer,
+			key:    key,
+			date:   sr.amzDate,
+			scope:  sr.scope,
+			prev:   sig,
+			hash:   sha256.New(),
+		}
+		cr.checksum, cr.trailer = trailerChecksum(r.Header.Get("X-Amz-Trailer"))
+		r.Body = cr
+		if l, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			r.ContentLength = l
+		}
+	default:
+		if _, err := hex.DecodeString(payload); err != nil || len(payload) != sha256.Size*2 {
+			return "", errS3InvalidContentSHA256
+		}
+		r.Body = &hashVerifyReader{
+			ReadCloser: r.Body,
+			hash:       sha256.New(),
+			want:       payload,
+		}
+	}
+	return sr.accessKey, nil
+}
+
+func parseSigV4(r *http.Request) (*sigV4Request, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != "" {
+		return parsePresignedSigV4(q)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errS3AccessDenied
+	}
+	if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		return nil, errS3UnsupportedAuth
+	}
+
+	sr := &sigV4Request{}
+	for _, f := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm), ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, errS3MalformedAuth
+		}
+		switch kv[0] {
+		case "Credential":
+			if err := sr.parseCredential(kv[1]); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			sr.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			sr.signature = kv[1]
+		}
+	}
+	if sr.signature == "" || len(sr.signedHeaders) == 0 {
+		return nil, errS3MalformedAuth
+	}
+
+	sr.amzDate = r.Header.Get("X-Amz-Date")
+	if sr.amzDate == "" {
+		// fallback to Date header in http format
+		t, err := http.ParseTime(r.Header.Get("Date"))
+		if err != nil {
+			return nil, errS3MalformedAuth
+		}
+		sr.amzDate = t.UTC().Format(sigV4TimeFormat)
+	}
+	return sr, nil
+}
+
+func parsePresignedSigV4(q url.Values) (*sigV4Request, error) {
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, errS3UnsupportedAuth
+	}
+	sr := &sigV4Request{
+		presigned:     true,
+		amzDate:       q.Get("X-Amz-Date"),
+		signedHeaders: strings.Split(q.Get("X-Amz-SignedHeaders"), ";"),
+		signature:     q.Get("X-Amz-Signature"),
+	}
+	if err := sr.parseCredential(q.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	exp, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || exp < 0 || exp > sigV4MaxPresignExpiry {
+		return nil, errS3MalformedAuth
+	}
+	sr.expires = exp
+	if sr.signature == "" || sr.amzDate == "" {
+		return nil, errS3MalformedAuth
+	}
+	return sr, nil
+}
+
+// parse <access-key>/<date>/<region>/<service>/aws4_request
+func (sr *sigV4Request) parseCredential(c string) error {
+	parts := strings.Split(c, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || parts[3] != "s3" {
+		return errS3MalformedAuth
+	}
+	sr.accessKey = parts[0]
+	sr.date = parts[1]
+	sr.region = parts[2]
+	sr.service = parts[3]
+	sr.scope = strings.Join(parts[1:], "/")
+	return nil
+}
+
+func canonicalRequest(r *http.Request, sr *sigV4Request, payload string) string {
+	var headers strings.Builder
+	for _, h := range sr.signedHeaders {
+		headers.WriteString(h)
+		headers.WriteByte(':')
+		headers.WriteString(canonicalHeaderValue(r, h))
+		headers.WriteByte('\n')
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.RawQuery, sr.presigned),
+		headers.String(),
+		strings.Join(sr.signedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+func canonicalHeaderValue(r *http.Request, h string) string {
+	var vs []string
+	switch h {
+	case "host":
+		vs = []string{r.Host}
+	case "content-length":
+		vs = []string{strconv.FormatInt(r.ContentLength, 10)}
+		if v := r.Header.Get("Content-Length"); v != "" {
+			vs = []string{v}
+		}
+	case "transfer-encoding":
+		vs = r.TransferEncoding
+	default:
+		vs = r.Header.Values(h)
+	}
+	trimmed := make([]string, len(vs))
+	for i, v := range vs {
+		trimmed[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+func canonicalQuery(raw string, presigned bool) string {
+	q, _ := url.ParseQuery(raw)
+	var pairs []string
+	for k, vs := range q {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// URI encode every byte except the unreserved characters, slash is kept
+// as is in paths
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func sigV4SigningKey(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	k = hmacSHA256(k, []byte(region))
+	k = hmacSHA256(k, []byte(service))
+	return hmacSHA256(k, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// hashVerifyReader fails the read at EOF if the body doesn't match the
+// signed payload hash
+type hashVerifyReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+}
+
+func (r *hashVerifyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.want {
+		return n, errS3ContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes aws-chunked request bodies, each chunk looks like
+//
+//	<hex-size>[;chunk-signature=<sig>]\r\n<data>\r\n
+//
+// and the last one has zero size optionally followed by trailing headers.
+// Chunk signatures are chained starting from the request seed signature,
+// trailing checksum is verified when the algorithm is supported
+type awsChunkedReader struct {
+	body   *bufio.Reader
+	closer io.Closer
+
+	signed bool
+	key    []byte
+	date   string
+	scope  string
+	prev   string
+
+	hash      hash.Hash // current chunk hash
+	sig       string    // current chunk signature
+	remaining int64
+	done      bool
+
+	checksum hash.Hash
+	trailer  string
+}
+
+func (r *awsChunkedReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	if r.remaining == 0 {
+		if err := r.nextChunk(); err != nil {
+			return 0, err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.body.Read(p)
+	r.remaining -= int64(n)
+	r.hash.Write(p[:n])
+	if r.checksum != nil {
+		r.checksum.Write(p[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if r.remaining == 0 {
+		if err := r.endChunk(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *awsChunkedReader) Close() error {
+	return r.closer.Close()
+}
+
+func (r *awsChunkedReader) readLine() (string, error) {
+	l, err := r.body.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(l, "\r\n"), nil
+}
+
+func (r *awsChunkedReader) nextChunk() error {
+	l, err := r.readLine()
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(l, ";", 2)
+	size, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 16, 64)
+	if err != nil || size < 0 {
+		return errS3InvalidChunk
+	}
+	r.sig = ""
+	if len(parts) == 2 {
+		r.sig = strings.TrimPrefix(parts[1], "chunk-signature=")
+	}
+	r.remaining = size
+	r.hash.Reset()
+
+	if size == 0 {
+		if err := r.verifyChunk(); err != nil {
+			return err
+		}
+		r.done = true
+		return r.readTrailers()
+	}
+	return nil
+}
+
+func (r *awsChunkedReader) endChunk() error {
+	if l, err := r.readLine(); err != nil {
+		return err
+	} else if l != "" {
+		return errS3InvalidChunk
+	}
+	return r.verifyChunk()
+}
+
+func (r *awsChunkedReader) verifyChunk() error {
+	if !r.signed {
+		return nil
+	}
+	sts := strings.Join([]string{
+		sigV4ChunkAlgorithm,
+		r.date,
+		r.scope,
+		r.prev,
+		emptySHA256,
+		hex.EncodeToString(r.hash.Sum(nil)),
+	}, "\n")
+	sig := hex.EncodeToString(hmacSHA256(r.key, []byte(sts)))
+	if !hmac.Equal([]byte(sig), []byte(r.sig)) {
+		return errS3SignatureMismatch
+	}
+	r.prev = sig
+	return nil
+}
+
+// read trailing headers until the empty line, only the checksum trailer is
+// verified, trailer signature isn't
+func (r *awsChunkedReader) readTrailers() error {
+	for {
+		l, err := r.readLine()
+		if err == io.ErrUnexpectedEOF && l == "" {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if l == "" {
+			break
+		}
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 || r.checksum == nil || !strings.EqualFold(kv[0], r.trailer) {
+			continue
+		}
+		want := strings.TrimSpace(kv[1])
+		if base64.StdEncoding.EncodeToString(r.checksum.Sum(nil)) != want {
+			return errS3BadDigest
+		}
+	}
+	return nil
+}
+
+func trailerChecksum(trailer string) (hash.Hash, string) {
+	trailer = strings.ToLower(strings.TrimSpace(trailer))
+	switch trailer {
+	case "x-amz-checksum-crc32":
+		return crc32.NewIEEE(), trailer
+	case "x-amz-checksum-crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), trailer
+	case "x-amz-checksum-sha1":
+		return sha1.New(), trailer
+	case "x-amz-checksum-sha256":
+		return sha256.New(), trailer
+	}
+	return nil, trailer
+}
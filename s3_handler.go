@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	S3PathPrefix = "/s3"
+
+	s3Namespace   = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys     = 1000
+	s3TimeFormat  = "2006-01-02T15:04:05.000Z"
+	s3DefaultType = "binary/octet-stream"
+)
+
+// S3Error is sent back as an XML error document
+type S3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return e.Message
+}
+
+var (
+	errS3AccessDenied          = &S3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKey      = &S3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key Id you provided does not exist in our records"}
+	errS3SignatureMismatch     = &S3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	errS3TimeTooSkewed         = &S3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	errS3ExpiredRequest        = &S3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errS3MalformedAuth         = &S3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	errS3UnsupportedAuth       = &S3Error{http.StatusBadRequest, "InvalidRequest", "Only AWS4-HMAC-SHA256 signatures are supported"}
+	errS3MissingContentSHA256  = &S3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+	errS3InvalidContentSHA256  = &S3Error{http.StatusBadRequest, "InvalidArgument", "x-amz-content-sha256 must be UNSIGNED-PAYLOAD, STREAMING-* or a valid sha256 value"}
+	errS3ContentSHA256Mismatch = &S3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	errS3InvalidChunk          = &S3Error{http.StatusBadRequest, "IncompleteBody", "The aws-chunked request body is malformed"}
+	errS3BadDigest             = &S3Error{http.StatusBadRequest, "BadDigest", "The checksum you specified did not match what we received"}
+	errS3InvalidDigest         = &S3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 or checksum value that you specified is not valid"}
+	errS3InvalidTag            = &S3Error{http.StatusBadRequest, "InvalidTag", "The tag provided was not a valid tag"}
+	errS3InvalidBucketName     = &S3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"}
+	errS3InvalidArgument       = &S3Error{http.StatusBadRequest, "InvalidArgument", "Invalid Argument"}
+	errS3NoSuchBucket          = &S3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errS3NoSuchKey             = &S3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errS3BucketExists          = &S3Error{http.StatusConflict, "BucketAlreadyExists", "The requested bucket name is not available"}
+	errS3BucketNotEmpty        = &S3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	errS3TypeNotAllowed        = &S3Error{http.StatusForbidden, "AccessDenied", "file type is not allowed"}
+	errS3EntityTooLarge        = &S3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size"}
+	errS3QuotaExceeded         = &S3Error{http.StatusForbidden, "QuotaExceeded", "Bucket quota exceeded"}
+	errS3CustomerKeyRequired   = &S3Error{http.StatusBadRequest, "InvalidRequest", "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object."}
+	errS3CustomerKeyInvalid    = &S3Error{http.StatusBadRequest, "InvalidArgument", "The secret key was invalid for the specified algorithm."}
+	errS3CustomerKeyMismatch   = &S3Error{http.StatusForbidden, "AccessDenied", "The provided encryption key does not match the key the object was stored with."}
+	errS3OperationAborted      = &S3Error{http.StatusConflict, "OperationAborted", "A conflicting conditional operation is currently in progress against this resource"}
+	errS3NotImplemented        = &S3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+	errS3NoSuchVersion         = &S3Error{http.StatusNotFound, "NoSuchVersion", "The specified version does not exist"}
+	errS3MethodNotAllowed      = &S3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+)
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func SendS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var se *S3Error
+	if !errors.As(err, &se) {
+		se = &S3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+	SendXml(w, se.Status, &s3ErrorResponse{
+		Code:     se.Code,
+		Message:  se.Message,
+		Resource: r.URL.Path,
+	})
+}
+
+func SendXml(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}
+
+// map storage errors into S3 errors
+func s3Err(err error) error {
+	switch {
+	case errors.Is(err, ErrBucketNotFound):
+		return errS3NoSuchBucket
+	case errors.Is(err, ErrBucketExists):
+		return errS3BucketExists
+	case errors.Is(err, ErrBucketNotEmpty):
+		return errS3BucketNotEmpty
+	case errors.Is(err, ErrAccessDenied):
+		return errS3AccessDenied
+	case errors.Is(err, ErrVersionNotFound):
+		return errS3NoSuchVersion
+	case errors.Is(err, ErrChecksumMismatch):
+		return errS3BadDigest
+	case errors.Is(err, ErrInvalidDigest):
+		return errS3InvalidDigest
+	case errors.Is(err, ErrTypeNotAllowed):
+		return errS3TypeNotAllowed
+	case errors.Is(err, ErrObjectTooLarge):
+		return errS3EntityTooLarge
+	case errors.Is(err, ErrQuotaExceeded):
+		return errS3QuotaExceeded
+	case errors.Is(err, ErrBucketDeleting):
+		return errS3OperationAborted
+	case errors.Is(err, ErrCustomerKeyRequired):
+		return errS3CustomerKeyRequired
+	case errors.Is(err, ErrCustomerKeyInvalid):
+		return errS3CustomerKeyInvalid
+	case errors.Is(err, ErrCustomerKeyMismatch):
+		return errS3CustomerKeyMismatch
+	}
+	return err
+}
+
+// MountS3 serves a subset of the S3 REST API (path style) under S3PathPrefix
+func MountS3(r *mux.Router) {
+	s := r.PathPrefix(S3PathPrefix).Subrouter()
+	s.Use(s3AuthMiddleware(apiKeySecret))
+
+	for _, p := range []string{"/{bucket}", "/{bucket}/"} {
+		s.HandleFunc(p, HandleS3PutBucketVersioning).Methods(http.MethodPut).Queries("versioning", "")
+		s.HandleFunc(p, HandleS3GetBucketVersioning).Methods(http.MethodGet).Queries("versioning", "")
+		s.HandleFunc(p, HandleS3CreateBucket).Methods(http.MethodPut)
+		s.HandleFunc(p, HandleS3DeleteBucket).Methods(http.MethodDelete)
+		s.HandleFunc(p, HandleS3HeadBucket).Methods(http.MethodHead)
+		s.HandleFunc(p, HandleS3ListObjects).Methods(http.MethodGet)
+	}
+
+	// multipart routes are matched by query so they go first
+	mountS3Multipart(s)
+
+	s.HandleFunc("/{bucket}/{key:.+}", Transfer(HandleS3PutObject)).Methods(http.MethodPut)
+	s.HandleFunc("/{bucket}/{key:.+}", Transfer(HandleS3GetObject)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/{bucket}/{key:.+}", HandleS3DeleteObject).Methods(http.MethodDelete)
+}
+
+// query parameters every request may carry, sdks send x-id=<Operation>
+// and presigned urls carry the signature
+func isS3CommonParam(k string) bool {
+	return k == "x-id" || strings.HasPrefix(k, "X-Amz-")
+}
+
+// reject requests with sub resources or options that are not supported
+// ex: ?acl, ?tagging or ?versionId
+func hasUnsupportedS3Params(r *http.Request, supported ...string) bool {
+	for k := range r.URL.Query() {
+		if isS3CommonParam(k) {
+			continue
+		}
+		ok := false
+		for _, s := range supported {
+			ok = ok || k == s
+		}
+		if !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func s3AuthMiddleware(lookup S3SecretLookup) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ak, err := VerifySigV4(r, lookup)
+			if err != nil {
+				SendS3Error(w, r, err)
+				return
+			}
+			k, err := FetchApiKey(ak)
+			if err != nil {
+				SendS3Error(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, WithPrincipal(r, k))
+		})
+	}
+}
+
+var s3BucketNameRgx = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+func HandleS3CreateBucket(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["bucket"]
+	if hasUnsupportedS3Params(r) {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+	if !s3BucketNameRgx.MatchString(name) {
+		SendS3Error(w, r, errS3InvalidBucketName)
+		return
+	}
+	// CreateBucketConfiguration isn't used, region is ignored
+	if _, err := io.Copy(io.Discard, io.LimitReader(r.Body, MaxMemoryLimit)); err != nil {
+		SendS3Error(w, r, err)
+		return
+	}
+
+	b := &Bucket{
+		Name: name,
+		Grants: []BucketGrant{
+			{AccessKey: Principal(r).AccessKey, Permission: PermissionAdmin},
+		},
+	}
+	if err := createBucket(b); err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	w.Header().Set("Location", "/"+name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func HandleS3DeleteBucket(w http.ResponseWriter, r *http.Request) {
+	if hasUnsupportedS3Params(r) {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+	b, err := AuthorizeBucket(r, mux.Vars(r)["bucket"], PermissionAdmin)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	if err := DeleteBucket(b); err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func HandleS3HeadBucket(w http.ResponseWriter, r *http.Request) {
+	if _, err := AuthorizeBucket(r, mux.Vars(r)["bucket"], PermissionRead); err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type s3LocationResponse struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+type s3ListResponse struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	Contents              []s3ObjectEntry  `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3ObjectEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag,omitempty"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func HandleS3ListObjects(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := mux.Vars(r)["bucket"]
+
+	b, err := AuthorizeBucket(r, name, PermissionRead)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	if _, ok := q["location"]; ok {
+		SendXml(w, http.StatusOK, &s3LocationResponse{Xmlns: s3Namespace})
+		return
+	}
+	if q.Get("list-type") != "2" || hasUnsupportedS3Params(r,
+		"list-type", "prefix", "delimiter", "max-keys", "continuation-token",
+		"start-after", "fetch-owner", "encoding-type") {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	res := &s3ListResponse{
+		Xmlns:             s3Namespace,
+		Name:              b.Name,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		MaxKeys:           s3MaxKeys,
+		ContinuationToken: q.Get("continuation-token"),
+		StartAfter:        q.Get("start-after"),
+	}
+	if v := q.Get("max-keys"); v != "" {
+		mk, err := strconv.Atoi(v)
+		if err != nil || mk < 0 {
+			SendS3Error(w, r, errS3InvalidArgument)
+			return
+		}
+		if mk < s3MaxKeys {
+			res.MaxKeys = mk
+		}
+	}
+	if res.MaxKeys == 0 {
+		SendXml(w, http.StatusOK, res)
+		return
+	}
+
+	l, err := ListBucketObjects(b, &ListOptions{
+		Prefix:     res.Prefix,
+		Delimiter:  res.Delimiter,
+		MaxKeys:    res.MaxKeys,
+		Token:      res.ContinuationToken,
+		StartAfter: res.StartAfter,
+	})
+	if err != nil {
+		if err == ErrInvalidListToken {
+			err = errS3InvalidArgument
+		}
+		SendS3Error(w, r, err)
+		return
+	}
+
+	for _, o := range l.Objects {
+		res.Contents = append(res.Contents, s3ObjectEntry{
+			Key:          o.Key,
+			LastModified: o.CreatedAt.UTC().Format(s3TimeFormat),
+			ETag:         o.S3ETag(),
+			Size:         o.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, cp := range l.CommonPrefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: cp})
+	}
+	res.KeyCount = l.KeyCount
+	res.IsTruncated = l.IsTruncated
+	res.NextContinuationToken = l.NextToken
+
+	SendXml(w, http.StatusOK, res)
+}
+
+func HandleS3PutObject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if hasUnsupportedS3Params(r) || r.Header.Get("X-Amz-Copy-Source") != "" {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	typ := r.Header.Get("Content-Type")
+	if typ == "" {
+		typ = s3DefaultType
+	}
+
+	sums, err := ParseChecksums(r.Header)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	tags, err := ParseTags(r.Header.Get("X-Amz-Tagging"))
+	if err != nil {
+		SendS3Error(w, r, errS3InvalidTag)
+		return
+	}
+	key, err := ParseS3CustomerKey(r.Header)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	b, err := AuthorizeBucket(r, vars["bucket"], PermissionWrite)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	if err := b.CheckUpload(vars["key"], -1, typ); err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadLimit)
+	o := &Object{Type: typ}
+	if _, err := o.Save(&SaveConfig{
+		BucketID:    vars["bucket"],
+		Reader:      r.Body,
+		Key:         vars["key"],
+		Checksums:   sums,
+		Tags:        tags,
+		CustomerKey: key,
+	}); err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	if o.Versioned {
+		w.Header().Set("X-Amz-Version-Id", o.UUID)
+	}
+	if key != nil {
+		w.Header().Set(S3CustomerAlgorithmHeader, "AES256")
+		w.Header().Set(S3CustomerKeyMD5Header, customerKeyMD5(key))
+	}
+	w.Header().Set("ETag", o.S3ETag())
+	w.WriteHeader(http.StatusOK)
+}
+
+func HandleS3GetObject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if hasUnsupportedS3Params(r, "versionId") {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	var (
+		o   *Object
+		err error
+	)
+	if id := r.URL.Query().Get("versionId"); id != "" {
+		o, err = fetchS3Version(r, vars["bucket"], vars["key"], id, PermissionRead)
+		if err == nil && o.DeleteMarker {
+			err = errS3MethodNotAllowed
+		}
+	} else {
+		o, err = fetchS3Object(r, vars["bucket"], vars["key"], PermissionRead)
+	}
+	if err != nil {
+		SendS3Error(w, r, err)
+		return
+	}
+
+	key, err := ParseS3CustomerKey(r.Header)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	f, err := OpenObject(o, key)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", o.Type)
+	if etag := o.S3ETag(); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if len(o.Tags) > 0 {
+		w.Header().Set("X-Amz-Tagging-Count", strconv.Itoa(len(o.Tags)))
+	}
+	if r.URL.Query().Get("versionId") != "" {
+		w.Header().Set("X-Amz-Version-Id", o.UUID)
+	}
+	http.ServeContent(w, r, o.Key, o.CreatedAt, f)
+}
+
+func HandleS3DeleteObject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if hasUnsupportedS3Params(r, "versionId") {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	// deleting a specific version removes it for good
+	if id := r.URL.Query().Get("versionId"); id != "" {
+		v, err := fetchS3Version(r, vars["bucket"], vars["key"], id, PermissionWrite)
+		if err != nil {
+			SendS3Error(w, r, err)
+			return
+		}
+		if err := DeleteObject(v.UUID); err != nil {
+			SendS3Error(w, r, err)
+			return
+		}
+		w.Header().Set("X-Amz-Version-Id", v.UUID)
+		if v.DeleteMarker {
+			w.Header().Set("X-Amz-Delete-Marker", "true")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	b, err := AuthorizeBucket(r, vars["bucket"], PermissionWrite)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	m, err := DeleteObjectKey(b, vars["key"])
+	if err != nil && err != ErrRecordNotFound {
+		SendS3Error(w, r, err)
+		return
+	}
+	// deleting a missing key is not an error in S3
+	if m != nil {
+		w.Header().Set("X-Amz-Version-Id", m.UUID)
+		w.Header().Set("X-Amz-Delete-Marker", "true")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func fetchS3Object(r *http.Request, bucket, key string, perm Permission) (*Object, error) {
+	if _, err := AuthorizeBucket(r, bucket, perm); err != nil {
+		return nil, s3Err(err)
+	}
+	o, err := FetchObjectByKey(bucket, key)
+	if err != nil {
+		if err == ErrRecordNotFound {
+			return nil, errS3NoSuchKey
+		}
+		return nil, err
+	}
+	return o, nil
+}
+
+func fetchS3Version(r *http.Request, bucket, key, id string, perm Permission) (*Object, error) {
+	if _, err := AuthorizeBucket(r, bucket, perm); err != nil {
+		return nil, s3Err(err)
+	}
+	v, err := FetchObjectVersion(bucket, id)
+	if err != nil {
+		return nil, s3Err(err)
+	}
+	if v.Key != CleanKey(key) {
+		return nil, errS3NoSuchVersion
+	}
+	return v, nil
+}
+
+type s3VersioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+func HandleS3GetBucketVersioning(w http.ResponseWriter, r *http.Request) {
+	b, err := AuthorizeBucket(r, mux.Vars(r)["bucket"], PermissionRead)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	// suspended and never enabled buckets look the same
+	res := &s3VersioningConfiguration{Xmlns: s3Namespace}
+	if b.Versioning {
+		res.Status = "Enabled"
+	}
+	SendXml(w, http.StatusOK, res)
+}
+
+func HandleS3PutBucketVersioning(w http.ResponseWriter, r *http.Request) {
+	b, err := AuthorizeBucket(r, mux.Vars(r)["bucket"], PermissionAdmin)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	var cfg s3VersioningConfiguration
+	if err := xml.NewDecoder(io.LimitReader(r.Body, MaxMemoryLimit)).Decode(&cfg); err != nil {
+		SendS3Error(w, r, errS3MalformedXML)
+		return
+	}
+	if cfg.Status != "Enabled" && cfg.Status != "Suspended" {
+		SendS3Error(w, r, errS3MalformedXML)
+		return
+	}
+
+	if err := b.SetVersioning(cfg.Status == "Enabled"); err != nil {
+		SendS3Error(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
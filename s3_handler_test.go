@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func sseHeaders(k []byte) http.Header {
+	sum := md5.Sum(k)
+	h := http.Header{}
+	h.Set(S3CustomerAlgorithmHeader, "AES256")
+	h.Set(S3CustomerKeyHeader, base64.StdEncoding.EncodeToString(k))
+	h.Set(S3CustomerKeyMD5Header, base64.StdEncoding.EncodeToString(sum[:]))
+	return h
+}
+
+func TestParseS3CustomerKey(t *testing.T) {
+	k := []byte(strings.Repeat("k", encKeySize))
+	if got, err := ParseS3CustomerKey(sseHeaders(k)); err != nil || string(got) != string(k) {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if got, err := ParseS3CustomerKey(http.Header{}); got != nil || err != nil {
+		t.Errorf("got %q, %v without headers", got, err)
+	}
+
+	bad := []func(h http.Header){
+		func(h http.Header) { h.Set(S3CustomerAlgorithmHeader, "AES128") },
+		func(h http.Header) { h.Set(S3CustomerKeyHeader, "c2hvcnQ=") },
+		func(h http.Header) { h.Set(S3CustomerKeyMD5Header, "AAAAAAAAAAAAAAAAAAAAAA==") },
+		func(h http.Header) { h.Del(S3CustomerKeyHeader) },
+	}
+	for i, f := range bad {
+		h := sseHeaders(k)
+		f(h)
+		if _, err := ParseS3CustomerKey(h); err != ErrCustomerKeyInvalid {
+			t.Errorf("case %d: got %v, want invalid key", i, err)
+		}
+	}
+}
+
+func TestS3GetObjectCustomerKey(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "sse")
+	k := []byte(strings.Repeat("k", encKeySize))
+	o := &Object{Type: "text/plain"}
+	if _, err := SaveObject(o, &SaveConfig{
+		BucketID:    b.Name,
+		Reader:      strings.NewReader("secret"),
+		Key:         "a.txt",
+		CustomerKey: k,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, S3PathPrefix+"/sse/a.txt", nil)
+		for name := range h {
+			r.Header.Set(name, h.Get(name))
+		}
+		r = WithPrincipal(r, &ApiKey{AccessKey: "root", Admin: true})
+		r = mux.SetURLVars(r, map[string]string{"bucket": "sse", "key": "a.txt"})
+		w := httptest.NewRecorder()
+		HandleS3GetObject(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+		code   string
+	}{
+		{"no key", http.Header{}, http.StatusBadRequest, "InvalidRequest"},
+		{"invalid key", http.Header{S3CustomerAlgorithmHeader: {"AES256"}}, http.StatusBadRequest, "InvalidArgument"},
+		{"wrong key", sseHeaders([]byte(strings.Repeat("x", encKeySize))), http.StatusForbidden, "AccessDenied"},
+	}
+	for _, tt := range tests {
+		w := get(tt.header)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), "<Code>"+tt.code+"</Code>") {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, w.Code, w.Body, tt.status, tt.code)
+		}
+	}
+
+	w := get(sseHeaders(k))
+	if b, _ := io.ReadAll(w.Body); w.Code != http.StatusOK || string(b) != "secret" {
+		t.Errorf("got %d %q, want the object content", w.Code, b)
+	}
+}
+
+func TestS3PutObjectCustomerKey(t *testing.T) {
+	setupStores(t)
+	newTestBucket(t, "sse")
+	k := []byte(strings.Repeat("k", encKeySize))
+
+	serve := func(h http.HandlerFunc, method, target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, S3PathPrefix+"/sse/a.txt"+target, strings.NewReader("secret"))
+		r.Header.Set("Content-Type", "text/plain")
+		for name := range header {
+			r.Header.Set(name, header.Get(name))
+		}
+		r = WithPrincipal(r, &ApiKey{AccessKey: "root", Admin: true})
+		r = mux.SetURLVars(r, map[string]string{"bucket": "sse", "key": "a.txt"})
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	if w := serve(HandleS3PutObject, http.MethodPut, "", http.Header{S3CustomerAlgorithmHeader: {"AES256"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("put with an invalid key got %d %s", w.Code, w.Body)
+	}
+	w := serve(HandleS3PutObject, http.MethodPut, "", sseHeaders(k))
+	if w.Code != http.StatusOK || w.Header().Get(S3CustomerKeyMD5Header) != sseHeaders(k).Get(S3CustomerKeyMD5Header) {
+		t.Fatalf("put got %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	o, err := FetchObjectByKey("sse", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.CustomerKeySHA256 != customerKeyFingerprint(k) || !o.Encrypted {
+		t.Errorf("object saved without the customer key")
+	}
+	if w := serve(HandleS3GetObject, http.MethodGet, "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("get without the key got %d", w.Code)
+	}
+	if w := serve(HandleS3GetObject, http.MethodGet, "", sseHeaders(k)); w.Code != http.StatusOK || w.Body.String() != "secret" {
+		t.Errorf("get got %d %q", w.Code, w.Body)
+	}
+
+	// multipart uploads aren't encrypted with customer keys
+	if w := serve(HandleS3CreateMultipartUpload, http.MethodPost, "?uploads=", sseHeaders(k)); w.Code != http.StatusNotImplemented {
+		t.Errorf("multipart upload with a customer key got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestS3Api(t *testing.T) {
+	setupStores(t)
+	t.Setenv("ROOT_ACCESS_KEY", testAccessKey)
+	t.Setenv("ROOT_SECRET_KEY", testSecretKey)
+	router := mux.NewRouter()
+	MountS3(router)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, S3PathPrefix+target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/plain")
+		sum := sha256.Sum256([]byte(body))
+		signTestRequest(r, time.Now(), hex.EncodeToString(sum[:]))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do(http.MethodPut, "/photos", ""); w.Code != http.StatusOK {
+		t.Fatalf("create bucket got %d %s", w.Code, w.Body)
+	}
+	for _, key := range []string{"a.txt", "dir/b.txt", "dir/c.txt"} {
+		if w := do(http.MethodPut, "/photos/"+key, "content of "+key); w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+			t.Fatalf("put %s got %d %s", key, w.Code, w.Body)
+		}
+	}
+
+	w := do(http.MethodGet, "/photos/dir/b.txt", "")
+	if w.Code != http.StatusOK || w.Body.String() != "content of dir/b.txt" {
+		t.Errorf("get got %d %q", w.Code, w.Body)
+	}
+
+	w = do(http.MethodGet, "/photos?list-type=2&delimiter=%2F", "")
+	var l s3ListResponse
+	if err := xml.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatalf("list got %d %s", w.Code, w.Body)
+	}
+	if len(l.Contents) != 1 || l.Contents[0].Key != "a.txt" || len(l.CommonPrefixes) != 1 || l.CommonPrefixes[0].Prefix != "dir/" {
+		t.Errorf("got listing %s", w.Body)
+	}
+
+	if w := do(http.MethodDelete, "/photos", ""); w.Code != http.StatusConflict {
+		t.Errorf("deleting a bucket with objects got %d", w.Code)
+	}
+	for _, key := range []string{"a.txt", "dir/b.txt", "dir/c.txt"} {
+		if w := do(http.MethodDelete, "/photos/"+key, ""); w.Code != http.StatusNoContent {
+			t.Errorf("delete %s got %d %s", key, w.Code, w.Body)
+		}
+	}
+	if w := do(http.MethodGet, "/photos/a.txt", ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "NoSuchKey") {
+		t.Errorf("get deleted got %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodDelete, "/photos", ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete bucket got %d %s", w.Code, w.Body)
+	}
+
+	// unsigned and badly signed requests are rejected
+	r := httptest.NewRequest(http.MethodGet, S3PathPrefix+"/photos", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "AccessDenied") {
+		t.Errorf("unsigned got %d %s", w.Code, w.Body)
+	}
+	r = httptest.NewRequest(http.MethodPut, S3PathPrefix+"/photos/a.txt", strings.NewReader("other"))
+	signTestRequest(r, time.Now(), unsignedPayload)
+	r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "Signature=", "Signature=0", 1))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "SignatureDoesNotMatch") {
+		t.Errorf("bad signature got %d %s", w.Code, w.Body)
+	}
+}
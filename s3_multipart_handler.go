@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errS3NoSuchUpload     = &S3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errS3InvalidPart      = &S3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	errS3InvalidPartOrder = &S3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errS3EntityTooSmall   = &S3Error{http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size"}
+	errS3MalformedXML     = &S3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+)
+
+// map multipart errors into S3 errors
+func s3MultipartErr(err error) error {
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		return errS3NoSuchUpload
+	case errors.Is(err, ErrInvalidPart):
+		return errS3InvalidPart
+	case errors.Is(err, ErrInvalidPartOrder):
+		return errS3InvalidPartOrder
+	case errors.Is(err, ErrPartTooSmall):
+		return errS3EntityTooSmall
+	case errors.Is(err, ErrUploadLocked):
+		return errS3OperationAborted
+	}
+	return s3Err(err)
+}
+
+func mountS3Multipart(s *mux.Router) {
+	k := "/{bucket}/{key:.+}"
+	s.HandleFunc(k, HandleS3CreateMultipartUpload).Methods(http.MethodPost).Queries("uploads", "")
+	s.HandleFunc(k, Transfer(HandleS3CompleteMultipartUpload)).Methods(http.MethodPost).Queries("uploadId", "{uploadId}")
+	s.HandleFunc(k, Transfer(HandleS3UploadPart)).Methods(http.MethodPut).Queries("uploadId", "{uploadId}")
+	s.HandleFunc(k, HandleS3ListParts).Methods(http.MethodGet).Queries("uploadId", "{uploadId}")
+	s.HandleFunc(k, HandleS3AbortMultipartUpload).Methods(http.MethodDelete).Queries("uploadId", "{uploadId}")
+}
+
+// Fetch upload of the request and check that it belongs to bucket and key in
+// the path and request principal can write to its bucket
+func authorizeS3Upload(r *http.Request) (*MultipartUpload, error) {
+	vars := mux.Vars(r)
+	if _, err := AuthorizeBucket(r, vars["bucket"], PermissionWrite); err != nil {
+		return nil, s3Err(err)
+	}
+	u, err := FetchMultipartUpload(vars["uploadId"])
+	if err != nil {
+		return nil, s3MultipartErr(err)
+	}
+	if u.BucketName != vars["bucket"] || u.Key != CleanKey(vars["key"]) {
+		return nil, errS3NoSuchUpload
+	}
+	return u, nil
+}
+
+type s3InitiateMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// parts are stored as received until the upload completes, multipart uploads
+// can't be encrypted with a customer key
+func hasS3CustomerKey(r *http.Request) bool {
+	return r.Header.Get(S3CustomerAlgorithmHeader) != "" || r.Header.Get(S3CustomerKeyHeader) != ""
+}
+
+func HandleS3CreateMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if hasUnsupportedS3Params(r, "uploads") || hasS3CustomerKey(r) {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	typ := r.Header.Get("Content-Type")
+	if typ == "" {
+		typ = s3DefaultType
+	}
+
+	b, err := AuthorizeBucket(r, vars["bucket"], PermissionWrite)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+	if err := b.CheckUpload(vars["key"], -1, typ); err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	u := &MultipartUpload{
+		BucketName: vars["bucket"],
+		Key:        vars["key"],
+		Type:       typ,
+		Initiator:  Principal(r).AccessKey,
+	}
+	if err := u.Create(); err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	SendXml(w, http.StatusOK, &s3InitiateMultipartUploadResponse{
+		Xmlns:    s3Namespace,
+		Bucket:   u.BucketName,
+		Key:      u.Key,
+		UploadID: u.ID.Hex(),
+	})
+}
+
+func HandleS3UploadPart(w http.ResponseWriter, r *http.Request) {
+	if hasUnsupportedS3Params(r, "uploadId", "partNumber") || r.Header.Get("X-Amz-Copy-Source") != "" || hasS3CustomerKey(r) {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > MultipartMaxParts {
+		SendS3Error(w, r, errS3InvalidArgument)
+		return
+	}
+
+	sums, err := ParseChecksums(r.Header)
+	if err != nil {
+		SendS3Error(w, r, s3Err(err))
+		return
+	}
+
+	u, err := authorizeS3Upload(r)
+	if err != nil {
+		SendS3Error(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadLimit)
+	p, err := u.PutPart(n, r.Body, sums)
+	if err != nil {
+		SendS3Error(w, r, s3MultipartErr(err))
+		return
+	}
+
+	w.Header().Set("ETag", `"`+p.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+type s3CompleteMultipartUploadRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func HandleS3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	if hasUnsupportedS3Params(r, "uploadId") {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	u, err := authorizeS3Upload(r)
+	if err != nil {
+		SendS3Error(w, r, err)
+		return
+	}
+
+	var req s3CompleteMultipartUploadRequest
+	r.Body = http.MaxBytesReader(w, r.Body, MaxMemoryLimit)
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendS3Error(w, r, errS3MalformedXML)
+		return
+	}
+	cps := make([]CompletedPart, 0, len(req.Parts))
+	for _, p := range req.Parts {
+		cps = append(cps, CompletedPart{Number: p.PartNumber, ETag: p.ETag})
+	}
+
+	o, etag, err := u.Complete(cps)
+	if err != nil {
+		SendS3Error(w, r, s3MultipartErr(err))
+		return
+	}
+
+	if o.Versioned {
+		w.Header().Set("X-Amz-Version-Id", o.UUID)
+	}
+	SendXml(w, http.StatusOK, &s3CompleteMultipartUploadResponse{
+		Xmlns:    s3Namespace,
+		Location: JoinUrl(S3PathPrefix + "/" + o.BucketName + "/" + o.Key),
+		Bucket:   o.BucketName,
+		Key:      o.Key,
+		ETag:     `"` + etag + `"`,
+	})
+}
+
+type s3ListPartsResponse struct {
+	XMLName     xml.Name      `xml:"ListPartsResult"`
+	Xmlns       string        `xml:"xmlns,attr"`
+	Bucket      string        `xml:"Bucket"`
+	Key         string        `xml:"Key"`
+	UploadID    string        `xml:"UploadId"`
+	MaxParts    int           `xml:"MaxParts"`
+	IsTruncated bool          `xml:"IsTruncated"`
+	Parts       []s3PartEntry `xml:"Part"`
+}
+
+type s3PartEntry struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+// all parts are listed at once, an upload can't have more than
+// MultipartMaxParts parts
+func HandleS3ListParts(w http.ResponseWriter, r *http.Request) {
+	if hasUnsupportedS3Params(r, "uploadId", "max-parts", "part-number-marker") {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	u, err := authorizeS3Upload(r)
+	if err != nil {
+		SendS3Error(w, r, err)
+		return
+	}
+	parts, err := u.Parts()
+	if err != nil {
+		SendS3Error(w, r, err)
+		return
+	}
+
+	res := &s3ListPartsResponse{
+		Xmlns:    s3Namespace,
+		Bucket:   u.BucketName,
+		Key:      u.Key,
+		UploadID: u.ID.Hex(),
+		MaxParts: MultipartMaxParts,
+	}
+	for _, p := range parts {
+		res.Parts = append(res.Parts, s3PartEntry{
+			PartNumber:   p.Number,
+			LastModified: p.UpdatedAt.UTC().Format(s3TimeFormat),
+			ETag:         `"` + p.ETag + `"`,
+			Size:         p.Size,
+		})
+	}
+	SendXml(w, http.StatusOK, res)
+}
+
+func HandleS3AbortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	if hasUnsupportedS3Params(r, "uploadId") {
+		SendS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	u, err := authorizeS3Upload(r)
+	if err != nil {
+		SendS3Error(w, r, err)
+		return
+	}
+	if err := u.Abort(); err != nil {
+		SendS3Error(w, r, s3MultipartErr(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tests run against the bolt metadata store in a temporary file and the
+// memory storage backend, both replace the global ones for the test
+
+func setupStores(t *testing.T) {
+	t.Helper()
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "storage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevMetadata, prevStorage := metadata, storage
+	metadata, storage = s, NewMemoryStorage()
+	t.Cleanup(func() {
+		s.Close()
+		metadata, storage = prevMetadata, prevStorage
+	})
+}
+
+// Create bucket with the exact given name
+func newTestBucket(t *testing.T, name string) *Bucket {
+	t.Helper()
+	b := &Bucket{Name: name}
+	if err := createBucket(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func saveTestObject(t *testing.T, b *Bucket, key string, content string) *Object {
+	t.Helper()
+	o := &Object{Type: "image/png"}
+	_, err := SaveObject(o, &SaveConfig{
+		BucketID: b.Name,
+		Reader:   strings.NewReader(content),
+		Key:      key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"errors"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/kamva/mgm/v3"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type ObjectSharingSession struct {
@@ -17,15 +21,78 @@ type ObjectSharingSession struct {
 	ExpiryDate       time.Time              `bson:"expiry_date" json:"expiry_date"`
 	Metadata         map[string]interface{} `json:"metadata"`
 	OUUID            string                 `json:"ouuid"`
+	Label            string                 `json:"label"`
+	RevokedAt        *time.Time             `bson:"revoked_at" json:"revoked_at"`
+
+	// Restrictions, zero values mean no restriction
+	MaxDownloads int      `bson:"max_downloads" json:"max_downloads"`
+	Downloads    int      `json:"downloads"`
+	OneTime      bool     `bson:"one_time" json:"one_time"`
+	AllowedCIDRs []string `bson:"allowed_cidrs" json:"allowed_cidrs"`
+	PasswordHash string   `bson:"password_hash" json:"-"`
+}
+
+var (
+	ErrSessionRevoked   = errors.New("session revoked")
+	ErrSessionExhausted = errors.New("session download limit reached")
+	ErrSessionIPDenied  = errors.New("address is not allowed to use this session")
+	ErrSessionPassword  = errors.New("session password is required or invalid")
+)
+
+// Request details session restrictions are checked against
+type SessionAccess struct {
+	IP       net.IP
+	Password string
+	// counts against session downloads
+	Download bool
+	// key of objects saved with a customer key
+	CustomerKey []byte
+	// Accept-Encoding header, compressed objects are served compressed
+	// when it accepts their encoding
+	AcceptEncoding string
+	// images are served transformed when set
+	Transform *ImageTransform
+
+	// conditional request validators
+	IfNoneMatch     string
+	IfModifiedSince string
+}
+
+// Check if the client copy of content with etag and modtime is still fresh,
+// like http.ServeContent If-None-Match takes precedence over If-Modified-Since
+func (acc *SessionAccess) NotModified(etag string, modtime time.Time) bool {
+	if acc.IfNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(acc.IfNoneMatch, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if acc.IfModifiedSince == "" || modtime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(acc.IfModifiedSince)
+	if err != nil {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(t)
 }
 
 func (s *ObjectSharingSession) CreateIndex() error {
 	col := mgm.Coll(s)
+
+	// objects used to have one session only, drop the old unique index
+	col.Indexes().DropOne(context.Background(), "ouuid")
+
 	_, err := col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
-		Keys: bson.M{"ouuid": 1},
+		Keys: bson.D{{Key: "ouuid", Value: 1}, {Key: "expiry_date", Value: -1}},
 		Options: options.MergeIndexOptions(
-			options.Index().SetUnique(true),
-			options.Index().SetName("ouuid"),
+			options.Index().SetName("ouuid_expiry_date"),
 		),
 	})
 	if err != nil {
@@ -38,77 +105,112 @@ func (s *ObjectSharingSession) Create() error {
 	return CreateSession(s)
 }
 
+// Objects can have many sessions at once, ex: a link per recipient
 func CreateSession(s *ObjectSharingSession) error {
-	// Remove all previous sessions
-	if err := removeUnexpired(s.OUUID); err != nil {
+	return Metadata().CreateSession(s)
+}
+
+func (s *ObjectSharingSession) CheckExpiration() bool {
+	return s.ExpiryDate.Before(time.Now())
+}
+
+func (s *ObjectSharingSession) IsRevoked() bool {
+	return s.RevokedAt != nil
+}
+
+func (s *ObjectSharingSession) IsExhausted() bool {
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+func (s *ObjectSharingSession) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+func (s *ObjectSharingSession) SetPassword(p string) error {
+	if p == "" {
+		s.PasswordHash = ""
+		return nil
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(p), bcrypt.DefaultCost)
+	if err != nil {
 		return err
 	}
-	col := mgm.Coll(s)
-	if err := col.Create(s, nil); err != nil {
+	s.PasswordHash = string(h)
+	return nil
+}
+
+// Check session restrictions other than expiry and revocation
+func (s *ObjectSharingSession) CheckAccess(acc *SessionAccess) error {
+	if len(s.AllowedCIDRs) > 0 {
+		allowed := false
+		for _, c := range s.AllowedCIDRs {
+			_, n, err := net.ParseCIDR(c)
+			if err == nil && acc.IP != nil && n.Contains(acc.IP) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrSessionIPDenied
+		}
+	}
+
+	if s.HasPassword() {
+		err := bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(acc.Password))
+		if err != nil {
+			return ErrSessionPassword
+		}
+	}
+
+	if s.IsExhausted() {
+		return ErrSessionExhausted
+	}
+	return nil
+}
+
+// Count a download, the store only increments while the session is under its
+// limit so concurrent requests can't go over it
+func (s *ObjectSharingSession) CountDownload() error {
+	ss, err := Metadata().IncrementSessionDownloads(s.ID.Hex())
+	if err != nil {
+		if err == ErrRecordNotFound {
+			return ErrSessionExhausted
+		}
 		return err
 	}
+	*s = *ss
 	return nil
 }
 
-// Remove all previous sessions
-func removeUnexpired(ouuid string) error {
-	col := mgm.Coll(&ObjectSharingSession{})
-	_, err := col.DeleteMany(
-		context.Background(),
-		bson.M{
-			"ouuid": ouuid,
-			"expiry_date": bson.M{
-				"$gt": time.Now(),
-			},
-		},
-	)
+// Revoke session, links using it stop working immediately
+func (s *ObjectSharingSession) Revoke() error {
+	if s.IsRevoked() {
+		return nil
+	}
+	ss, err := Metadata().RevokeSession(s.ID.Hex(), time.Now().UTC())
 	if err != nil {
 		return err
 	}
+	*s = *ss
 	return nil
 }
 
-func (s *ObjectSharingSession) CheckExpiration() bool {
-	return s.ExpiryDate.Before(time.Now())
+// fetch all object sessions, latest first
+func FetchObjectSessions(ouuid string) ([]ObjectSharingSession, error) {
+	return Metadata().FetchObjectSessions(ouuid)
 }
 
 // fetch object latest session
 func FetchLatestSession(ouuid string) (*ObjectSharingSession, error) {
-	col := mgm.Coll(&ObjectSharingSession{})
-	var ss []ObjectSharingSession
-
-	crs, err := col.Find(
-		context.Background(),
-		bson.M{"ouuid": ouuid},
-		options.Find().SetSort(bson.M{
-			"expiry_date": -1,
-		}).SetLimit(1),
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := crs.All(context.Background(), &ss); err != nil {
-		return nil, err
-	}
-
-	return &ss[0], nil
+	return Metadata().FetchLatestSession(ouuid)
 }
 
 // fetch object session with session id
 func FetchSession(id string) (*ObjectSharingSession, error) {
-	col := mgm.Coll(&ObjectSharingSession{})
-	var s ObjectSharingSession
-
 	if id == "" {
 		return nil, errors.New("session id is empty")
 	}
-
-	if err := col.FindByID(id, &s); err != nil {
-		return nil, err
-	}
-
-	return &s, nil
+	return Metadata().FetchSession(id)
 }
 
 func (s *ObjectSharingSession) BelongToObj(uuid string) (bool, error) {
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func newTestSession(t *testing.T, o *Object, shr *ObjectShare) *ObjectSharingSession {
+	t.Helper()
+	_, s, err := o.GenerateSharableLink(shr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestObjectSessions(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	first := newTestSession(t, o, &ObjectShare{Label: "alice"})
+	second := newTestSession(t, o, &ObjectShare{Label: "bob"})
+
+	// new sessions don't replace the previous ones
+	ss, err := FetchObjectSessions(o.UUID)
+	if err != nil || len(ss) != 2 {
+		t.Fatalf("got %d sessions, %v", len(ss), err)
+	}
+	for _, s := range []*ObjectSharingSession{first, second} {
+		f, err := ServeObject(o.UUID, s.ID.Hex(), &SessionAccess{})
+		if err != nil {
+			t.Fatalf("%s: %v", s.Label, err)
+		}
+		f.Close()
+	}
+
+	if err := first.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ServeObject(o.UUID, first.ID.Hex(), &SessionAccess{}); err != ErrSessionRevoked {
+		t.Errorf("got %v with a revoked session", err)
+	}
+	f, err := ServeObject(o.UUID, second.ID.Hex(), &SessionAccess{})
+	if err != nil {
+		t.Fatalf("other session stopped working: %v", err)
+	}
+	f.Close()
+
+	other := saveTestObject(t, b, "b.png", "other")
+	if _, err := ServeObject(other.UUID, second.ID.Hex(), &SessionAccess{}); err != ErrSessionNotFound {
+		t.Errorf("got %v using the session of another object", err)
+	}
+}
+
+func TestHandleObjectSessions(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	other := saveTestObject(t, b, "b.png", "other")
+	s := newTestSession(t, o, &ObjectShare{Label: "alice"})
+	newTestSession(t, o, &ObjectShare{Label: "bob"})
+
+	serve := func(h http.HandlerFunc, method string, vars map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/object/"+vars["uuid"]+"/external", nil)
+		r = WithPrincipal(r, &ApiKey{AccessKey: "root", Admin: true})
+		r = mux.SetURLVars(r, vars)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	w := serve(HandleObjectSessionsFetch, http.MethodGet, map[string]string{"uuid": o.UUID})
+	var list struct {
+		Sessions []struct {
+			Label string `json:"label"`
+		} `json:"sessions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Sessions) != 2 {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+
+	vars := map[string]string{"uuid": o.UUID, "session": s.ID.Hex()}
+	if w := serve(HandleObjectSessionFetch, http.MethodGet, vars); w.Code != http.StatusOK {
+		t.Errorf("fetch got %d %s", w.Code, w.Body)
+	}
+	otherVars := map[string]string{"uuid": other.UUID, "session": s.ID.Hex()}
+	if w := serve(HandleObjectSessionRevoke, http.MethodDelete, otherVars); w.Code != http.StatusNotFound {
+		t.Errorf("revoking through another object got %d", w.Code)
+	}
+
+	w = serve(HandleObjectSessionRevoke, http.MethodDelete, vars)
+	var revoked struct {
+		RevokedAt *string `json:"revoked_at"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &revoked); err != nil || w.Code != http.StatusOK || revoked.RevokedAt == nil {
+		t.Errorf("revoke got %d %s", w.Code, w.Body)
+	}
+	if s, _ := FetchSession(s.ID.Hex()); s == nil || !s.IsRevoked() {
+		t.Error("session not revoked")
+	}
+}
+
+func TestSessionCheckAccess(t *testing.T) {
+	s := &ObjectSharingSession{AllowedCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}}
+	if err := s.SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		ip       string
+		password string
+		err      error
+	}{
+		{"allowed", "10.1.2.3", "secret", nil},
+		{"allowed ipv6", "2001:db8::1", "secret", nil},
+		{"other address", "192.168.1.1", "secret", ErrSessionIPDenied},
+		{"no address", "", "secret", ErrSessionIPDenied},
+		{"wrong password", "10.1.2.3", "guess", ErrSessionPassword},
+		{"no password", "10.1.2.3", "", ErrSessionPassword},
+	}
+	for _, tt := range tests {
+		if err := s.CheckAccess(&SessionAccess{IP: net.ParseIP(tt.ip), Password: tt.password}); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	s = &ObjectSharingSession{MaxDownloads: 2, Downloads: 2}
+	if err := s.CheckAccess(&SessionAccess{}); err != ErrSessionExhausted {
+		t.Errorf("got %v, want exhausted", err)
+	}
+}
+
+func TestServeObjectCountsDownloads(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	s := newTestSession(t, o, &ObjectShare{OneTime: true})
+	if s.MaxDownloads != 1 {
+		t.Errorf("one time session allows %d downloads", s.MaxDownloads)
+	}
+
+	// requests that aren't downloads don't use the session up
+	f, err := ServeObject(o.UUID, s.ID.Hex(), &SessionAccess{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f, err = ServeObject(o.UUID, s.ID.Hex(), &SessionAccess{Download: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := ServeObject(o.UUID, s.ID.Hex(), &SessionAccess{Download: true}); err != ErrSessionExhausted {
+		t.Errorf("got %v downloading twice, want exhausted", err)
+	}
+	if s, _ := FetchSession(s.ID.Hex()); s.Downloads != 1 {
+		t.Errorf("got %d downloads", s.Downloads)
+	}
+}
+
+func TestRevokeKeepsDownloads(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	s := newTestSession(t, o, &ObjectShare{MaxDownloads: 3})
+
+	// s is stale once the download is counted
+	f, err := ServeObject(o.UUID, s.ID.Hex(), &SessionAccess{Download: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := s.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Downloads != 1 || !s.IsRevoked() {
+		t.Errorf("got %d downloads, revoked %v", s.Downloads, s.IsRevoked())
+	}
+	ss, _ := FetchSession(s.ID.Hex())
+	at := *ss.RevokedAt
+	time.Sleep(2 * time.Millisecond)
+	stale := &ObjectSharingSession{}
+	stale.ID = s.ID
+	if err := stale.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	if ss, _ = FetchSession(s.ID.Hex()); ss.Downloads != 1 || !ss.RevokedAt.Equal(at) {
+		t.Errorf("got %d downloads, revoked at %v want %v", ss.Downloads, ss.RevokedAt, at)
+	}
+}
+
+func TestServeObjectConcurrentDownloads(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	s := newTestSession(t, o, &ObjectShare{MaxDownloads: 3})
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := ServeObject(o.UUID, s.ID.Hex(), &SessionAccess{Download: true})
+			if err != nil {
+				return
+			}
+			f.Close()
+			mu.Lock()
+			ok++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if ok != 3 {
+		t.Errorf("served %d downloads, want 3", ok)
+	}
+}
+
+func TestHandleServingCountsRangeDownloads(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	s := newTestSession(t, o, &ObjectShare{MaxDownloads: 4})
+
+	get := func(method, rg string) int {
+		r := httptest.NewRequest(method, "/share/photos/"+o.UUID+"?session="+s.ID.Hex(), nil)
+		if rg != "" {
+			r.Header.Set("Range", rg)
+		}
+		r = mux.SetURLVars(r, map[string]string{"bucket": "photos", "uuid": o.UUID})
+		w := httptest.NewRecorder()
+		HandleServingRequestedObject(w, r)
+		return w.Code
+	}
+	if code := get(http.MethodHead, ""); code != http.StatusOK {
+		t.Errorf("head got %d", code)
+	}
+	for _, rg := range []string{"", "bytes=0-", "bytes=1-", "bytes=5-,0-"} {
+		if code := get(http.MethodGet, rg); code != http.StatusOK && code != http.StatusPartialContent {
+			t.Errorf("%q got %d", rg, code)
+		}
+	}
+	if code := get(http.MethodGet, "bytes=1-"); code != http.StatusForbidden {
+		t.Errorf("got %d past max downloads", code)
+	}
+	if s, _ := FetchSession(s.ID.Hex()); s.Downloads != 4 {
+		t.Errorf("got %d downloads, want 4", s.Downloads)
+	}
+}
+
+func TestHandleServingPasswordSession(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	s := newTestSession(t, o, &ObjectShare{Password: "secret", AllowedCIDRs: []string{"192.0.2.0/24"}})
+
+	get := func(remote, password string) int {
+		r := httptest.NewRequest(http.MethodGet, "/share/photos/"+o.UUID+"?session="+s.ID.Hex(), nil)
+		r.RemoteAddr = remote
+		if password != "" {
+			r.Header.Set("X-Share-Password", password)
+		}
+		r = mux.SetURLVars(r, map[string]string{"bucket": "photos", "uuid": o.UUID})
+		w := httptest.NewRecorder()
+		HandleServingRequestedObject(w, r)
+		return w.Code
+	}
+	if code := get("192.0.2.1:1234", "secret"); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if code := get("192.0.2.1:1234", "guess"); code != http.StatusUnauthorized {
+		t.Errorf("got %d with a wrong password", code)
+	}
+	if code := get("198.51.100.1:1234", "secret"); code != http.StatusForbidden {
+		t.Errorf("got %d from another network", code)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSigningNotConfigured = errors.New("signed links are not configured")
+	ErrSignatureInvalid     = errors.New("link signature is invalid")
+	ErrSignatureExpired     = errors.New("link expired")
+)
+
+// Share links signing keys configured as SHARE_SIGNING_KEYS=<kid>:<secret>,...
+// new links are signed with SHARE_SIGNING_KEY_ID, older keys are kept in the
+// list until their links expire to allow rotation
+func shareSigningKeys() map[string][]byte {
+	keys := map[string][]byte{}
+	for _, p := range strings.Split(os.Getenv("SHARE_SIGNING_KEYS"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), ":", 2)
+		if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+			keys[kv[0]] = []byte(kv[1])
+		}
+	}
+	return keys
+}
+
+func activeSigningKey() (string, []byte, error) {
+	kid := os.Getenv("SHARE_SIGNING_KEY_ID")
+	k, ok := shareSigningKeys()[kid]
+	if !ok {
+		return "", nil, ErrSigningNotConfigured
+	}
+	return kid, k, nil
+}
+
+func shareSignature(key []byte, method, bucket, uuid string, expires int64) string {
+	m := fmt.Sprintf("%s\n%s\n%s\n%d", method, bucket, uuid, expires)
+	return hex.EncodeToString(hmacSHA256(key, []byte(m)))
+}
+
+// Generate stateless link to object, it's valid for ttl seconds and method
+func (o *Object) GenerateSignedLink(ttl time.Duration, method string) (string, time.Time, error) {
+	if method != http.MethodGet && method != http.MethodHead {
+		return "", time.Time{}, errors.New("method is not allowed")
+	}
+	kid, key, err := activeSigningKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if ttl == 0 {
+		ttl = time.Duration(3600)
+	}
+
+	exp := CalculateExpiration(ttl)
+	q := url.Values{
+		"expires": {strconv.FormatInt(exp.Unix(), 10)},
+		"method":  {method},
+		"kid":     {kid},
+		"sig":     {shareSignature(key, method, o.BucketName, o.UUID, exp.Unix())},
+	}
+	l := fmt.Sprintf("/share/%s/%s?%s", o.BucketName, o.Title, q.Encode())
+	return JoinUrl(l), exp, nil
+}
+
+// Verify signed link query without touching the database, GET links can be
+// used for HEAD requests as well
+func VerifySignedLink(method, bucket, uuid string, q url.Values) error {
+	key, ok := shareSigningKeys()[q.Get("kid")]
+	if !ok {
+		return ErrSignatureInvalid
+	}
+	exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	m := q.Get("method")
+	if m != method && !(m == http.MethodGet && method == http.MethodHead) {
+		return ErrSignatureInvalid
+	}
+	sig := shareSignature(key, m, bucket, uuid, exp)
+	if !hmac.Equal([]byte(sig), []byte(q.Get("sig"))) {
+		return ErrSignatureInvalid
+	}
+
+	if time.Now().Unix() > exp {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func IsSignedLink(q url.Values) bool {
+	return q.Get("sig") != ""
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedLinkQuery(t *testing.T, o *Object, ttl time.Duration, method string) url.Values {
+	t.Helper()
+	l, _, err := o.GenerateSignedLink(ttl, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
+
+func TestSignedLink(t *testing.T) {
+	t.Setenv("SHARE_SIGNING_KEYS", "k1:first,k2:second")
+	t.Setenv("SHARE_SIGNING_KEY_ID", "k1")
+	o := &Object{UUID: "uuid", BucketName: "photos", Title: "uuid.png"}
+
+	if _, _, err := o.GenerateSignedLink(60, http.MethodPut); err == nil {
+		t.Error("link generated for PUT")
+	}
+	q := signedLinkQuery(t, o, 60, http.MethodGet)
+	if !IsSignedLink(q) || q.Get("kid") != "k1" {
+		t.Errorf("got query %v", q)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		bucket, uuid string
+		change       func(q url.Values)
+		err          error
+	}{
+		{"valid", http.MethodGet, "photos", "uuid", nil, nil},
+		{"head with get link", http.MethodHead, "photos", "uuid", nil, nil},
+		{"other method", http.MethodDelete, "photos", "uuid", nil, ErrSignatureInvalid},
+		{"other object", http.MethodGet, "photos", "other", nil, ErrSignatureInvalid},
+		{"other bucket", http.MethodGet, "videos", "uuid", nil, ErrSignatureInvalid},
+		{"extended", http.MethodGet, "photos", "uuid", func(q url.Values) {
+			exp, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+			q.Set("expires", strconv.FormatInt(exp+3600, 10))
+		}, ErrSignatureInvalid},
+		{"other key", http.MethodGet, "photos", "uuid", func(q url.Values) { q.Set("kid", "k2") }, ErrSignatureInvalid},
+		{"unknown key", http.MethodGet, "photos", "uuid", func(q url.Values) { q.Set("kid", "k3") }, ErrSignatureInvalid},
+	}
+	for _, tt := range tests {
+		q := signedLinkQuery(t, o, 60, http.MethodGet)
+		if tt.change != nil {
+			tt.change(q)
+		}
+		if err := VerifySignedLink(tt.method, tt.bucket, tt.uuid, q); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	q = signedLinkQuery(t, o, 60, http.MethodGet)
+	q.Set("expires", strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	q.Set("sig", shareSignature([]byte("first"), http.MethodGet, "photos", "uuid", time.Now().Add(-time.Minute).Unix()))
+	if err := VerifySignedLink(http.MethodGet, "photos", "uuid", q); err != ErrSignatureExpired {
+		t.Errorf("got %v, want expired", err)
+	}
+}
+
+func TestSignedLinkKeyRotation(t *testing.T) {
+	t.Setenv("SHARE_SIGNING_KEYS", "k1:first")
+	t.Setenv("SHARE_SIGNING_KEY_ID", "k1")
+	o := &Object{UUID: "uuid", BucketName: "photos", Title: "uuid.png"}
+	old := signedLinkQuery(t, o, 60, http.MethodGet)
+
+	// links of the previous key work while it's listed
+	t.Setenv("SHARE_SIGNING_KEYS", "k1:first,k2:second")
+	t.Setenv("SHARE_SIGNING_KEY_ID", "k2")
+	if q := signedLinkQuery(t, o, 60, http.MethodGet); q.Get("kid") != "k2" {
+		t.Errorf("signed with %s, want k2", q.Get("kid"))
+	}
+	if err := VerifySignedLink(http.MethodGet, "photos", "uuid", old); err != nil {
+		t.Errorf("got %v with the previous key", err)
+	}
+
+	t.Setenv("SHARE_SIGNING_KEYS", "k2:second")
+	if err := VerifySignedLink(http.MethodGet, "photos", "uuid", old); err != ErrSignatureInvalid {
+		t.Errorf("got %v once the previous key is removed", err)
+	}
+	t.Setenv("SHARE_SIGNING_KEY_ID", "k3")
+	if _, _, err := o.GenerateSignedLink(60, http.MethodGet); err != ErrSigningNotConfigured {
+		t.Errorf("got %v without the active key", err)
+	}
+}
+
+func TestServeSignedObject(t *testing.T) {
+	setupStores(t)
+	t.Setenv("SHARE_SIGNING_KEYS", "k1:first")
+	t.Setenv("SHARE_SIGNING_KEY_ID", "k1")
+	b := newTestBucket(t, "photos")
+	o := saveTestObject(t, b, "a.png", "content")
+	q := signedLinkQuery(t, o, 60, http.MethodGet)
+
+	f, err := ServeSignedObject(http.MethodGet, b.Name, o.UUID, q, &SessionAccess{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if c, _ := io.ReadAll(f.File); string(c) != "content" {
+		t.Errorf("got %q", c)
+	}
+	exp, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	q.Set("sig", shareSignature([]byte("guessed"), http.MethodGet, b.Name, o.UUID, exp))
+	if _, err := ServeSignedObject(http.MethodGet, b.Name, o.UUID, q, &SessionAccess{}); err != ErrSignatureInvalid {
+		t.Errorf("got %v signed with another secret", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	LocalStorageDriver  = "local"
+	MemoryStorageDriver = "memory"
+
+	DefaultStoragePath = "./cloud"
+)
+
+var (
+	ErrFileNotFound = errors.New("file not found")
+	ErrDirNotEmpty  = errors.New("directory is not empty")
+	ErrDirExists    = errors.New("directory already exists")
+	ErrInvalidPath  = errors.New("path is outside the storage root")
+
+	storage StorageBackend
+)
+
+// StorageBackend is where objects bytes are kept, paths are always relative
+// to the backend root ex: bucket/new/image.jpg
+type StorageBackend interface {
+	// CreateFile streams r into p and returns the written size, the file
+	// must not be visible at p until it's completely written
+	CreateFile(p string, r io.Reader) (int64, error)
+	// AppendFile appends r to p creating it if missing, bytes written before
+	// a read error are kept and counted in the returned size
+	AppendFile(p string, r io.Reader) (int64, error)
+	GetFile(p string) (StoredFile, error)
+	DeleteFile(p string) error
+	// MoveFile renames src to dst creating dst directory if missing
+	MoveFile(src, dst string) error
+	// WalkFiles calls fn with the slash separated path and size of every
+	// stored file, files still being written are skipped
+	WalkFiles(fn func(p string, size int64) error) error
+	CreateDir(dir string) error
+	// MoveDir renames directory src with everything in it to dst, dst must
+	// not exist
+	MoveDir(src, dst string) error
+	// DeleteDir removes dir with everything in it when forced, otherwise
+	// only when it holds no files, empty sub directories go along as deleted
+	// objects leave their directories behind
+	DeleteDir(dir string, force bool) error
+	Exists(p string) (bool, error)
+	// ModTime returns when p was last written
+	ModTime(p string) (time.Time, error)
+	// CleanStaging removes leftovers of writes interrupted by a crash and
+	// returns how many were removed, it's called on startup
+	CleanStaging() (int, error)
+}
+
+// StoredFile is a readable file returned from a storage backend
+type StoredFile interface {
+	io.ReadSeekCloser
+	Name() string
+}
+
+// Open storage backend selected by STORAGE_DRIVER (local by default)
+func OpenStorage() error {
+	s, err := NewStorage(os.Getenv("STORAGE_DRIVER"))
+	if err != nil {
+		return err
+	}
+	storage = s
+	return nil
+}
+
+func NewStorage(driver string) (StorageBackend, error) {
+	switch driver {
+	case "", LocalStorageDriver:
+		p := os.Getenv("STORAGE_PATH")
+		if p == "" {
+			p = DefaultStoragePath
+		}
+		return NewLocalStorage(p)
+	case MemoryStorageDriver:
+		return NewMemoryStorage(), nil
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", driver)
+}
+
+func Storage() StorageBackend {
+	return storage
+}
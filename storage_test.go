@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// every storage backend, the local one rooted in a directory of its own
+func testBackends(t *testing.T) map[string]StorageBackend {
+	t.Helper()
+	local, err := NewLocalStorage(filepath.Join(t.TempDir(), "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]StorageBackend{"local": local, "memory": NewMemoryStorage()}
+}
+
+func readStored(t *testing.T, s StorageBackend, p string) string {
+	t.Helper()
+	f, err := s.GetFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestStorageFiles(t *testing.T) {
+	for name, s := range testBackends(t) {
+		if _, err := s.CreateFile("b/dir/a.txt", strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.AppendFile("b/dir/a.txt", strings.NewReader(" world")); err != nil {
+			t.Fatal(err)
+		}
+		if got := readStored(t, s, "b/dir/a.txt"); got != "hello world" {
+			t.Errorf("%s: read %q", name, got)
+		}
+
+		if err := s.MoveFile("b/dir/a.txt", "b/other/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetFile("b/dir/a.txt"); err != ErrFileNotFound {
+			t.Errorf("%s: moved file still found: %v", name, err)
+		}
+		if ok, err := s.Exists("b/other/a.txt"); !ok || err != nil {
+			t.Errorf("%s: moved file exists %v, %v", name, ok, err)
+		}
+
+		if mt, err := s.ModTime("b/other/a.txt"); err != nil || time.Since(mt) > time.Minute {
+			t.Errorf("%s: moved file written at %v, %v", name, mt, err)
+		}
+
+		if err := s.DeleteFile("b/other/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteFile("b/other/a.txt"); err != ErrFileNotFound {
+			t.Errorf("%s: deleting missing file got %v", name, err)
+		}
+		if _, err := s.ModTime("b/other/a.txt"); err != ErrFileNotFound {
+			t.Errorf("%s: mod time of missing file got %v", name, err)
+		}
+	}
+}
+
+func TestStorageDirs(t *testing.T) {
+	for name, s := range testBackends(t) {
+		if err := s.CreateDir("b"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.CreateFile("b/a.txt", strings.NewReader("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteDir("b", false); err != ErrDirNotEmpty {
+			t.Errorf("%s: deleting non empty directory got %v", name, err)
+		}
+		if err := s.DeleteDir("missing", false); err != ErrFileNotFound {
+			t.Errorf("%s: deleting missing directory got %v", name, err)
+		}
+
+		if err := s.CreateDir("c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.MoveDir("b", "c"); err != ErrDirExists {
+			t.Errorf("%s: moving over directory got %v", name, err)
+		}
+		if err := s.MoveDir("b", "d"); err != nil {
+			t.Fatal(err)
+		}
+		if got := readStored(t, s, "d/a.txt"); got != "a" {
+			t.Errorf("%s: moved directory holds %q", name, got)
+		}
+
+		if err := s.DeleteDir("d", true); err != nil {
+			t.Fatal(err)
+		}
+		// empty sub directories don't keep a directory from being deleted
+		if err := s.CreateDir("c/e/f"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteDir("c", false); err != nil {
+			t.Errorf("%s: deleting empty directory got %v", name, err)
+		}
+		if ok, _ := s.Exists("c/e"); ok {
+			t.Errorf("%s: sub directory of deleted directory exists", name)
+		}
+		if ok, _ := s.Exists("d/a.txt"); ok {
+			t.Errorf("%s: file of deleted directory exists", name)
+		}
+	}
+}
+
+func TestStorageRejectsOutsidePaths(t *testing.T) {
+	outside := t.TempDir()
+	for name, s := range testBackends(t) {
+		escape := "../" + filepath.Base(outside) + "/x"
+		if l, ok := s.(*LocalStorage); ok {
+			// relative to the local root the directory is two levels up
+			rel, _ := filepath.Rel(l.root, filepath.Join(outside, "x"))
+			escape = filepath.ToSlash(rel)
+		}
+
+		if _, err := s.CreateFile(escape, strings.NewReader("x")); err != ErrInvalidPath {
+			t.Errorf("%s: creating %s got %v", name, escape, err)
+		}
+		if _, err := s.GetFile("a/../../x"); err != ErrInvalidPath {
+			t.Errorf("%s: reading outside got %v", name, err)
+		}
+		if err := s.MoveFile("a.txt", "../a.txt"); err != ErrInvalidPath {
+			t.Errorf("%s: moving outside got %v", name, err)
+		}
+		for _, dir := range []string{"", ".", "..", "a/../.."} {
+			if err := s.DeleteDir(dir, true); err != ErrInvalidPath {
+				t.Errorf("%s: deleting %q got %v", name, dir, err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the root: %v", err)
+	}
+}
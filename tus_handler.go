@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads following tus protocol https://tus.io/protocols/resumable-upload
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,termination,expiration"
+)
+
+var ErrTusVersion = errors.New("unsupported tus version")
+
+// set tus headers and reject requests for other protocol versions
+func checkTus(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		SendHttpJsonError(w, http.StatusPreconditionFailed, ErrTusVersion)
+		return false
+	}
+	return true
+}
+
+// Parse Upload-Metadata header, pairs of key and base64 value separated by commas
+func parseUploadMetadata(h string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, p := range strings.Split(h, ",") {
+		kv := strings.Fields(p)
+		if len(kv) == 0 {
+			continue
+		}
+		if len(kv) > 2 {
+			return nil, errors.New("invalid upload metadata")
+		}
+		v := ""
+		if len(kv) == 2 {
+			b, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, errors.New("invalid upload metadata")
+			}
+			v = string(b)
+		}
+		m[kv[0]] = v
+	}
+	return m, nil
+}
+
+func setUploadHeaders(w http.ResponseWriter, u *Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.Format(http.TimeFormat))
+	if u.IsComplete() {
+		w.Header().Set("Upload-Object-Uuid", u.ObjectUUID)
+	}
+}
+
+func sendUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		SendHttpJsonError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrUploadOffset):
+		SendHttpJsonError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrUploadLocked):
+		SendHttpJsonError(w, http.StatusLocked, err)
+	default:
+		sendSaveError(w, err)
+	}
+}
+
+// Fetch upload and check that request principal can write to its bucket
+func authorizeUpload(r *http.Request) (*Upload, error) {
+	u, err := FetchUpload(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := AuthorizeBucket(r, u.BucketName, PermissionWrite); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func HandleUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(MaxUploadLimit, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create upload, bucket, key and filetype are sent in Upload-Metadata
+// ex: Upload-Metadata: bucket cGljcw==,filename YS5wbmc=,filetype aW1hZ2UvcG5n
+func HandleUploadCreation(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+
+	l, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || l < 0 {
+		SendHttpJsonError(w, http.StatusBadRequest, errors.New("upload length is required"))
+		return
+	}
+	if l > MaxUploadLimit {
+		SendHttpJsonError(w, http.StatusRequestEntityTooLarge, errors.New("upload is too large"))
+		return
+	}
+
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		SendHttpJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	// uploads without a key are saved under a key of their own
+	k := meta["key"]
+	if meta["bucket"] == "" {
+		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("bucket metadata is required"))
+		return
+	}
+
+	b, err := AuthorizeBucket(r, meta["bucket"], PermissionWrite)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+	if err := b.CheckUpload(k, l, meta["filetype"]); err != nil {
+		sendSaveError(w, err)
+		return
+	}
+
+	u := &Upload{
+		BucketName: b.Name,
+		Key:        k,
+		Type:       meta["filetype"],
+		Length:     l,
+		Metadata:   meta,
+	}
+	if err := u.Create(); err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	setUploadHeaders(w, u)
+	w.Header().Set("Location", JoinUrl("/uploads/"+u.ID.Hex()))
+	SendJson(w, http.StatusCreated, Payload{
+		"message":   "upload created",
+		"upload_id": u.ID.Hex(),
+	})
+}
+
+func HandleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+
+	u, err := authorizeUpload(r)
+	if err != nil {
+		sendUploadError(w, err)
+		return
+	}
+
+	setUploadHeaders(w, u)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func HandleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadLimit)
+	defer r.Body.Close()
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		SendHttpJsonError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/offset+octet-stream"))
+		return
+	}
+	off, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || off < 0 {
+		SendHttpJsonError(w, http.StatusBadRequest, errors.New("upload offset is required"))
+		return
+	}
+
+	u, err := authorizeUpload(r)
+	if err != nil {
+		sendUploadError(w, err)
+		return
+	}
+
+	// offset is reported even on failure so clients resume from it
+	err = u.WriteChunk(off, r.Body)
+	setUploadHeaders(w, u)
+	if err != nil {
+		sendUploadError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func HandleUploadTermination(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+
+	u, err := authorizeUpload(r)
+	if err != nil {
+		sendUploadError(w, err)
+		return
+	}
+	if err := u.Delete(); err != nil {
+		sendUploadError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+)
+
+// Upload is a resumable upload in progress, chunks are appended to a partial
+// file on the storage backend until the offset reaches the declared length,
+// then it's saved as a normal object
+type Upload struct {
+	mgm.DefaultModel `bson:",inline"`
+	BucketName       string            `bson:"bucket_name" json:"bucket_name"`
+	Key              string            `json:"key"`
+	Type             string            `json:"type"`
+	Length           int64             `json:"length"`
+	Offset           int64             `json:"offset"`
+	Metadata         map[string]string `json:"metadata"`
+	ExpiresAt        time.Time         `bson:"expires_at" json:"expires_at"`
+	ObjectUUID       string            `bson:"object_uuid" json:"object_uuid"`
+}
+
+const (
+	// uploads not touched for this long are dropped
+	UploadTTL = 24 * time.Hour
+
+	uploadsDir = ".uploads"
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload does not exist")
+	ErrUploadOffset   = errors.New("upload offset does not match")
+	ErrUploadLocked   = errors.New("upload is being written by another request")
+)
+
+// path of the partial file in the storage backend
+func (u *Upload) PartialPath() string {
+	return path.Join(uploadsDir, u.ID.Hex())
+}
+
+func (u *Upload) IsComplete() bool {
+	return u.ObjectUUID != ""
+}
+
+func (u *Upload) IsExpired() bool {
+	return u.ExpiresAt.Before(time.Now())
+}
+
+func (u *Upload) Create() error {
+	return CreateUpload(u)
+}
+
+func CreateUpload(u *Upload) error {
+	u.ExpiresAt = time.Now().Add(UploadTTL).UTC()
+	if err := Metadata().CreateUpload(u); err != nil {
+		return err
+	}
+	if _, err := Storage().CreateFile(u.PartialPath(), bytes.NewReader(nil)); err != nil {
+		Metadata().DeleteUpload(u)
+		return err
+	}
+
+	// nothing to wait for
+	if u.Length == 0 {
+		return u.finish()
+	}
+	return nil
+}
+
+// Fetch upload by id, expired uploads are removed once they are touched or
+// by the janitor
+func FetchUpload(id string) (*Upload, error) {
+	u, err := Metadata().FetchUpload(id)
+	if err != nil {
+		if err == ErrRecordNotFound {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	if u.IsExpired() {
+		if err := u.Delete(); err != nil {
+			return nil, err
+		}
+		return nil, ErrUploadNotFound
+	}
+	return u, nil
+}
+
+// upload id -> *sync.RWMutex, chunks of the same upload are written one at a time
+var uploadLocks sync.Map
+
+func lockUpload(id string) (func(), error) {
+	v, _ := uploadLocks.LoadOrStore(id, &sync.RWMutex{})
+	m := v.(*sync.RWMutex)
+	if !m.TryLock() {
+		return nil, ErrUploadLocked
+	}
+	return m.Unlock, nil
+}
+
+// shared lock, multipart parts are stored in parallel but not while the
+// upload is completed or aborted
+func rlockUpload(id string) (func(), error) {
+	v, _ := uploadLocks.LoadOrStore(id, &sync.RWMutex{})
+	m := v.(*sync.RWMutex)
+	if !m.TryRLock() {
+		return nil, ErrUploadLocked
+	}
+	return m.RUnlock, nil
+}
+
+// Append chunk read from r at offset, bytes received before r fails are kept
+// so the client can resume from the new offset
+func (u *Upload) WriteChunk(offset int64, r io.Reader) error {
+	unlock, err := lockUpload(u.ID.Hex())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// reload under lock, another request could have moved the offset
+	cur, err := Metadata().FetchUpload(u.ID.Hex())
+	if err != nil {
+		return err
+	}
+	*u = *cur
+
+	if u.IsComplete() || offset != u.Offset {
+		return ErrUploadOffset
+	}
+
+	// never write past the declared length
+	n, werr := Storage().AppendFile(u.PartialPath(), io.LimitReader(r, u.Length-u.Offset))
+	u.Offset += n
+	u.ExpiresAt = time.Now().Add(UploadTTL).UTC()
+	if err := Metadata().UpdateUpload(u); err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+
+	if u.Offset == u.Length {
+		return u.finish()
+	}
+	return nil
+}
+
+// Save completed upload as a normal object then drop its partial file
+func (u *Upload) finish() error {
+	f, err := Storage().GetFile(u.PartialPath())
+	if err != nil {
+		return err
+	}
+
+	o := &Object{
+		Type: u.Type,
+	}
+	_, err = o.Save(&SaveConfig{
+		BucketID: u.BucketName,
+		Reader:   f,
+		Key:      u.Key,
+		Filename: u.Metadata["filename"],
+	})
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	u.ObjectUUID = o.UUID
+	if err := Metadata().UpdateUpload(u); err != nil {
+		return err
+	}
+	if err := Storage().DeleteFile(u.PartialPath()); err != nil && err != ErrFileNotFound {
+		return err
+	}
+	return nil
+}
+
+// Delete upload and its partial file, fails with ErrUploadLocked while a
+// chunk is being written
+func (u *Upload) Delete() error {
+	unlock, err := lockUpload(u.ID.Hex())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return u.remove()
+}
+
+// remove upload and its partial file, the upload lock must be held
+func (u *Upload) remove() error {
+	err := Storage().DeleteFile(u.PartialPath())
+	if err != nil && err != ErrFileNotFound {
+		return err
+	}
+	if err := Metadata().DeleteUpload(u); err != nil {
+		return err
+	}
+	uploadLocks.Delete(u.ID.Hex())
+	return nil
+}
+
+// Remove uploads expired at t, uploads being written are left for the next
+// run. Returns how many were removed.
+func CleanupUploads(t time.Time) (int, error) {
+	uploads, err := Metadata().FetchUploadsExpiredBefore(t)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range uploads {
+		u := &uploads[i]
+		unlock, err := lockUpload(u.ID.Hex())
+		if err != nil {
+			continue
+		}
+		// a chunk written meanwhile pushed the expiry back
+		cur, err := Metadata().FetchUpload(u.ID.Hex())
+		if err == nil && cur.ExpiresAt.Before(t) {
+			if err = cur.remove(); err == nil {
+				n++
+			}
+		}
+		unlock()
+		if err != nil && err != ErrRecordNotFound {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Periodically remove expired resumable uploads along with their partial files
+func RunUploadJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := CleanupUploads(time.Now())
+		if err != nil {
+			log.Printf("uploads cleanup failed: %v\n", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("uploads cleanup removed %d expired uploads\n", n)
+		}
+	}
+}
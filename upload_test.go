@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestUpload(t *testing.T, b *Bucket, key string, length int64) *Upload {
+	t.Helper()
+	u := &Upload{BucketName: b.Name, Key: key, Type: "image/png", Length: length}
+	if err := CreateUpload(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestWriteChunk(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "uploads")
+	u := newTestUpload(t, b, "a.png", 10)
+
+	if err := u.WriteChunk(0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.WriteChunk(0, strings.NewReader("hello")); err != ErrUploadOffset {
+		t.Errorf("got %v, want offset mismatch", err)
+	}
+	// bytes past the declared length are dropped
+	if err := u.WriteChunk(5, strings.NewReader("world!!")); err != nil {
+		t.Fatal(err)
+	}
+	if !u.IsComplete() || u.Offset != 10 {
+		t.Fatalf("upload not complete at offset %d", u.Offset)
+	}
+
+	o, err := FetchObjectByKey(b.Name, "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.UUID != u.ObjectUUID || o.Size != 10 {
+		t.Errorf("saved object %s of %d bytes", o.UUID, o.Size)
+	}
+	if ok, _ := Storage().Exists(u.PartialPath()); ok {
+		t.Error("partial file kept")
+	}
+}
+
+func TestCleanupUploads(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "uploads")
+	expired := newTestUpload(t, b, "a.png", 10)
+	if err := expired.WriteChunk(0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := Metadata().UpdateUpload(expired); err != nil {
+		t.Fatal(err)
+	}
+	active := newTestUpload(t, b, "b.png", 10)
+
+	// uploads being written are left alone
+	unlock, err := lockUpload(expired.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CleanupUploads(time.Now()); n != 0 || err != nil {
+		t.Errorf("removed %d uploads, %v", n, err)
+	}
+	unlock()
+
+	if n, err := CleanupUploads(time.Now()); n != 1 || err != nil {
+		t.Errorf("removed %d uploads, %v", n, err)
+	}
+	if _, err := FetchUpload(expired.ID.Hex()); err != ErrUploadNotFound {
+		t.Errorf("expired upload fetched: %v", err)
+	}
+	if ok, _ := Storage().Exists(expired.PartialPath()); ok {
+		t.Error("partial file of expired upload kept")
+	}
+	if _, err := FetchUpload(active.ID.Hex()); err != nil {
+		t.Errorf("active upload removed: %v", err)
+	}
+}
+
+func TestDeleteUploadLocked(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "uploads")
+	u := newTestUpload(t, b, "a.png", 10)
+	if err := u.WriteChunk(0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a chunk being written keeps its partial file
+	unlock, err := lockUpload(u.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Delete(); err != ErrUploadLocked {
+		t.Errorf("deleting got %v, want locked", err)
+	}
+	unlock()
+	if ok, _ := Storage().Exists(u.PartialPath()); !ok {
+		t.Error("partial file removed while locked")
+	}
+
+	if err := u.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchUpload(u.ID.Hex()); err != ErrUploadNotFound {
+		t.Errorf("deleted upload fetched: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Every object saved under a key is a version of it, the latest one is what
+// the key resolves to. Version ids are the objects uuids.
+
+var (
+	ErrVersionNotFound       = errors.New("version does not exist")
+	ErrVersionIsDeleteMarker = errors.New("version is a delete marker")
+)
+
+// Enable or suspend versioning, suspending keeps the existing versions
+func (b *Bucket) SetVersioning(enabled bool) error {
+	b.Versioning = enabled
+	return Metadata().UpdateBucket(b)
+}
+
+// Versions of key latest first, delete markers included
+func FetchObjectVersions(bucket string, key string) ([]Object, error) {
+	return Metadata().FetchObjectVersions(bucket, CleanKey(key))
+}
+
+// Fetch version by id making sure it belongs to bucket
+func FetchObjectVersion(bucket string, id string) (*Object, error) {
+	o, err := FetchObject(id)
+	if err != nil {
+		if err == ErrRecordNotFound {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+	if o.BucketName != bucket {
+		return nil, ErrVersionNotFound
+	}
+	return o, nil
+}
+
+// Delete key, versioned buckets keep its versions and get a delete marker on
+// top which is returned. Otherwise the null versions of key are removed, when
+// versions saved before versioning was suspended are left a delete marker
+// still hides them.
+func DeleteObjectKey(b *Bucket, key string) (*Object, error) {
+	if _, err := FetchObjectByKey(b.Name, key); err != nil {
+		return nil, err
+	}
+
+	if b.Versioning {
+		return createDeleteMarker(b, key, true)
+	}
+
+	vs, err := FetchObjectVersions(b.Name, key)
+	if err != nil {
+		return nil, err
+	}
+	versioned := false
+	for _, v := range vs {
+		if v.Versioned {
+			versioned = true
+			continue
+		}
+		if err := DeleteObject(v.UUID); err != nil && err != ErrRecordNotFound {
+			return nil, err
+		}
+	}
+	if versioned {
+		return createDeleteMarker(b, key, false)
+	}
+	return nil, nil
+}
+
+func createDeleteMarker(b *Bucket, key string, versioned bool) (*Object, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	m := &Object{
+		UUID:         id.String(),
+		BucketName:   b.Name,
+		Key:          CleanKey(key),
+		DeleteMarker: true,
+		Versioned:    versioned,
+	}
+	if err := Metadata().CreateObject(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Delete the null versions of o key saved before it, delete markers
+// included. Versions saved in the same millisecond are left for the next
+// save so concurrent saves can't delete each other.
+func replaceNullVersions(o *Object) error {
+	vs, err := FetchObjectVersions(o.BucketName, o.Key)
+	if err != nil {
+		return err
+	}
+	saved := o.CreatedAt.Truncate(time.Millisecond)
+	for _, v := range vs {
+		if v.Versioned || v.UUID == o.UUID || !v.CreatedAt.Truncate(time.Millisecond).Before(saved) {
+			continue
+		}
+		if err := DeleteObject(v.UUID); err != nil && err != ErrRecordNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore version by saving a copy of it as the latest version of its key,
+// versions saved with a customer key are copied encrypted with the same key
+func RestoreObjectVersion(v *Object, customerKey []byte) (*Object, error) {
+	if v.DeleteMarker {
+		return nil, ErrVersionIsDeleteMarker
+	}
+
+	f, err := OpenObject(v, customerKey)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &SaveConfig{
+		BucketID: v.BucketName,
+		Reader:   f,
+		Key:      v.Key,
+		Filename: v.Filename,
+		Tags:     v.Tags,
+	}
+	if v.CustomerKeySHA256 != "" {
+		cfg.CustomerKey = customerKey
+	}
+	o := &Object{
+		Type: v.Type,
+	}
+	if _, err := o.Save(cfg); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// uuids of key versions latest first
+func versionIDs(t *testing.T, b *Bucket, key string) []string {
+	t.Helper()
+	vs, err := FetchObjectVersions(b.Name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, v := range vs {
+		ids = append(ids, v.UUID)
+	}
+	return ids
+}
+
+func setVersioning(t *testing.T, b *Bucket, enabled bool) {
+	t.Helper()
+	if err := b.SetVersioning(enabled); err != nil {
+		t.Fatal(err)
+	}
+	// versions saved in the same millisecond aren't told apart
+	time.Sleep(2 * time.Millisecond)
+}
+
+func TestSaveReplacesObjectWithoutVersioning(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "plain")
+	saveTestObject(t, b, "a.png", "first")
+	time.Sleep(2 * time.Millisecond)
+	o := saveTestObject(t, b, "a.png", "second")
+
+	if got := versionIDs(t, b, "a.png"); len(got) != 1 || got[0] != o.UUID {
+		t.Errorf("got versions %v, want only %s", got, o.UUID)
+	}
+	u, err := Metadata().FetchBucketUsage(b.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Objects != 1 || u.Bytes != int64(len("second")) {
+		t.Errorf("got usage %+v, want the latest object only", u)
+	}
+
+	if m, err := DeleteObjectKey(b, "a.png"); err != nil || m != nil {
+		t.Fatalf("got marker %v, %v", m, err)
+	}
+	if got := versionIDs(t, b, "a.png"); len(got) != 0 {
+		t.Errorf("versions left %v", got)
+	}
+}
+
+func TestVersioningKeepsVersions(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "versioned")
+	setVersioning(t, b, true)
+	v1 := saveTestObject(t, b, "a.png", "v1")
+	time.Sleep(2 * time.Millisecond)
+	v2 := saveTestObject(t, b, "a.png", "v2")
+	time.Sleep(2 * time.Millisecond)
+
+	m, err := DeleteObjectKey(b, "a.png")
+	if err != nil || m == nil {
+		t.Fatalf("got marker %v, %v", m, err)
+	}
+	if _, err := FetchObjectByKey(b.Name, "a.png"); err != ErrRecordNotFound {
+		t.Errorf("deleted key fetched: %v", err)
+	}
+	want := []string{m.UUID, v2.UUID, v1.UUID}
+	if got := versionIDs(t, b, "a.png"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got versions %v, want %v", got, want)
+	}
+
+	// deleting the marker brings the key back
+	if err := DeleteObject(m.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if o, err := FetchObjectByKey(b.Name, "a.png"); err != nil || o.UUID != v2.UUID {
+		t.Errorf("got %v, %v, want version %s", o, err, v2.UUID)
+	}
+}
+
+func TestSuspendedVersioning(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "suspended")
+	setVersioning(t, b, true)
+	v1 := saveTestObject(t, b, "a.png", "v1")
+	time.Sleep(2 * time.Millisecond)
+	v2 := saveTestObject(t, b, "a.png", "v2")
+	setVersioning(t, b, false)
+
+	saveTestObject(t, b, "a.png", "null 1")
+	time.Sleep(2 * time.Millisecond)
+	null := saveTestObject(t, b, "a.png", "null 2")
+	time.Sleep(2 * time.Millisecond)
+
+	// only the null version is replaced
+	want := []string{null.UUID, v2.UUID, v1.UUID}
+	if got := versionIDs(t, b, "a.png"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got versions %v, want %v", got, want)
+	}
+
+	// deleting removes the null version and hides the older ones
+	m, err := DeleteObjectKey(b, "a.png")
+	if err != nil || m == nil {
+		t.Fatalf("got marker %v, %v", m, err)
+	}
+	want = []string{m.UUID, v2.UUID, v1.UUID}
+	if got := versionIDs(t, b, "a.png"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got versions %v, want %v", got, want)
+	}
+	if _, err := FetchObjectByKey(b.Name, "a.png"); err != ErrRecordNotFound {
+		t.Errorf("deleted key fetched: %v", err)
+	}
+
+	// saving again replaces the null delete marker
+	time.Sleep(2 * time.Millisecond)
+	o := saveTestObject(t, b, "a.png", "null 3")
+	want = []string{o.UUID, v2.UUID, v1.UUID}
+	if got := versionIDs(t, b, "a.png"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got versions %v, want %v", got, want)
+	}
+}
+
+func TestRestoreObjectVersion(t *testing.T) {
+	setupStores(t)
+	b := newTestBucket(t, "versioned")
+	setVersioning(t, b, true)
+	v1 := saveTestObject(t, b, "a.png", "v1")
+	time.Sleep(2 * time.Millisecond)
+	saveTestObject(t, b, "a.png", "v2")
+	time.Sleep(2 * time.Millisecond)
+
+	o, err := RestoreObjectVersion(v1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := FetchObjectByKey(b.Name, "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.UUID != o.UUID || latest.SHA256 != v1.SHA256 {
+		t.Errorf("latest %s isn't a copy of %s", latest.UUID, v1.UUID)
+	}
+	if got := versionIDs(t, b, "a.png"); len(got) != 3 {
+		t.Errorf("got %d versions, want 3", len(got))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type versioningPayload struct {
+	Enabled *bool `json:"enabled" validate:"required"`
+}
+
+func HandleBucketVersioning(w http.ResponseWriter, r *http.Request) {
+	var payload versioningPayload
+	if err := ParseAndValidate(r, &payload); err != nil {
+		SendValidationError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	defer r.Body.Close()
+
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionAdmin)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := b.SetVersioning(*payload.Enabled); err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"message":    "bucket versioning updated",
+		"versioning": b.Versioning,
+	})
+}
+
+func HandleObjectVersionsFetch(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("key is required"))
+		return
+	}
+
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionRead)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	vs, err := FetchObjectVersions(b.Name, key)
+	if err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(vs) == 0 {
+		SendHttpJsonError(w, http.StatusNotFound, ErrRecordNotFound)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"key":      CleanKey(key),
+		"latest":   vs[0].UUID,
+		"versions": vs,
+	})
+}
+
+// Fetch version in bucket of the request after checking principal perm
+func fetchRequestVersion(r *http.Request, perm Permission) (*Object, error) {
+	vars := mux.Vars(r)
+	if _, err := AuthorizeBucket(r, vars["name"], perm); err != nil {
+		return nil, err
+	}
+	return FetchObjectVersion(vars["name"], vars["version"])
+}
+
+func HandleObjectVersionFetch(w http.ResponseWriter, r *http.Request) {
+	v, err := fetchRequestVersion(r, PermissionRead)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+	SendJson(w, http.StatusOK, Payload{"version": v})
+}
+
+func HandleObjectVersionRestore(w http.ResponseWriter, r *http.Request) {
+	v, err := fetchRequestVersion(r, PermissionWrite)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+	key, err := ParseCustomerKey(r.Header)
+	if err != nil {
+		SendHttpJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	o, err := RestoreObjectVersion(v, key)
+	if err != nil {
+		if err == ErrVersionIsDeleteMarker {
+			SendHttpJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		sendSaveError(w, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{
+		"message": "version restored",
+		"uuid":    o.UUID,
+	})
+}
+
+// Delete version permanently, deleting a delete marker brings the key back
+func HandleObjectVersionDeletion(w http.ResponseWriter, r *http.Request) {
+	v, err := fetchRequestVersion(r, PermissionWrite)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	if err := DeleteObject(v.UUID); err != nil {
+		SendHttpJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	SendJson(w, http.StatusOK, Payload{"message": "version deleted"})
+}
+
+// Delete object by key, versioned buckets get a delete marker
+func HandleObjectKeyDeletion(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		SendHttpJsonError(w, http.StatusUnprocessableEntity, errors.New("key is required"))
+		return
+	}
+
+	b, err := AuthorizeBucket(r, mux.Vars(r)["name"], PermissionWrite)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	m, err := DeleteObjectKey(b, key)
+	if err != nil {
+		SendAccessError(w, err)
+		return
+	}
+
+	p := Payload{"message": "object deleted"}
+	if m != nil {
+		p["delete_marker"] = m.UUID
+	}
+	SendJson(w, http.StatusOK, p)
+}